@@ -0,0 +1,81 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type audit struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// AuditBody sets a Writer that will be written a frame containing the method,
+// URL, headers and body of every request received by the Proxy. Passing nil
+// disables auditing.
+//
+// Each frame starts with a "=== BEGIN <uuid> <length>" line and ends with a
+// "=== END <uuid>" line, where the UUID is the same as the UUID of any Results
+// of the request. Frames are written using a single Write call and writes are
+// serialized, so frames are never interleaved. The body of streamed requests
+// is not written.
+func (p *Proxy) AuditBody(w io.Writer) {
+	var a *audit
+	if w != nil {
+		a = &audit{w: w}
+	}
+	p.lock.Lock()
+	p.audit = a
+	p.lock.Unlock()
+}
+
+// AuditBodyLimit sets the maximum number of body bytes that will be written in
+// each AuditBody frame. Larger bodies will be truncated, but the length in the
+// frame header will always be the full body length.
+//
+// A value of zero or less disables the limit (the default). The limit can be
+// set before or after AuditBody is configured.
+func (p *Proxy) AuditBodyLimit(n int) {
+	p.lock.Lock()
+	p.auditMax = n
+	p.lock.Unlock()
+}
+func (a *audit) write(r *http.Request, t *transfer, n int) {
+	var (
+		b bytes.Buffer
+		d = t.data
+	)
+	if n > 0 && len(d) > n {
+		d = d[:n]
+	}
+	b.Grow(len(d) + 512)
+	b.WriteString("=== BEGIN " + t.id + " " + strconv.Itoa(len(t.data)) + "\n")
+	b.WriteString(r.Method + " " + r.URL.RequestURI() + " " + r.Proto + "\n")
+	b.WriteString("Host: " + r.Host + "\n")
+	r.Header.Write(&b)
+	b.WriteByte('\n')
+	b.Write(d)
+	b.WriteString("\n=== END " + t.id + "\n")
+	a.lock.Lock()
+	a.w.Write(b.Bytes())
+	a.lock.Unlock()
+}
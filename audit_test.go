@@ -0,0 +1,76 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+type buffer struct {
+	b    bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.b.Write(p)
+}
+func (b *buffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.b.String()
+}
+func TestAuditBody(t *testing.T) {
+	var (
+		b buffer
+		c = make(chan string, 2)
+	)
+	s := switchproxytest.NewSwitch(t, http.NotFoundHandler())
+	s.Pre = func(r switchproxy.Result) { c <- r.UUID }
+	p := switchproxytest.NewProxy(t, s)
+	// Set before 'AuditBody', which must not reset it.
+	p.AuditBodyLimit(4)
+	p.AuditBody(&b)
+	post(t, p.URL+"/first", "0123456789")
+	post(t, p.URL+"/second", "ab")
+	v := b.String()
+	for _, u := range []string{<-c, <-c} {
+		if !strings.Contains(v, "=== BEGIN "+u+" ") || !strings.Contains(v, "=== END "+u+"\n") {
+			t.Fatalf("audit output has no frame for %s:\n%s", u, v)
+		}
+	}
+	if strings.Count(v, "=== BEGIN ") != 2 {
+		t.Fatalf("audit output has %d frames, want 2", strings.Count(v, "=== BEGIN "))
+	}
+	if !strings.Contains(v, "POST /first HTTP/1.1\n") || !strings.Contains(v, " 10\n") || !strings.Contains(v, "\n0123\n===") {
+		t.Fatalf("first frame is missing the request line, length or truncated body:\n%s", v)
+	}
+	if strings.Contains(v, "01234") {
+		t.Fatalf("body was not truncated to the limit:\n%s", v)
+	}
+	if !strings.Contains(v, "\nab\n===") {
+		t.Fatalf("second frame is missing the body:\n%s", v)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type entry struct {
+	t    time.Time
+	v    Result
+	d    time.Duration
+	w    time.Duration
+	e    time.Duration
+	busy atomic.Bool
+}
+type cache struct {
+	m    map[key]*entry
+	ttl  time.Duration
+	size int
+	lock sync.Mutex
+}
+
+// Cache enables a response cache on the Proxy, which will store up to the
+// specified number of GET responses from the primary Switch.
+//
+// Only 200 responses that allow being stored by a shared cache are stored,
+// which excludes responses with "no-store", "no-cache" or "private" in the
+// "Cache-Control" header, and responses with a "Vary" or "Set-Cookie" header.
+// Requests with an "Authorization" header are not cached. Responses are fresh
+// for the "s-maxage" or "max-age" time, or for the ttl if neither are set. An
+// "ETag" header is added to stored responses that do not have one.
+//
+// Fresh responses are returned to clients without contacting the primary
+// Switch and conditional requests ("If-None-Match" or "If-Modified-Since")
+// that match them receive a 304 response. Secondary Switches still receive all
+// requests. A size of zero or less disables the cache.
+//
+// Responses with the "stale-while-revalidate" directive are returned to clients
+// for up to the specified number of seconds after they become stale, while a
+// single background request to the primary Switch refreshes them. Responses with
+// the "stale-if-error" directive are returned instead of an error (or a 5xx
+// response) for up to the specified number of seconds after they become stale.
+func (p *Proxy) Cache(size int, ttl time.Duration) {
+	var c *cache
+	if size > 0 {
+		c = &cache{m: make(map[key]*entry, size), ttl: ttl, size: size}
+	}
+	p.lock.Lock()
+	p.cache = c
+	p.lock.Unlock()
+}
+
+// CacheWhen sets a Matcher that limits the response cache to only the requests
+// that it matches. Requests that do not match are not stored or returned from the
+// cache. Passing nil removes the Matcher, so all GET requests can be cached.
+func (p *Proxy) CacheWhen(m Matcher) {
+	p.lock.Lock()
+	p.cacheWhen = m
+	p.lock.Unlock()
+}
+
+// ServeStale sets if the Proxy will return the last cached response for a request
+// when the primary Switch is unhealthy (according to its health check), even if
+// the response is no longer fresh. This requires the cache to be enabled with
+// 'Cache'.
+//
+// When this is enabled and the primary Switch is unhealthy, requests are handled
+// in this order:
+//
+//  1. The last cached response, if there is one.
+//  2. The 'MaintenanceResponse', if set.
+//  3. A 503 response.
+//
+// Requests are always sent to a healthy primary Switch as normal. When this is
+// not enabled, requests are sent to an unhealthy primary Switch, unless the
+// 'MaintenanceResponse' is set.
+func (p *Proxy) ServeStale(e bool) {
+	p.lock.Lock()
+	p.stale = e
+	p.lock.Unlock()
+}
+func (o *config) degrade(s *Switch, r *http.Request, t *transfer) (Result, bool, bool) {
+	if s == nil || s.Healthy() {
+		return Result{}, false, false
+	}
+	if o.stale && o.cache != nil && r.Method == http.MethodGet && o.cacheWhen.match(r) {
+		if e := o.cache.get(requestKey(s, r)); e != nil {
+			return e.result(r, t, time.Since(e.t)), true, true
+		}
+	}
+	return Result{}, false, o.stale || o.down != nil
+}
+func (c *cache) get(k key) *entry {
+	c.lock.Lock()
+	e := c.m[k]
+	c.lock.Unlock()
+	return e
+}
+func (c *cache) put(k key, r *http.Request, v Result) {
+	if v.Status != http.StatusOK || v.Failover || len(r.Header.Get("Authorization")) > 0 {
+		return
+	}
+	if len(v.Headers.Values("Vary")) > 0 || len(v.Headers.Values("Set-Cookie")) > 0 {
+		return
+	}
+	if cacheControl(r.Header, "no-store") {
+		return
+	}
+	d, ok := c.fresh(v.Headers)
+	if !ok {
+		return
+	}
+	w, _ := cacheSeconds(v.Headers, "stale-while-revalidate")
+	s, _ := cacheSeconds(v.Headers, "stale-if-error")
+	if d+max(w, s) <= 0 {
+		return
+	}
+	if len(v.Headers.Get("ETag")) == 0 {
+		h := sha256.Sum256(v.Content)
+		// Set on the original Headers, so the client that caused the response
+		// to be stored also receives the ETag.
+		v.Headers.Set("ETag", `"`+hex.EncodeToString(h[:16])+`"`)
+	}
+	v.Headers, v.Content = v.Headers.Clone(), append([]byte(nil), v.Content...)
+	c.lock.Lock()
+	if _, ok := c.m[k]; !ok && len(c.m) >= c.size {
+		c.evict()
+	}
+	c.m[k] = &entry{t: time.Now(), v: v, d: d, w: w, e: s}
+	c.lock.Unlock()
+}
+func (c *cache) evict() {
+	for k, e := range c.m {
+		if time.Since(e.t) >= e.d+max(e.w, e.e) {
+			delete(c.m, k)
+		}
+	}
+	if len(c.m) < c.size {
+		return
+	}
+	// Nothing has expired, so remove any entry to make room.
+	for k := range c.m {
+		delete(c.m, k)
+		break
+	}
+}
+func (c *cache) fresh(h http.Header) (time.Duration, bool) {
+	if cacheControl(h, "no-store") || cacheControl(h, "no-cache") || cacheControl(h, "private") {
+		return 0, false
+	}
+	v, ok := cacheSeconds(h, "s-maxage")
+	if !ok {
+		v, ok = cacheSeconds(h, "max-age")
+	}
+	if !ok {
+		return c.ttl, c.ttl > 0
+	}
+	return v, true
+}
+func (e *entry) result(r *http.Request, t *transfer, a time.Duration) Result {
+	v := e.v
+	v.UUID, v.IP, v.Headers = t.id, r.RemoteAddr, e.v.Headers.Clone()
+	v.Headers.Set("Age", strconv.Itoa(int(a/time.Second)))
+	return v
+}
+func cacheValue(h http.Header, d string) (string, bool) {
+	for _, v := range h.Values("Cache-Control") {
+		for _, e := range strings.Split(v, ",") {
+			k, x, _ := strings.Cut(strings.TrimSpace(e), "=")
+			if strings.EqualFold(k, d) {
+				return strings.Trim(x, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+func cacheSeconds(h http.Header, d string) (time.Duration, bool) {
+	v, ok := cacheValue(h, d)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+func cacheControl(h http.Header, d string) bool {
+	_, ok := cacheValue(h, d)
+	return ok
+}
+func notModified(r *http.Request, h http.Header) bool {
+	if m := r.Header.Get("If-None-Match"); len(m) > 0 {
+		e := h.Get("ETag")
+		for _, v := range strings.Split(m, ",") {
+			// Weak comparison is used, as the requests are only GET requests.
+			if v = strings.TrimSpace(v); v == "*" || (len(e) > 0 && strings.TrimPrefix(v, "W/") == strings.TrimPrefix(e, "W/")) {
+				return true
+			}
+		}
+		// If-Modified-Since is ignored when If-None-Match is present.
+		return false
+	}
+	s, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	l, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !l.After(s)
+}
+func writeNotModified(w http.ResponseWriter, h http.Header) {
+	for _, k := range [...]string{"Age", "ETag", "Last-Modified", "Cache-Control", "Expires", "Content-Location"} {
+		if v := h.Values(k); len(v) > 0 {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+func (p *Proxy) fetch(o *config, s *Switch, r *http.Request, t *transfer) (*Switch, Result, bool, error) {
+	var (
+		k key
+		c bool
+		e *entry
+	)
+	if c = o.cache != nil && r.Method == http.MethodGet && o.cacheWhen.match(r); c {
+		// Requests with the same URL can be routed to different Switches, so the
+		// Switch is part of the key.
+		if k = requestKey(s, r); !cacheControl(r.Header, "no-cache") {
+			e = o.cache.get(k)
+		}
+		if e != nil {
+			switch a := time.Since(e.t); {
+			case a < e.d:
+				return s, e.result(r, t, a), true, nil
+			case a < e.d+e.w:
+				// Only one refresh is started for each entry, any other requests
+				// are served the stale response until it is replaced.
+				if e.busy.CompareAndSwap(false, true) {
+					p.revalidate(o, k, e, s, r, t)
+				}
+				return s, e.result(r, t, a), true, nil
+			}
+		}
+	}
+	f := func() (*Switch, Result, error) {
+		x, v, err := p.forward(o, s, r, t)
+		if err == nil && c {
+			o.cache.put(k, r, v)
+		}
+		return x, v, err
+	}
+	var (
+		x   *Switch
+		v   Result
+		err error
+	)
+	if o.group != nil && r.Method == http.MethodGet && !credentials(r) && o.groupWhen.match(r) {
+		x, v, err = o.group.do(r.Context(), requestKey(s, r), f)
+	} else {
+		x, v, err = f()
+	}
+	if e != nil && (err != nil || v.Status >= 500) {
+		if a := time.Since(e.t); a < e.d+e.e {
+			return s, e.result(r, t, a), true, nil
+		}
+	}
+	return x, v, false, err
+}
+func (p *Proxy) revalidate(o *config, k key, e *entry, s *Switch, r *http.Request, t *transfer) {
+	// The request and transfer are reused once the client is answered, so the
+	// refresh uses copies of both and is not cancelled with the client request.
+	n := p.pool.get()
+	n.read.Write(t.data)
+	n.data, n.id = n.read.Bytes(), newUUID()
+	n.in = bytes.NewReader(n.data)
+	q := r.Clone(context.WithoutCancel(r.Context()))
+	q.Body = http.NoBody
+	q.Header.Del("If-None-Match")
+	q.Header.Del("If-Modified-Since")
+	go func() {
+		if _, v, err := p.forward(o, s, q, n); err == nil {
+			o.cache.put(k, q, v)
+		}
+		e.busy.Store(false)
+		p.clear(n)
+	}()
+}
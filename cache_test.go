@@ -0,0 +1,208 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestCacheNotModified(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		io.WriteString(w, "cached")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Minute)
+	if o, b := get(t, p.URL+"/poll"); o.StatusCode != http.StatusOK || b != "cached" {
+		t.Fatalf("first response = %d %q, want 200 from the Switch", o.StatusCode, b)
+	}
+	for i, c := range [...]struct {
+		name, value string
+		status      int
+	}{
+		{"If-None-Match", `"v1"`, http.StatusNotModified},
+		{"If-None-Match", `W/"v1"`, http.StatusNotModified},
+		{"If-None-Match", `"v0", "v1"`, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"v2"`, http.StatusOK},
+		{"If-Modified-Since", "Tue, 03 Jan 2006 15:04:05 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", http.StatusOK},
+	} {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/poll", nil)
+		q.Header.Set(c.name, c.value)
+		o, b := do(t, q)
+		if o.StatusCode != c.status {
+			t.Fatalf("request %d (%s: %s) status = %d, want %d", i, c.name, c.value, o.StatusCode, c.status)
+		}
+		switch {
+		case c.status == http.StatusNotModified && (len(b) > 0 || o.Header.Get("ETag") != `"v1"`):
+			t.Fatalf("request %d 304 body = %q, ETag = %q, want no body and the cached ETag", i, b, o.Header.Get("ETag"))
+		case c.status == http.StatusOK && b != "cached":
+			t.Fatalf("request %d body = %q, want the cached response", i, b)
+		}
+	}
+	if v := n.Load(); v != 1 {
+		t.Fatalf("Switch received %d requests, want only the first", v)
+	}
+}
+func TestCacheSwitch(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "primary")
+	}))
+	j := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "json")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Minute)
+	p.RouteContentType("application/json", j)
+	// Both requests have the same URL, but are routed to different Switches, so
+	// they must not share a cached response.
+	for i := 0; i < 2; i++ {
+		if _, b := get(t, p.URL+"/data"); b != "primary" {
+			t.Fatalf("request %d = %q, want the primary response", i, b)
+		}
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/data", nil)
+		q.Header.Set("Content-Type", "application/json")
+		if _, b := do(t, q); b != "json" {
+			t.Fatalf("JSON request %d = %q, want the routed Switch response", i, b)
+		}
+	}
+}
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var (
+		n atomic.Int64
+		r = make(chan struct{})
+		e = make(chan struct{}, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		v := n.Add(1)
+		if v == 2 {
+			// Hold the refresh until the stale responses are checked.
+			e <- struct{}{}
+			select {
+			case <-r:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=30")
+		io.WriteString(w, "v"+strconv.FormatInt(v, 10))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Minute)
+	if _, b := get(t, p.URL+"/"); b != "v1" {
+		t.Fatalf("first response = %q, want v1", b)
+	}
+	if o, b := get(t, p.URL+"/"); b != "v1" || len(o.Header.Get("Age")) == 0 {
+		t.Fatalf("stale response = %q (Age %q), want the cached v1", b, o.Header.Get("Age"))
+	}
+	select {
+	case <-e:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background refresh was not started")
+	}
+	// Only one refresh runs at a time, so this is served stale without another
+	// request to the Switch.
+	if _, b := get(t, p.URL+"/"); b != "v1" || n.Load() != 2 {
+		t.Fatalf("response during refresh = %q with %d Switch requests, want v1 and 2", b, n.Load())
+	}
+	close(r)
+	for i := 0; i < 100; i++ {
+		if _, b := get(t, p.URL+"/"); b != "v1" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("refreshed response was not stored")
+}
+func TestCacheStaleIfError(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if n.Add(1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=30")
+		io.WriteString(w, "ok")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Minute)
+	for i := 0; i < 2; i++ {
+		if o, b := get(t, p.URL+"/"); o.StatusCode != http.StatusOK || b != "ok" {
+			t.Fatalf("request %d = %d %q, want the cached response", i, o.StatusCode, b)
+		}
+	}
+	if v := n.Load(); v != 2 {
+		t.Fatalf("Switch received %d requests, want 2", v)
+	}
+}
+func TestServeStale(t *testing.T) {
+	var (
+		d atomic.Bool
+		n atomic.Int64
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			n.Add(1)
+		}
+		if d.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "last good")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Millisecond)
+	p.ServeStale(true)
+	if _, b := get(t, p.URL+"/"); b != "last good" {
+		t.Fatalf("response = %q, want the Switch response", b)
+	}
+	d.Store(true)
+	s.HealthCheck(5*time.Millisecond, "/health")
+	defer s.HealthCheck(0, "")
+	for i := 0; i < 100 && s.Healthy(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Healthy() {
+		t.Fatal("Switch is healthy, want it to be marked unhealthy")
+	}
+	// The Switch is unhealthy, so it is not sent any requests.
+	n.Store(0)
+	if o, b := get(t, p.URL+"/"); o.StatusCode != http.StatusOK || b != "last good" || len(o.Header.Get("Age")) == 0 {
+		t.Fatalf("response = %d %q, want the stale cached response", o.StatusCode, b)
+	}
+	if o, _ := get(t, p.URL+"/uncached"); o.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("uncached status = %d, want 503", o.StatusCode)
+	}
+	p.MaintenanceResponse(http.StatusOK, "text/plain", []byte("maintenance"))
+	if _, b := get(t, p.URL+"/uncached"); b != "maintenance" {
+		t.Fatalf("uncached response = %q, want the maintenance response", b)
+	}
+	if v := n.Load(); v != 0 {
+		t.Fatalf("unhealthy Switch received %d requests, want none", v)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errCoalesced is returned to the requests waiting on a coalesced request that
+// panicked before it returned a Result.
+var errCoalesced = errors.New("coalesced request did not complete")
+
+type key struct {
+	s *Switch
+	u string
+}
+type call struct {
+	err  error
+	s    *Switch
+	h    http.Header
+	v    Result
+	done chan struct{}
+}
+type group struct {
+	m    map[key]*call
+	lock sync.Mutex
+}
+
+// Coalesce sets if the Proxy will combine identical concurrent GET requests
+// into a single request to the primary Switch.
+//
+// Requests are identical if they are sent to the same Switch with the same host
+// and URL. While a request is being forwarded, any identical requests will wait
+// for it to finish and will all receive the same response (or error), unless
+// their own client goes away first. Requests with other methods, or with an
+// "Authorization" or "Cookie" header, are not combined, as the response may be
+// specific to the client. Secondary Switches still receive every request.
+func (p *Proxy) Coalesce(e bool) {
+	var g *group
+	if e {
+		g = &group{m: make(map[key]*call)}
+	}
+	p.lock.Lock()
+	p.group = g
+	p.lock.Unlock()
+}
+
+// CoalesceWhen sets a Matcher that limits request coalescing to only the requests
+// that it matches. Passing nil removes the Matcher, so all GET requests can be
+// combined.
+func (p *Proxy) CoalesceWhen(m Matcher) {
+	p.lock.Lock()
+	p.groupWhen = m
+	p.lock.Unlock()
+}
+func requestKey(s *Switch, r *http.Request) key {
+	return key{s: s, u: r.Host + r.URL.RequestURI()}
+}
+func credentials(r *http.Request) bool {
+	return len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Cookie")) > 0
+}
+func (g *group) do(x context.Context, k key, f func() (*Switch, Result, error)) (*Switch, Result, error) {
+	g.lock.Lock()
+	if c, ok := g.m[k]; ok {
+		g.lock.Unlock()
+		// Waiting requests stop once their own client is gone, without
+		// affecting the request being forwarded.
+		select {
+		case <-c.done:
+		case <-x.Done():
+			return k.s, Result{}, x.Err()
+		}
+		// Each waiting request gets its own Headers, so changes made while
+		// writing one response can not affect the others.
+		v := c.v
+		v.Headers = c.h.Clone()
+		return c.s, v, c.err
+	}
+	c := &call{s: k.s, err: errCoalesced, done: make(chan struct{})}
+	g.m[k] = c
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		delete(g.m, k)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+	s, v, err := f()
+	// The content buffer will be reused once the request is done, so the waiting
+	// requests need their own copy.
+	v.Content = append([]byte(nil), v.Content...)
+	c.s, c.v, c.h, c.err = s, v, v.Headers.Clone(), err
+	return s, v, err
+}
@@ -0,0 +1,229 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+// burst sends n concurrent requests created by f and returns the response
+// status codes and bodies.
+func burst(t *testing.T, n int, f func() *http.Request) ([]int, []string) {
+	t.Helper()
+	var (
+		g sync.WaitGroup
+		c = make([]int, n)
+		b = make([]string, n)
+	)
+	for i := 0; i < n; i++ {
+		g.Add(1)
+		go func(i int) {
+			defer g.Done()
+			o, err := http.DefaultClient.Do(f())
+			if err != nil {
+				t.Errorf("request failed: %s", err)
+				return
+			}
+			var v [64]byte
+			k, _ := o.Body.Read(v[:])
+			o.Body.Close()
+			c[i], b[i] = o.StatusCode, string(v[:k])
+		}(i)
+	}
+	g.Wait()
+	return c, b
+}
+
+// slow returns a Handler that counts requests and waits before responding, so
+// concurrent requests overlap.
+func slow(n *atomic.Int64, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		h(w, r)
+	})
+}
+func TestCoalesce(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, slow(&n, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Shared", "1")
+		w.Write([]byte("shared"))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Coalesce(true)
+	// The Via header is added to each response, which must not affect the
+	// Headers of the other waiting requests.
+	p.Via("edge")
+	c, b := burst(t, 10, func() *http.Request {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/expensive", nil)
+		return q
+	})
+	if v := n.Load(); v != 1 {
+		t.Fatalf("upstream received %d requests, want 1", v)
+	}
+	for i := range c {
+		if c[i] != http.StatusOK || b[i] != "shared" {
+			t.Fatalf("response %d = %d %q, want the shared response", i, c[i], b[i])
+		}
+	}
+}
+func TestCoalesceError(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, slow(&n, func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Coalesce(true)
+	c, _ := burst(t, 5, func() *http.Request {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+		return q
+	})
+	if v := n.Load(); v != 1 {
+		t.Fatalf("upstream received %d requests, want 1", v)
+	}
+	for i := range c {
+		if c[i] != http.StatusBadGateway {
+			t.Fatalf("response %d = %d, want the shared 502 error", i, c[i])
+		}
+	}
+}
+func TestCoalesceCredentials(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, slow(&n, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization") + r.Header.Get("Cookie")))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Coalesce(true)
+	var i atomic.Int64
+	_, b := burst(t, 6, func() *http.Request {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/account", nil)
+		if v := i.Add(1); v%2 == 0 {
+			q.Header.Set("Authorization", "user"+strconv.FormatInt(v, 10))
+		} else {
+			q.Header.Set("Cookie", "user"+strconv.FormatInt(v, 10))
+		}
+		return q
+	})
+	if v := n.Load(); v != 6 {
+		t.Fatalf("upstream received %d requests, want every request with credentials", v)
+	}
+	m := make(map[string]bool)
+	for _, v := range b {
+		m[v] = true
+	}
+	if len(m) != 6 {
+		t.Fatalf("responses = %q, want each client to get its own response", b)
+	}
+}
+func TestCoalesceSwitch(t *testing.T) {
+	var a, b atomic.Int64
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, slow(&a, func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("primary"))
+	})))
+	v := httptest.NewServer(slow(&b, func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("route"))
+	}))
+	defer v.Close()
+	if _, err := p.AddRoute(switchproxy.Route{Match: switchproxy.MatchHeader("X-Beta"), Target: v.URL}); err != nil {
+		t.Fatalf("add route failed: %s", err)
+	}
+	p.Coalesce(true)
+	var i atomic.Int64
+	_, r := burst(t, 8, func() *http.Request {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/same", nil)
+		if i.Add(1)%2 == 0 {
+			q.Header.Set("X-Beta", "1")
+		}
+		return q
+	})
+	if a.Load() != 1 || b.Load() != 1 {
+		t.Fatalf("Switches received %d and %d requests, want one each", a.Load(), b.Load())
+	}
+	var x, y int
+	for _, v := range r {
+		switch v {
+		case "primary":
+			x++
+		case "route":
+			y++
+		}
+	}
+	if x != 4 || y != 4 {
+		t.Fatalf("responses = %q, want each request to get the response of its own Switch", r)
+	}
+}
+func TestCoalescePanic(t *testing.T) {
+	var (
+		g = switchproxy.NewGroup()
+		r = make(chan struct{})
+		e = make(chan error, 1)
+		d = make(chan struct{})
+	)
+	go func() {
+		defer func() { recover() }()
+		g.Do(context.Background(), "k", func() error {
+			close(r)
+			<-d
+			panic("upstream")
+		})
+	}()
+	<-r
+	go func() {
+		e <- g.Do(context.Background(), "k", func() error { return errors.New("not coalesced") })
+	}()
+	x, f := context.WithCancel(context.Background())
+	c := make(chan error, 1)
+	go func() {
+		c <- g.Do(x, "k", func() error { return errors.New("not coalesced") })
+	}()
+	// The waiting request stops when its own context is done, while the first
+	// request is still running.
+	f()
+	select {
+	case err := <-c:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled waiter err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled waiter did not return")
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(d)
+	select {
+	case err := <-e:
+		if err == nil || err.Error() == "not coalesced" {
+			t.Fatalf("waiter err = %v, want the coalesced request error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not released after the panic")
+	}
+	// The key is removed after the panic, so the next call runs again.
+	if err := g.Do(context.Background(), "k", func() error { return nil }); err != nil {
+		t.Fatalf("call after the panic err = %v, want nil", err)
+	}
+}
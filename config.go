@@ -0,0 +1,77 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"errors"
+	"time"
+)
+
+// Config is a struct that contains the configuration options of a Proxy. It
+// can be used to create a Proxy using the 'NewFromConfig' function.
+//
+// Any timeout values that are zero will use the DefaultTimeout value.
+type Config struct {
+	Listen            string        `json:"listen"`
+	Cert              string        `json:"cert"`
+	Key               string        `json:"key"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	MaxBodySize       int64         `json:"max_body_size"`
+	MaxHeaderBytes    int           `json:"max_header_bytes"`
+}
+
+// Validate returns an error if any of the Config values are invalid.
+func (c Config) Validate() error {
+	switch {
+	case len(c.Cert) > 0 && len(c.Key) == 0:
+		return errors.New("certificate specified without a key")
+	case len(c.Key) > 0 && len(c.Cert) == 0:
+		return errors.New("key specified without a certificate")
+	case c.ReadTimeout < 0, c.WriteTimeout < 0, c.IdleTimeout < 0, c.ReadHeaderTimeout < 0:
+		return errors.New("timeout values cannot be negative")
+	case c.MaxBodySize < 0:
+		return errors.New("max body size cannot be negative")
+	case c.MaxHeaderBytes < 0:
+		return errors.New("max header bytes cannot be negative")
+	}
+	return nil
+}
+
+// NewFromConfig creates a new Proxy instance from the specified Config. This
+// function returns an error if the Config is invalid.
+func NewFromConfig(c Config) (*Proxy, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	p := New(c.Listen, MaxBodySize(c.MaxBodySize))
+	if len(c.Cert) > 0 {
+		p.key, p.cert = c.Key, c.Cert
+	}
+	p.server.ReadTimeout, p.server.WriteTimeout = timeout(c.ReadTimeout), timeout(c.WriteTimeout)
+	p.server.IdleTimeout, p.server.ReadHeaderTimeout = timeout(c.IdleTimeout), timeout(c.ReadHeaderTimeout)
+	p.server.MaxHeaderBytes = c.MaxHeaderBytes
+	return p, nil
+}
+func timeout(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultTimeout
+	}
+	return d
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		c    switchproxy.Config
+		ok   bool
+	}{
+		{"empty", switchproxy.Config{}, true},
+		{"tls", switchproxy.Config{Cert: "cert.pem", Key: "key.pem"}, true},
+		{"cert without key", switchproxy.Config{Cert: "cert.pem"}, false},
+		{"key without cert", switchproxy.Config{Key: "key.pem"}, false},
+		{"negative timeout", switchproxy.Config{IdleTimeout: -1}, false},
+		{"negative body size", switchproxy.Config{MaxBodySize: -1}, false},
+		{"negative header bytes", switchproxy.Config{MaxHeaderBytes: -1}, false},
+	} {
+		if _, err := switchproxy.NewFromConfig(v.c); (err == nil) != v.ok {
+			t.Errorf("%s: NewFromConfig error = %v, want ok = %t", v.name, err, v.ok)
+		}
+	}
+}
+func TestNewFromConfig(t *testing.T) {
+	p, err := switchproxy.NewFromConfig(switchproxy.Config{
+		Listen:         "127.0.0.1:8080",
+		ReadTimeout:    time.Minute,
+		MaxHeaderBytes: 4096,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig failed: %s", err)
+	}
+	s := switchproxy.Server(p)
+	if s.Addr != "127.0.0.1:8080" || s.MaxHeaderBytes != 4096 {
+		t.Fatalf("server Addr = %q, MaxHeaderBytes = %d, want the Config values", s.Addr, s.MaxHeaderBytes)
+	}
+	if s.ReadTimeout != time.Minute {
+		t.Fatalf("ReadTimeout = %s, want %s", s.ReadTimeout, time.Minute)
+	}
+	if s.WriteTimeout != switchproxy.DefaultTimeout || s.IdleTimeout != switchproxy.DefaultTimeout || s.ReadHeaderTimeout != switchproxy.DefaultTimeout {
+		t.Fatalf("unset timeouts = %s, %s, %s, want DefaultTimeout", s.WriteTimeout, s.IdleTimeout, s.ReadHeaderTimeout)
+	}
+}
+func TestNewDefaultTimeout(t *testing.T) {
+	if s := switchproxy.Server(switchproxy.New("")); s.ReadTimeout != switchproxy.DefaultTimeout || s.WriteTimeout != switchproxy.DefaultTimeout {
+		t.Fatalf("timeouts = %s, %s, want DefaultTimeout without parameters", s.ReadTimeout, s.WriteTimeout)
+	}
+	// Any parameter disables the default timeouts, as before.
+	if s := switchproxy.Server(switchproxy.New("", switchproxy.MaxBodySize(1))); s.ReadTimeout != 0 || s.WriteTimeout != 0 {
+		t.Fatalf("timeouts = %s, %s, want none with parameters", s.ReadTimeout, s.WriteTimeout)
+	}
+	s := switchproxy.Server(switchproxy.New("", switchproxy.Timeout(time.Second)))
+	if s.ReadTimeout != time.Second || s.IdleTimeout != time.Second {
+		t.Fatalf("timeouts = %s, %s, want the Timeout parameter", s.ReadTimeout, s.IdleTimeout)
+	}
+}
+func TestIdleTimeout(t *testing.T) {
+	s := switchproxy.Server(switchproxy.New("", switchproxy.IdleTimeout(time.Minute)))
+	if s.IdleTimeout != time.Minute {
+		t.Fatalf("IdleTimeout = %s, want %s", s.IdleTimeout, time.Minute)
+	}
+	if s.ReadTimeout != 0 || s.WriteTimeout != 0 || s.ReadHeaderTimeout != 0 {
+		t.Fatalf("request timeouts = %s, %s, %s, want them unchanged", s.ReadTimeout, s.WriteTimeout, s.ReadHeaderTimeout)
+	}
+	s = switchproxy.Server(switchproxy.New("", switchproxy.Timeout(time.Second), switchproxy.IdleTimeout(time.Minute)))
+	if s.IdleTimeout != time.Minute || s.ReadTimeout != time.Second || s.WriteTimeout != time.Second {
+		t.Fatalf("timeouts = %s, %s, %s, want IdleTimeout to only replace the idle timeout", s.IdleTimeout, s.ReadTimeout, s.WriteTimeout)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"net/url"
+)
+
+// ContextKey is the type of the key used to store an *Info value in the context
+// of requests processed by a Proxy.
+type ContextKey struct{}
+
+type (
+	targetKey   struct{}
+	redirectKey struct{}
+)
+
+// Info is a struct that contains the information of a request that is
+// processed by a Proxy. The UUID field is the correlation UUID that is used in
+// all Results of the request.
+type Info struct {
+	UUID string
+}
+
+// WithInfo returns a copy of the context that contains an empty *Info value.
+//
+// Middleware that wraps a Proxy can use this on the request context before
+// passing it to the Proxy, which will fill the *Info value, so that it can be
+// read using 'FromContext' after the Proxy returns.
+func WithInfo(x context.Context) context.Context {
+	return context.WithValue(x, ContextKey{}, new(Info))
+}
+
+// FromContext returns the *Info value stored in the context by a Proxy, or nil
+// if the context does not contain one.
+//
+// Functions set by 'OnRequest' and 'OnError' can read this from the request context.
+func FromContext(x context.Context) *Info {
+	i, _ := x.Value(ContextKey{}).(*Info)
+	return i
+}
+
+// WithTarget returns a copy of the context that contains a target URL override.
+//
+// When a request with this context is processed by a Proxy, the primary Switch
+// will send the request to the scheme and host of the specified URL instead of
+// its own target. All of the primary Switch settings, including the limits set
+// by 'RestrictTargets' and 'BlockPrivateTargets', still apply. Any additional
+// targets, the fallback and gRPC requests are not affected.
+func WithTarget(x context.Context, target *url.URL) context.Context {
+	return context.WithValue(x, targetKey{}, target)
+}
+func targetFrom(x context.Context) *url.URL {
+	u, _ := x.Value(targetKey{}).(*url.URL)
+	return u
+}
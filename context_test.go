@@ -0,0 +1,102 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestFromContext(t *testing.T) {
+	var (
+		a = make(chan string, 1)
+		b = make(chan string, 1)
+		c = make(chan string, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.NotFoundHandler())
+	s.Pre = func(r switchproxy.Result) { a <- r.UUID }
+	p := switchproxy.New("")
+	p.Primary(s)
+	p.OnRequest(func(r *http.Request) error {
+		if i := switchproxy.FromContext(r.Context()); i != nil {
+			b <- i.UUID
+		} else {
+			b <- ""
+		}
+		return nil
+	})
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if switchproxy.FromContext(r.Context()) != nil {
+			t.Error("FromContext returned a value before WithInfo")
+		}
+		r = r.WithContext(switchproxy.WithInfo(r.Context()))
+		p.ServeHTTP(w, r)
+		c <- switchproxy.FromContext(r.Context()).UUID
+	}))
+	defer v.Close()
+	get(t, v.URL)
+	u := <-a
+	if len(u) == 0 {
+		t.Fatal("Result UUID is empty")
+	}
+	if v := <-b; v != u {
+		t.Fatalf("OnRequest UUID = %q, want the Result UUID %q", v, u)
+	}
+	if v := <-c; v != u {
+		t.Fatalf("middleware UUID = %q, want the Result UUID %q", v, u)
+	}
+}
+func TestWithTarget(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary " + r.URL.Path))
+	}))
+	o := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("override " + r.URL.Path))
+	}))
+	defer o.Close()
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		t.Fatalf("parse URL failed: %s", err)
+	}
+	p := switchproxy.New("127.0.0.1:0")
+	p.Primary(s)
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Route") == "override" {
+			r = r.WithContext(switchproxy.WithTarget(r.Context(), u))
+		}
+		p.ServeHTTP(w, r)
+	}))
+	defer v.Close()
+	if _, b := get(t, v.URL+"/path"); b != "primary /path" {
+		t.Fatalf("response = %q, want the primary without an override", b)
+	}
+	q, _ := http.NewRequest(http.MethodGet, v.URL+"/path", nil)
+	q.Header.Set("X-Route", "override")
+	if _, b := do(t, q); b != "override /path" {
+		t.Fatalf("response = %q, want the override target", b)
+	}
+	// The override is still limited by the primary Switch settings.
+	s.RestrictTargets("backend.example.com")
+	if r, _ := do(t, q); r.StatusCode != http.StatusForbidden {
+		t.Fatalf("response = %d for a denied override, want 403", r.StatusCode)
+	}
+}
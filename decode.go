@@ -0,0 +1,64 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDecoded is the largest decompressed body that will be passed to the Post
+// Handler, which stops small compressed bodies using large amounts of memory.
+const maxDecoded = 32 << 20
+
+// DecodeContent sets if the Results passed to the Post Handler will contain the
+// decompressed response body, when the response has a "Content-Encoding" of
+// "gzip" or "deflate".
+//
+// Only the Handler Content is changed, the client still receives the original
+// compressed response and headers. The body is only decompressed when the Post
+// Handler is set. If decompressing fails, or the decompressed body is larger
+// than 32MB, the original body is used.
+func (s *Switch) DecodeContent(e bool) {
+	s.decode.Store(e)
+}
+func decoded(h http.Header, b []byte) []byte {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		return b
+	}
+	if err != nil {
+		return b
+	}
+	d, err := io.ReadAll(io.LimitReader(r, maxDecoded+1))
+	if r.Close(); err != nil || len(d) > maxDecoded {
+		return b
+	}
+	return d
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var v bytes.Buffer
+	w := gzip.NewWriter(&v)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip failed: %s", err)
+	}
+	return v.Bytes()
+}
+func TestDecodeContent(t *testing.T) {
+	var (
+		z = gzipped(t, []byte(`{"ok":true}`))
+		// Decompresses to more than the limit.
+		l = gzipped(t, make([]byte, 33<<20))
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/large" {
+			w.Write(l)
+			return
+		}
+		w.Write(z)
+	}))
+	c := make(chan switchproxy.Result, 1)
+	s.Post = func(r switchproxy.Result) { c <- r }
+	s.DecodeContent(true)
+	p := switchproxytest.NewProxy(t, s)
+	for _, v := range [...]struct {
+		path        string
+		body, saved []byte
+	}{
+		{"/", z, []byte(`{"ok":true}`)},
+		{"/large", l, l},
+	} {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+v.path, nil)
+		// Set explicitly, so the client does not decompress the response.
+		q.Header.Set("Accept-Encoding", "gzip")
+		o, b := do(t, q)
+		if o.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal([]byte(b), v.body) {
+			t.Fatalf("%s client response was changed, want the compressed body", v.path)
+		}
+		if r := <-c; !bytes.Equal(r.Content, v.saved) {
+			t.Fatalf("%s Post Content has %d bytes, want %d", v.path, len(r.Content), len(v.saved))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+func digestValid(h http.Header, b []byte) bool {
+	if v := h.Get("Content-MD5"); len(v) > 0 && !digestEqual(v, md5Sum(b)) {
+		return false
+	}
+	for _, d := range h.Values("Digest") {
+		for _, e := range strings.Split(d, ",") {
+			a, v, ok := strings.Cut(strings.TrimSpace(e), "=")
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(a) {
+			case "md5":
+				if !digestEqual(v, md5Sum(b)) {
+					return false
+				}
+			case "sha-256":
+				if !digestEqual(v, sha256Sum(b)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+func responseDigest(a string, b []byte) string {
+	if a == "md5" {
+		return "md5=" + base64.StdEncoding.EncodeToString(md5Sum(b))
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sha256Sum(b))
+}
+func md5Sum(b []byte) []byte {
+	v := md5.Sum(b)
+	return v[:]
+}
+func sha256Sum(b []byte) []byte {
+	v := sha256.Sum256(b)
+	return v[:]
+}
+func digestEqual(v string, d []byte) bool {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	return err == nil && subtle.ConstantTimeCompare(b, d) == 1
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		io.Copy(w, r.Body)
+	}))
+	s.VerifyDigest(true)
+	p := switchproxytest.NewProxy(t, s)
+	var (
+		m = md5.Sum([]byte("payload"))
+		h = sha256.Sum256([]byte("payload"))
+		x = sha256.Sum256([]byte("tampered"))
+	)
+	for i, c := range [...]struct {
+		name, value string
+		status      int
+	}{
+		{"", "", http.StatusOK},
+		{"Content-MD5", base64.StdEncoding.EncodeToString(m[:]), http.StatusOK},
+		{"Digest", "sha-256=" + base64.StdEncoding.EncodeToString(h[:]), http.StatusOK},
+		{"Content-MD5", base64.StdEncoding.EncodeToString(x[:16]), http.StatusBadRequest},
+		{"Digest", "sha-256=" + base64.StdEncoding.EncodeToString(x[:]), http.StatusBadRequest},
+	} {
+		q, _ := http.NewRequest(http.MethodPost, p.URL+"/", strings.NewReader("payload"))
+		if len(c.name) > 0 {
+			q.Header.Set(c.name, c.value)
+		}
+		if o, _ := do(t, q); o.StatusCode != c.status {
+			t.Fatalf("request %d (%s) status = %d, want %d", i, c.name, o.StatusCode, c.status)
+		}
+	}
+	if v := n.Load(); v != 3 {
+		t.Fatalf("target received %d requests, want only the 3 valid requests", v)
+	}
+}
+func TestAddResponseDigest(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Digest", "sha-256=stale")
+		io.WriteString(w, "response body")
+	}))
+	if err := s.AddResponseDigest("sha-1"); err == nil {
+		t.Fatal("AddResponseDigest succeeded with an unsupported algorithm")
+	}
+	p := switchproxytest.NewProxy(t, s)
+	var (
+		m = md5.Sum([]byte("response body"))
+		h = sha256.Sum256([]byte("response body"))
+	)
+	for _, c := range [...]struct {
+		algo, want string
+	}{
+		{"", "sha-256=" + base64.StdEncoding.EncodeToString(h[:])},
+		{"MD5", "md5=" + base64.StdEncoding.EncodeToString(m[:])},
+	} {
+		if err := s.AddResponseDigest(c.algo); err != nil {
+			t.Fatalf("AddResponseDigest(%q) failed: %s", c.algo, err)
+		}
+		if o, b := get(t, p.URL+"/"); b != "response body" || o.Header.Get("Digest") != c.want {
+			t.Fatalf("algorithm %q Digest = %q, want %q", c.algo, o.Header.Get("Digest"), c.want)
+		}
+	}
+	// Reset removes the digest, so the target header is returned unchanged.
+	s.Reset()
+	if o, _ := get(t, p.URL+"/"); o.Header.Get("Digest") != "sha-256=stale" {
+		t.Fatalf("Digest = %q after Reset, want the target header", o.Header.Get("Digest"))
+	}
+}
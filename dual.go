@@ -0,0 +1,99 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// DiffFunc is a function alias that is passed the request path and the Results
+// of the primary and candidate Switches when their responses differ.
+type DiffFunc func(string, Result, Result)
+
+type dual struct {
+	diff      DiffFunc
+	candidate *Switch
+}
+
+// DualRun sets the primary Proxy Switch context and a candidate Switch that
+// will be sent the same requests.
+//
+// The client will only receive the response from the primary Switch. When the
+// status or the content of the candidate response differs from the primary
+// response, the DiffFunc will be called with both Results. Passing a nil
+// candidate disables the comparison. Any sampling rate or normalize function set
+// by 'DualRunSample' and 'DualRunNormalize' is kept.
+func (p *Proxy) DualRun(primary, candidate *Switch, onDiff DiffFunc) {
+	var d *dual
+	if candidate != nil && onDiff != nil {
+		d = &dual{diff: onDiff, candidate: candidate}
+	}
+	// Both are set together, so no request uses the candidate without the
+	// matching primary.
+	p.lock.Lock()
+	p.primary, p.dual = primary, d
+	p.lock.Unlock()
+}
+func (o *config) sampled() bool {
+	return o.sample <= 1 || fastRand()%o.sample == 0
+}
+
+// DualRunSample sets the sampling rate of the DualRun comparison. Only one out
+// of every 'n' requests (on average) will be sent to the candidate Switch and
+// compared.
+//
+// Values of zero or one will compare every request (the default). This can be
+// set before or after 'DualRun' is called.
+func (p *Proxy) DualRunSample(n uint32) {
+	p.lock.Lock()
+	p.sample = n
+	p.lock.Unlock()
+}
+
+// DualRunNormalize sets a function that will be used to normalize the response
+// content of the primary and candidate Switches before comparing them. This can
+// be used to remove values that are expected to differ, such as timestamps.
+//
+// This can be set before or after 'DualRun' is called. A nil function compares
+// the content unchanged (the default).
+func (p *Proxy) DualRunNormalize(f func([]byte) []byte) {
+	p.lock.Lock()
+	p.normalize = f
+	p.lock.Unlock()
+}
+func equal(a, b Result, f func([]byte) []byte) bool {
+	if a.Status != b.Status {
+		return false
+	}
+	if f == nil {
+		return bytes.Equal(a.Content, b.Content)
+	}
+	return bytes.Equal(f(a.Content), f(b.Content))
+}
+func (d *dual) compare(x context.Context, r *http.Request, t *transfer, s *Switch, a Result, f func([]byte) []byte) {
+	a.Content = append([]byte(nil), a.Content...)
+	t.out.Reset()
+	t.in = bytes.NewReader(t.data)
+	b, err := d.candidate.process(x, r, t)
+	if err == nil && equal(a, b, f) {
+		return
+	}
+	a.Headers, b.Headers = s.headers(a.Headers), d.candidate.headers(b.Headers)
+	d.diff(r.URL.Path, a, b)
+}
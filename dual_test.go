@@ -0,0 +1,104 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestDualRun(t *testing.T) {
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("same " + r.URL.Path))
+	}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/diff" {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write([]byte("same " + r.URL.Path))
+	}))
+	d := make(chan [2]switchproxy.Result, 2)
+	p := switchproxytest.NewProxy(t, nil)
+	p.DualRun(a, b, func(_ string, x, y switchproxy.Result) { d <- [2]switchproxy.Result{x, y} })
+	if _, v := get(t, p.URL+"/match"); v != "same /match" {
+		t.Fatalf("response = %q, want the primary response", v)
+	}
+	if o, v := get(t, p.URL+"/diff"); o.StatusCode != http.StatusOK || v != "same /diff" {
+		t.Fatalf("response = %d %q, want the primary response", o.StatusCode, v)
+	}
+	select {
+	case v := <-d:
+		if v[0].Path != "/diff" || v[0].Status != http.StatusOK || v[1].Status != http.StatusTeapot {
+			t.Fatalf("diff called with %s %d and %d, want /diff 200 and 418", v[0].Path, v[0].Status, v[1].Status)
+		}
+	default:
+		t.Fatal("diff was not called for differing responses")
+	}
+	if len(d) > 0 {
+		t.Fatal("diff was called for matching responses")
+	}
+}
+func TestDualRunNormalize(t *testing.T) {
+	var n atomic.Int64
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("time=" + time.Now().Format(time.RFC3339Nano)))
+	}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("time=" + time.Now().Add(time.Hour).Format(time.RFC3339Nano)))
+	}))
+	e := regexp.MustCompile(`time=\S+`)
+	p := switchproxytest.NewProxy(t, nil)
+	// Set before 'DualRun', which must not reset it.
+	p.DualRunNormalize(func(b []byte) []byte { return e.ReplaceAll(b, []byte("time=")) })
+	p.DualRun(a, b, func(string, switchproxy.Result, switchproxy.Result) { n.Add(1) })
+	for i := 0; i < 5; i++ {
+		get(t, p.URL+"/")
+	}
+	if v := n.Load(); v != 0 {
+		t.Fatalf("diff called %d times, want 0 after normalizing", v)
+	}
+	p.DualRunNormalize(nil)
+	get(t, p.URL+"/")
+	if v := n.Load(); v != 1 {
+		t.Fatalf("diff called %d times, want 1 without normalizing", v)
+	}
+}
+func TestDualRunSample(t *testing.T) {
+	var c atomic.Int64
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Add(1)
+	}))
+	p := switchproxytest.NewProxy(t, nil)
+	p.DualRunSample(10)
+	p.DualRun(a, b, func(string, switchproxy.Result, switchproxy.Result) {})
+	for i := 0; i < 200; i++ {
+		q, _ := http.NewRequest(http.MethodPost, p.URL+"/", bytes.NewReader(nil))
+		do(t, q)
+	}
+	// One in ten on average, the bounds are wide so the test is not flaky.
+	if v := c.Load(); v < 2 || v > 60 {
+		t.Fatalf("candidate received %d of 200 requests, want about 20", v)
+	}
+}
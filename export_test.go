@@ -0,0 +1,99 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+)
+
+// Server returns the underlying http.Server of the Proxy, for tests.
+func Server(p *Proxy) *http.Server {
+	return p.server
+}
+
+// TimeoutOf returns the timeout of the Switch, for tests.
+func TimeoutOf(s *Switch) time.Duration {
+	return s.timeout
+}
+
+// KeepAliveOf returns the keep-alive period of the Proxy listener and true if
+// the listener sets the TCP keep-alive of accepted connections, for tests.
+func KeepAliveOf(p *Proxy) (time.Duration, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	k, ok := p.listener.(*keepAlive)
+	if !ok {
+		return 0, false
+	}
+	return k.d, true
+}
+
+// PoolPut returns n new transfers to the Proxy pool, for tests.
+func PoolPut(p *Proxy, n int) {
+	for i := 0; i < n; i++ {
+		p.pool.put(&transfer{out: new(bytes.Buffer), read: new(bytes.Buffer)})
+	}
+}
+
+// PoolIdle returns the number of transfers held by the Proxy pool reaper, for
+// tests.
+func PoolIdle(p *Proxy) int {
+	p.pool.lock.Lock()
+	defer p.pool.lock.Unlock()
+	return len(p.pool.free)
+}
+
+// PoolPrune drops the pooled transfers returned before the time, for tests.
+func PoolPrune(p *Proxy, e time.Time) {
+	p.pool.prune(e)
+}
+
+// Deny returns the error of the BlockPrivateTargets dial check for the address,
+// for tests.
+func Deny(addr string) error {
+	return deny("tcp", addr, nil)
+}
+
+// ReadBody reads the request body into a new transfer buffer, using the body
+// limit l, and returns the capacity of the buffer, for tests.
+func ReadBody(p *Proxy, r *http.Request, l int64) (int, error) {
+	t := &transfer{read: new(bytes.Buffer)}
+	err := p.read(r, t, l)
+	return t.read.Cap(), err
+}
+
+// Group is a request coalescing group, for tests.
+type Group struct {
+	g group
+}
+
+// NewGroup returns a new empty Group, for tests.
+func NewGroup() *Group {
+	return &Group{g: group{m: make(map[key]*call)}}
+}
+
+// Do calls f with the Group, using the key k to combine concurrent calls, and
+// returns the error of the call, for tests.
+func (g *Group) Do(x context.Context, k string, f func() error) error {
+	_, _, err := g.g.do(x, key{u: k}, func() (*Switch, Result, error) {
+		return nil, Result{}, f()
+	})
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ExternalURL sets the public base URL that clients use to reach the Proxy.
+// Only the scheme and host of the URL are used.
+//
+// When set, the "X-Forwarded-Proto", "X-Forwarded-Host" and "X-Forwarded-Port"
+// headers are set on forwarded requests, so the Switch targets can build
+// correct absolute URLs. Any "Location" or "Link" response headers that point
+// to the target of the Switch are also rewritten to point to this URL instead.
+//
+// While set, redirect responses from the Switch targets are not followed and
+// are passed back to the client instead, so their "Location" can be rewritten.
+// Without an external URL, redirects are followed by the Switch as normal.
+//
+// An empty string removes any set URL.
+func (p *Proxy) ExternalURL(base string) error {
+	if len(base) == 0 {
+		p.lock.Lock()
+		p.external = nil
+		p.lock.Unlock()
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return errors.New("unable to resolve URL: " + err.Error())
+	}
+	if !u.IsAbs() || len(u.Host) == 0 {
+		return errors.New(`external URL "` + base + `" must be absolute`)
+	}
+	p.lock.Lock()
+	p.external = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	p.lock.Unlock()
+	return nil
+}
+func forwarded(r *http.Request, u *url.URL) *http.Request {
+	o := u.Port()
+	if len(o) == 0 {
+		if o = "80"; u.Scheme == "https" {
+			o = "443"
+		}
+	}
+	r.Header.Set("X-Forwarded-Proto", u.Scheme)
+	r.Header.Set("X-Forwarded-Host", u.Host)
+	r.Header.Set("X-Forwarded-Port", o)
+	return r.WithContext(context.WithValue(r.Context(), redirectKey{}, struct{}{}))
+}
+func redirect(r *http.Request, v []*http.Request) error {
+	if r.Context().Value(redirectKey{}) != nil {
+		// The Location is rewritten by the Proxy, so the redirect is passed
+		// back to the client.
+		return http.ErrUseLastResponse
+	}
+	// Same limit as the default http.Client.
+	if len(v) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+func relocate(s *Switch, h http.Header, u *url.URL) {
+	var (
+		o = s.Scheme + "://" + s.Host
+		e = u.String()
+	)
+	if v := h.Get("Location"); strings.HasPrefix(v, o) && (len(v) == len(o) || strings.IndexByte("/?#", v[len(o)]) >= 0) {
+		h.Set("Location", e+v[len(o):])
+	}
+	l, ok := h["Link"]
+	if !ok {
+		return
+	}
+	// The Header values may be shared with the Result, so they are not
+	// changed in place.
+	n := make([]string, len(l))
+	for i := range l {
+		n[i] = strings.ReplaceAll(l[i], "<"+o, "<"+e)
+	}
+	h["Link"] = n
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func redirector() *httptest.Server {
+	var v *httptest.Server
+	v = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			w.Header().Set("Link", "<"+v.URL+"/style.css>; rel=preload")
+			http.Redirect(w, r, v.URL+"/new?a=1", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Proto") + " " + r.Header.Get("X-Forwarded-Host") + " " + r.Header.Get("X-Forwarded-Port")))
+	}))
+	return v
+}
+func TestExternalURL(t *testing.T) {
+	v := redirector()
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	if err = p.ExternalURL("https://public.example.com/ignored"); err != nil {
+		t.Fatalf("ExternalURL failed: %s", err)
+	}
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	o, err := c.Get(p.URL + "/old")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	o.Body.Close()
+	if o.StatusCode != http.StatusFound || o.Header.Get("Location") != "https://public.example.com/new?a=1" {
+		t.Fatalf("response = %d, Location = %q, want the redirect to the external URL", o.StatusCode, o.Header.Get("Location"))
+	}
+	if l := o.Header.Get("Link"); l != "<https://public.example.com/style.css>; rel=preload" {
+		t.Fatalf("Link = %q, want the external URL", l)
+	}
+	if _, b := get(t, p.URL+"/new"); b != "/new https public.example.com 443" {
+		t.Fatalf("forwarded headers = %q, want the external scheme, host and port", b)
+	}
+	if err = p.ExternalURL("/relative"); err == nil {
+		t.Fatal("ExternalURL accepted a relative URL")
+	}
+}
+func TestExternalURLRedirects(t *testing.T) {
+	v := redirector()
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	// Without an external URL, the Switch follows the redirect as before.
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	o, err := c.Get(p.URL + "/old")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	if o.Body.Close(); o.StatusCode != http.StatusOK {
+		t.Fatalf("response = %d, want the redirect to be followed", o.StatusCode)
+	}
+	// Changing the URL while serving must not race with requests.
+	var g sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			for j := 0; j < 10; j++ {
+				if o, err := c.Get(p.URL + "/old"); err == nil {
+					o.Body.Close()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			p.ExternalURL("https://public.example.com")
+		} else {
+			p.ExternalURL("")
+		}
+	}
+	g.Wait()
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// maxHead is the largest response head that is kept to check the framing, which
+// matches the default limit of the Transport.
+const maxHead = 1 << 20
+
+// ErrConflictingFraming is an error returned when the response of a Switch
+// target has both the Content-Length and Transfer-Encoding headers, if enabled
+// by 'StrictFraming'.
+var ErrConflictingFraming = errors.New("response has conflicting Content-Length and Transfer-Encoding headers")
+
+type framing struct {
+	net.Conn
+	head []byte
+	lock sync.Mutex
+	on   bool
+}
+type dialFunc func(context.Context, string, string) (net.Conn, error)
+
+// StrictFraming sets if the Switch will reject responses from the Switch target
+// that have both the Content-Length and Transfer-Encoding headers, which can be
+// used to smuggle responses. Rejected responses fail with a 400 status and the
+// ErrConflictingFraming error.
+//
+// When disabled (the default), the body is read as chunked and the response is
+// sent to the client with only a Content-Length header that matches the body.
+//
+// The Transport removes the Content-Length header of chunked responses, so the
+// response heads are read from the connections instead. This replaces the
+// dialer of the Switch Transport, so it must be called before the Switch is
+// used. Responses from HTTPS targets that are reached through an upstream proxy
+// are not checked.
+func (s *Switch) StrictFraming(e bool) {
+	s.strict = e
+	s.dialer()
+}
+func (c *framing) arm() {
+	c.lock.Lock()
+	c.on, c.head = true, c.head[:0]
+	c.lock.Unlock()
+}
+func (c *framing) conflict() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.on {
+		return false
+	}
+	var l, t bool
+	for _, v := range bytes.Split(c.head, []byte{'\n'})[1:] {
+		k, _, ok := strings.Cut(string(v), ":")
+		if !ok {
+			continue
+		}
+		switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k)) {
+		case "Content-Length":
+			l = true
+		case "Transfer-Encoding":
+			t = true
+		}
+	}
+	return l && t
+}
+func frame(d dialFunc) dialFunc {
+	return func(x context.Context, n, a string) (net.Conn, error) {
+		c, err := d(x, n, a)
+		if err != nil {
+			return nil, err
+		}
+		return &framing{Conn: c}, nil
+	}
+}
+func headEnd(b []byte) int {
+	for i := 0; ; {
+		n := bytes.IndexByte(b[i:], '\n')
+		if n < 0 {
+			return -1
+		}
+		// An empty line, with or without the carriage return, ends the head.
+		if v := b[i : i+n]; len(v) == 0 || (len(v) == 1 && v[0] == '\r') {
+			return i + n + 1
+		}
+		i += n + 1
+	}
+}
+func (c *framing) scan(b []byte) {
+	for c.head = append(c.head, b...); ; {
+		i := headEnd(c.head)
+		if i < 0 {
+			if len(c.head) > maxHead {
+				c.on, c.head = false, nil
+			}
+			return
+		}
+		// Informational responses are followed by the head of the final
+		// response, except for "101 Switching Protocols".
+		if h := c.head[:i]; len(h) > 12 && h[9] == '1' && !bytes.HasPrefix(h[9:], []byte("101")) {
+			c.head = append(c.head[:0], c.head[i:]...)
+			continue
+		}
+		c.head, c.on = c.head[:i], false
+		return
+	}
+}
+func (c *framing) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lock.Lock()
+		if c.on {
+			c.scan(b[:n])
+		}
+		c.lock.Unlock()
+	}
+	return n, err
+}
+func (s *Switch) frameTLS(d dialFunc) dialFunc {
+	return func(x context.Context, n, a string) (net.Conn, error) {
+		c, err := d(x, n, a)
+		if err != nil {
+			return nil, err
+		}
+		h, _, _ := net.SplitHostPort(a)
+		if s.tr.TLSHandshakeTimeout > 0 {
+			var f context.CancelFunc
+			x, f = context.WithTimeout(x, s.tr.TLSHandshakeTimeout)
+			defer f()
+		}
+		// Only HTTP/1.1 is used by the Transport, so no protocols are offered.
+		v := tls.Client(c, &tls.Config{ServerName: h})
+		if err = v.HandshakeContext(x); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return &framing{Conn: v}, nil
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type geo struct {
+	routes  map[string]*Switch
+	resolve func(net.IP) string
+}
+
+// GeoRoute sets a function that will be used to select the primary Switch for
+// each request based on the client IP address.
+//
+// The resolver is passed the IP address of the client and should return a
+// region code, which is used to select a Switch from the routes map. If the
+// region is not in the map (or the IP cannot be parsed), the primary Switch set
+// by 'Primary' is used. This is only used for requests that do not match the
+// routes added by 'AddRoute' or 'RouteContentType' (see 'Primary'). This
+// package does not include a GeoIP database, so the resolver must be supplied
+// by the caller.
+//
+// The client IP address is the connection address, unless the request is from
+// a proxy set by 'TrustedProxies', which allows the "X-Forwarded-For" header
+// to be used instead.
+//
+// The map is copied, so changes made to it afterwards have no effect. A nil
+// resolver removes any routing.
+func (p *Proxy) GeoRoute(resolver func(ip net.IP) string, routes map[string]*Switch) {
+	var g *geo
+	if resolver != nil {
+		g = &geo{routes: make(map[string]*Switch, len(routes)), resolve: resolver}
+		for k, v := range routes {
+			g.routes[k] = v
+		}
+	}
+	p.lock.Lock()
+	p.geo = g
+	p.lock.Unlock()
+}
+
+// TrustedProxies sets the addresses of any proxies in front of this Proxy that
+// are trusted to set the "X-Forwarded-For" header, as IP addresses or CIDR
+// networks (such as "10.0.0.0/8"). This is used to find the client IP address
+// for 'GeoRoute'.
+//
+// For requests from a trusted proxy, the client IP address is the last address
+// in the "X-Forwarded-For" header that is not a trusted proxy. The header is
+// ignored for any other requests, as it can be set by the client. Calling this
+// with no addresses removes all trusted proxies (the default).
+func (p *Proxy) TrustedProxies(networks ...string) error {
+	n := make([]*net.IPNet, 0, len(networks))
+	for _, v := range networks {
+		if strings.IndexByte(v, '/') > 0 {
+			_, x, err := net.ParseCIDR(v)
+			if err != nil {
+				return errors.New("invalid trusted proxy network: " + err.Error())
+			}
+			n = append(n, x)
+			continue
+		}
+		i := net.ParseIP(v)
+		if i == nil {
+			return errors.New(`invalid trusted proxy address "` + v + `"`)
+		}
+		if x := i.To4(); x != nil {
+			i = x
+		}
+		n = append(n, &net.IPNet{IP: i, Mask: net.CIDRMask(len(i)*8, len(i)*8)})
+	}
+	p.lock.Lock()
+	p.trusted = n
+	p.lock.Unlock()
+	return nil
+}
+func trusted(n []*net.IPNet, i net.IP) bool {
+	for k := range n {
+		if n[k].Contains(i) {
+			return true
+		}
+	}
+	return false
+}
+func clientIP(r *http.Request, n []*net.IPNet) net.IP {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		h = r.RemoteAddr
+	}
+	i := net.ParseIP(h)
+	if i == nil || !trusted(n, i) {
+		return i
+	}
+	// Each proxy appends the address it received the request from, so the
+	// header is read from the end until an untrusted address is found.
+	v := r.Header.Values("X-Forwarded-For")
+	for k := len(v) - 1; k >= 0; k-- {
+		e := strings.Split(v[k], ",")
+		for j := len(e) - 1; j >= 0; j-- {
+			x := net.ParseIP(strings.TrimSpace(e[j]))
+			if x == nil {
+				// An invalid entry can not be trusted, so the last trusted
+				// proxy is used as the client.
+				return i
+			}
+			if i = x; !trusted(n, x) {
+				return x
+			}
+		}
+	}
+	return i
+}
+func (g *geo) route(r *http.Request, s *Switch, n []*net.IPNet) *Switch {
+	i := clientIP(r, n)
+	if i == nil {
+		return s
+	}
+	if v, ok := g.routes[g.resolve(i)]; ok && v != nil {
+		return v
+	}
+	return s
+}
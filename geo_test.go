@@ -0,0 +1,99 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func region(i net.IP) string {
+	switch {
+	case i.Equal(net.IPv4(10, 0, 0, 1)):
+		return "eu"
+	case i.Equal(net.IPv4(192, 0, 2, 1)):
+		return "us"
+	}
+	return ""
+}
+func named(n string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, n)
+	})
+}
+func geoGet(t *testing.T, u string, xff ...string) string {
+	t.Helper()
+	q, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	for i := range xff {
+		q.Header.Add("X-Forwarded-For", xff[i])
+	}
+	_, b := do(t, q)
+	return b
+}
+func TestGeoRoute(t *testing.T) {
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, named("default")))
+	p.GeoRoute(region, map[string]*switchproxy.Switch{
+		"eu": switchproxytest.NewSwitch(t, named("eu")),
+		"us": switchproxytest.NewSwitch(t, named("us")),
+	})
+	// The header is ignored until the connection address is trusted.
+	if b := geoGet(t, p.URL, "10.0.0.1"); b != "default" {
+		t.Fatalf("untrusted X-Forwarded-For routed to %q", b)
+	}
+	if err := p.TrustedProxies("127.0.0.1", "172.16.0.0/12"); err != nil {
+		t.Fatalf("TrustedProxies failed: %s", err)
+	}
+	for _, v := range [...]struct {
+		xff  []string
+		want string
+	}{
+		{nil, "default"},
+		{[]string{"10.0.0.1"}, "eu"},
+		{[]string{"203.0.113.9"}, "default"},
+		{[]string{"192.0.2.1, 172.16.0.5"}, "us"},
+		{[]string{"192.0.2.1", "172.16.0.5, 172.16.0.6"}, "us"},
+		// The client can prepend anything, only the first untrusted hop is used.
+		{[]string{"10.0.0.1, 192.0.2.1"}, "us"},
+		{[]string{"10.0.0.1, bogus, 172.16.0.5"}, "default"},
+	} {
+		if b := geoGet(t, p.URL, v.xff...); b != v.want {
+			t.Fatalf("X-Forwarded-For %q routed to %q, expected %q", v.xff, b, v.want)
+		}
+	}
+	if err := p.TrustedProxies(); err != nil {
+		t.Fatalf("TrustedProxies failed: %s", err)
+	}
+	if b := geoGet(t, p.URL, "10.0.0.1"); b != "default" {
+		t.Fatalf("X-Forwarded-For routed to %q after removing trusted proxies", b)
+	}
+}
+func TestTrustedProxiesInvalid(t *testing.T) {
+	p := switchproxy.New("127.0.0.1:0")
+	for _, v := range []string{"", "bogus", "10.0.0.1/33", "10.0.0/8"} {
+		if err := p.TrustedProxies(v); err == nil {
+			t.Fatalf("TrustedProxies(%q) should have failed", v)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/PurpleSec/switchproxy
 
-go 1.17
+go 1.24
@@ -0,0 +1,142 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const grpcType = "application/grpc"
+
+func isGRPC(r *http.Request) bool {
+	if r.ProtoMajor < 2 {
+		return false
+	}
+	c := strings.ToLower(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(c, grpcType) {
+		return false
+	}
+	// Match "application/grpc" and "application/grpc+proto", but not
+	// "application/grpc-web".
+	return len(c) == len(grpcType) || c[len(grpcType)] == '+' || c[len(grpcType)] == ';'
+}
+
+// serveGRPC handles gRPC requests, which are streamed to and from the primary
+// Switch over HTTP/2 instead of being buffered. Secondary Switches and Observers
+// are not sent gRPC requests, only the primary Switch Handlers are called with
+// the request and response metadata. The request is still passed to the audit
+// log (without the body) and the 'OnRequest' function before it is sent.
+func (p *Proxy) serveGRPC(o *config, w http.ResponseWriter, r *http.Request, via string) {
+	t := &transfer{id: newUUID()}
+	if r = withUUID(r, t.id); !o.admit(w, r, t) {
+		r.Body.Close()
+		return
+	}
+	s, _ := o.switches(r)
+	if s == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if ok, err := s.stream(r.Context(), w, r, t.id, via); err != nil {
+		if o.error(r, err); !ok {
+			c := errorStatus(err)
+			http.Error(w, http.StatusText(c), c)
+		}
+	}
+}
+func flushCopy(w http.ResponseWriter, r io.Reader) (int64, error) {
+	var (
+		n int64
+		b = make([]byte, 32*1024)
+		c = http.NewResponseController(w)
+	)
+	for {
+		i, err := r.Read(b)
+		if i > 0 {
+			if _, err := w.Write(b[:i]); err != nil {
+				return n, err
+			}
+			n += int64(i)
+			c.Flush()
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+func (s *Switch) stream(x context.Context, w http.ResponseWriter, r *http.Request, u, via string) (bool, error) {
+	a := s.target(s.URL, r)
+	if !s.allowed(a) {
+		return false, &StatusError{Err: ErrTargetDenied, Status: http.StatusForbidden}
+	}
+	q, err := http.NewRequestWithContext(x, r.Method, a.String(), r.Body)
+	if err != nil {
+		return false, err
+	}
+	q.ContentLength = r.ContentLength
+	q.Header, q.Trailer = s.outgoing(r), r.Trailer
+	pre, post := s.handlers()
+	if pre != nil {
+		pre(Result{
+			IP:      r.RemoteAddr,
+			URL:     a.String(),
+			UUID:    u,
+			Path:    a.Path,
+			Target:  a.Host,
+			Method:  r.Method,
+			Headers: s.headers(r.Header),
+		})
+	}
+	o, err := s.h2.RoundTrip(q)
+	if err != nil {
+		return false, classify(err)
+	}
+	if s.copyHeaders(w.Header(), o.Header); len(via) > 0 {
+		w.Header().Add("Via", via)
+	}
+	w.WriteHeader(o.StatusCode)
+	http.NewResponseController(w).Flush()
+	n, err := flushCopy(w, o.Body)
+	o.Body.Close()
+	for k, v := range o.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+	if post != nil {
+		h := o.Header.Clone()
+		for k, v := range o.Trailer {
+			h[k] = v
+		}
+		post(Result{
+			IP:       r.RemoteAddr,
+			URL:      a.String(),
+			Path:     a.Path,
+			UUID:     u,
+			Target:   a.Host,
+			Status:   uint16(o.StatusCode),
+			Method:   r.Method,
+			Headers:  s.headers(h),
+			BytesOut: n,
+		})
+	}
+	return true, err
+}
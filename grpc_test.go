@@ -0,0 +1,219 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func frame(m string) []byte {
+	b := make([]byte, 5+len(m))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m)))
+	copy(b[5:], m)
+	return b
+}
+func readFrame(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatalf("read frame header failed: %s", err)
+	}
+	b := make([]byte, binary.BigEndian.Uint32(h[1:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("read frame failed: %s", err)
+	}
+	return string(b)
+}
+func h2cClient() *http.Client {
+	t := &http.Transport{Protocols: new(http.Protocols)}
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: t}
+}
+
+// grpcEcho starts a h2c server that echoes each gRPC message back as soon as it
+// is received, then sends the gRPC status trailers.
+func grpcEcho(t *testing.T) *switchproxy.Switch {
+	v := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		var h [5]byte
+		for {
+			if _, err := io.ReadFull(r.Body, h[:]); err != nil {
+				break
+			}
+			b := make([]byte, 5+binary.BigEndian.Uint32(h[1:]))
+			copy(b, h[:])
+			if _, err := io.ReadFull(r.Body, b[5:]); err != nil {
+				break
+			}
+			w.Write(b)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "done")
+	}))
+	v.Config.Protocols = new(http.Protocols)
+	v.Config.Protocols.SetUnencryptedHTTP2(true)
+	v.Start()
+	t.Cleanup(v.Close)
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	return s
+}
+func TestGRPCUnary(t *testing.T) {
+	p := switchproxytest.NewProxy(t, grpcEcho(t), switchproxy.UnencryptedHTTP2())
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Say", bytes.NewReader(frame("hello")))
+	q.Header.Set("Content-Type", "application/grpc")
+	q.Header.Set("Te", "trailers")
+	o, err := h2cClient().Do(q)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer o.Body.Close()
+	if o.ProtoMajor != 2 {
+		t.Fatalf("protocol = %s, want HTTP/2", o.Proto)
+	}
+	if v := readFrame(t, o.Body); v != "hello" {
+		t.Fatalf("message = %q, want %q", v, "hello")
+	}
+	io.Copy(io.Discard, o.Body)
+	if o.Trailer.Get("Grpc-Status") != "0" || o.Trailer.Get("Grpc-Message") != "done" {
+		t.Fatalf("trailers = %v, want the gRPC status", o.Trailer)
+	}
+}
+func TestGRPCContentType(t *testing.T) {
+	p := switchproxytest.NewProxy(t, grpcEcho(t), switchproxy.UnencryptedHTTP2())
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Say", bytes.NewReader(frame("hello")))
+	// Media types are case-insensitive, so this is still streamed as gRPC.
+	q.Header.Set("Content-Type", "Application/GRPC+proto")
+	q.Header.Set("Te", "trailers")
+	o, err := h2cClient().Do(q)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer o.Body.Close()
+	if v := readFrame(t, o.Body); v != "hello" {
+		t.Fatalf("message = %q, want %q", v, "hello")
+	}
+	io.Copy(io.Discard, o.Body)
+	if o.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("trailers = %v, want the gRPC status", o.Trailer)
+	}
+}
+func TestGRPCStream(t *testing.T) {
+	p := switchproxytest.NewProxy(t, grpcEcho(t), switchproxy.UnencryptedHTTP2())
+	r, w := io.Pipe()
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Chat", r)
+	q.Header.Set("Content-Type", "application/grpc+proto")
+	q.Header.Set("Te", "trailers")
+	go w.Write(frame("one"))
+	o, err := h2cClient().Do(q)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer o.Body.Close()
+	// Each reply is read before the next message is sent, which only works if
+	// both directions are streamed.
+	for _, m := range []string{"one", "two", "three"} {
+		if m != "one" {
+			w.Write(frame(m))
+		}
+		if v := readFrame(t, o.Body); v != m {
+			t.Fatalf("message = %q, want %q", v, m)
+		}
+	}
+	w.Close()
+	io.Copy(io.Discard, o.Body)
+	if o.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("trailers = %v, want the gRPC status", o.Trailer)
+	}
+}
+func TestGRPCCleartextOptIn(t *testing.T) {
+	p := switchproxytest.NewProxy(t, grpcEcho(t))
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Say", bytes.NewReader(frame("hello")))
+	q.Header.Set("Content-Type", "application/grpc")
+	if o, err := h2cClient().Do(q); err == nil {
+		o.Body.Close()
+		t.Fatal("h2c request succeeded without the UnencryptedHTTP2 parameter")
+	}
+}
+func TestGRPCOnRequest(t *testing.T) {
+	var (
+		b buffer
+		c = make(chan string, 1)
+		u = make(chan string, 1)
+		s = grpcEcho(t)
+	)
+	s.Pre = func(v switchproxy.Result) { c <- v.UUID }
+	p := switchproxytest.NewProxy(t, s, switchproxy.UnencryptedHTTP2())
+	p.Via("edge")
+	p.AuditBody(&b)
+	p.OnRequest(func(r *http.Request) error {
+		var v string
+		if i := switchproxy.FromContext(r.Context()); i != nil {
+			v = i.UUID
+		}
+		if u <- v; r.URL.Path == "/echo.Echo/Deny" {
+			return &switchproxy.StatusError{Status: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	call := func(path string) *http.Response {
+		t.Helper()
+		q, _ := http.NewRequest(http.MethodPost, p.URL+path, bytes.NewReader(frame("hello")))
+		q.Header.Set("Content-Type", "application/grpc")
+		q.Header.Set("Te", "trailers")
+		o, err := h2cClient().Do(q)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		io.Copy(io.Discard, o.Body)
+		o.Body.Close()
+		return o
+	}
+	o := call("/echo.Echo/Say")
+	if o.StatusCode != http.StatusOK || o.Header.Get("Via") != "2.0 edge" {
+		t.Fatalf("status = %d, Via = %q, want 200 and the Proxy pseudonym", o.StatusCode, o.Header.Get("Via"))
+	}
+	if v, h := <-u, <-c; len(v) == 0 || v != h {
+		t.Fatalf("OnRequest UUID = %q, Pre Handler UUID = %q, want the same UUID", v, h)
+	}
+	if !strings.Contains(b.String(), "POST /echo.Echo/Say HTTP/2.0") {
+		t.Fatalf("audit log = %q, want the gRPC request", b.String())
+	}
+	if o = call("/echo.Echo/Deny"); o.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("rejected status = %d, want 429", o.StatusCode)
+	}
+	<-u
+	s.RestrictTargets("example.com")
+	if o = call("/echo.Echo/Say"); o.StatusCode != http.StatusForbidden {
+		t.Fatalf("denied target status = %d, want 403", o.StatusCode)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const grpcWebType = "application/grpc-web"
+
+type webText struct {
+	r   io.Reader
+	err error
+	in  []byte
+	out []byte
+	dec []byte
+	buf []byte
+}
+type webWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func isGRPCWeb(r *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), grpcWebType)
+}
+
+// GRPCWeb sets if the Switch will translate gRPC-web requests (with a Content-Type
+// of "application/grpc-web" or "application/grpc-web-text") into native gRPC
+// requests, which are sent to the Switch target over HTTP/2.
+//
+// The response is translated back into gRPC-web, with the gRPC trailers sent
+// in the gRPC-web trailer frame at the end of the body. Like gRPC requests, these
+// are streamed and only sent to the primary Switch, after being passed to the
+// audit log (without the body) and the 'OnRequest' function. This has no effect
+// when the Switch is used as a secondary Switch.
+func (s *Switch) GRPCWeb(e bool) {
+	s.web.Store(e)
+}
+func (p *Proxy) serveGRPCWeb(o *config, w http.ResponseWriter, r *http.Request, s *Switch, via string) {
+	t := &transfer{id: newUUID()}
+	if r = withUUID(r, t.id); !o.admit(w, r, t) {
+		r.Body.Close()
+		return
+	}
+	if ok, err := s.streamWeb(r.Context(), w, r, t.id, via); err != nil {
+		if o.error(r, err); !ok {
+			c := errorStatus(err)
+			http.Error(w, http.StatusText(c), c)
+		}
+	}
+}
+func (s *Switch) streamWeb(x context.Context, w http.ResponseWriter, r *http.Request, u, via string) (bool, error) {
+	var (
+		a    = s.target(s.URL, r)
+		c    = strings.TrimPrefix(strings.ToLower(r.Header.Get("Content-Type")), grpcWebType)
+		text = strings.HasPrefix(c, "-text")
+		b    = io.Reader(r.Body)
+	)
+	if !s.allowed(a) {
+		return false, &StatusError{Err: ErrTargetDenied, Status: http.StatusForbidden}
+	}
+	if c = strings.TrimPrefix(c, "-text"); text {
+		b = &webText{r: r.Body}
+	}
+	q, err := http.NewRequestWithContext(x, http.MethodPost, a.String(), b)
+	if err != nil {
+		return false, err
+	}
+	if q.Header = s.outgoing(r); !text {
+		q.ContentLength = r.ContentLength
+	}
+	q.Header = q.Header.Clone()
+	q.Header.Set("Content-Type", grpcType+c)
+	q.Header.Set("TE", "trailers")
+	q.Header.Del("Content-Length")
+	q.Header.Del("X-Grpc-Web")
+	pre, post := s.handlers()
+	if pre != nil {
+		pre(Result{
+			IP:      r.RemoteAddr,
+			URL:     a.String(),
+			UUID:    u,
+			Path:    a.Path,
+			Target:  a.Host,
+			Method:  r.Method,
+			Headers: s.headers(r.Header),
+		})
+	}
+	o, err := s.h2.RoundTrip(q)
+	if err != nil {
+		return false, classify(err)
+	}
+	if s.copyHeaders(w.Header(), o.Header); len(via) > 0 {
+		w.Header().Add("Via", via)
+	}
+	if v := o.Header.Get("Content-Type"); strings.HasPrefix(v, grpcType) {
+		t := grpcWebType
+		if text {
+			t += "-text"
+		}
+		w.Header().Set("Content-Type", t+strings.TrimPrefix(v, grpcType))
+	}
+	// The body is re-encoded (when using text) and has the trailer frame added,
+	// so the upstream length cannot be used.
+	w.Header().Del("Content-Length")
+	w.Header().Del("Trailer")
+	w.WriteHeader(o.StatusCode)
+	http.NewResponseController(w).Flush()
+	var (
+		e = w
+		z io.WriteCloser
+	)
+	if text {
+		z = base64.NewEncoder(base64.StdEncoding, w)
+		e = &webWriter{ResponseWriter: w, w: z}
+	}
+	n, err := flushCopy(e, o.Body)
+	o.Body.Close()
+	if err == nil && len(o.Trailer) > 0 {
+		_, err = e.Write(webTrailer(o.Trailer))
+	}
+	if z != nil {
+		z.Close()
+	}
+	if post != nil {
+		h := o.Header.Clone()
+		for k, v := range o.Trailer {
+			h[k] = v
+		}
+		post(Result{
+			IP:       r.RemoteAddr,
+			URL:      a.String(),
+			Path:     a.Path,
+			UUID:     u,
+			Target:   a.Host,
+			Status:   uint16(o.StatusCode),
+			Method:   r.Method,
+			Headers:  s.headers(h),
+			BytesOut: n,
+		})
+	}
+	return true, err
+}
+func (w *webText) Read(b []byte) (int, error) {
+	for len(w.out) == 0 {
+		if w.err != nil {
+			if w.err == io.EOF && len(w.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, w.err
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 4096)
+		}
+		n, err := w.r.Read(w.buf)
+		w.in, w.err = append(w.in, w.buf[:n]...), err
+		// Only complete base64 quanta are decoded, the rest is kept until more
+		// of the body is read.
+		k := len(w.in) &^ 3
+		if w.dec, err = webDecode(w.dec[:0], w.in[:k]); err != nil {
+			w.err = err
+		}
+		w.in, w.out = append(w.in[:0], w.in[k:]...), w.dec
+	}
+	n := copy(b, w.out)
+	w.out = w.out[n:]
+	return n, nil
+}
+func (w *webWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+func (w *webWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+func webDecode(dst, src []byte) ([]byte, error) {
+	// Clients may encode each message separately, so the body can contain
+	// multiple padded base64 chunks, which a single decoder does not accept.
+	// Each chunk ends with the quantum that contains the padding.
+	for len(src) > 0 {
+		i := bytes.IndexByte(src, '=')
+		if i < 0 {
+			i = len(src)
+		} else {
+			i = (i/4 + 1) * 4
+		}
+		var err error
+		if dst, err = base64.StdEncoding.AppendDecode(dst, src[:i]); err != nil {
+			return dst, err
+		}
+		src = src[i:]
+	}
+	return dst, nil
+}
+func webTrailer(h http.Header) []byte {
+	var b strings.Builder
+	for k, v := range h {
+		for i := range v {
+			b.WriteString(strings.ToLower(k))
+			b.WriteString(": ")
+			b.WriteString(v[i])
+			b.WriteString("\r\n")
+		}
+	}
+	// The trailer frame uses the same framing as gRPC messages, but with the
+	// most significant bit of the flags set.
+	f := make([]byte, 5, 5+b.Len())
+	f[0] = 0x80
+	binary.BigEndian.PutUint32(f[1:], uint32(b.Len()))
+	return append(f, b.String()...)
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestGRPCWebUnary(t *testing.T) {
+	s := grpcEcho(t)
+	s.GRPCWeb(true)
+	p := switchproxytest.NewProxy(t, s)
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Say", bytes.NewReader(frame("hello")))
+	q.Header.Set("Content-Type", "application/grpc-web+proto")
+	q.Header.Set("X-Grpc-Web", "1")
+	o, b := do(t, q)
+	if o.StatusCode != http.StatusOK || o.Header.Get("Content-Type") != "application/grpc-web" {
+		t.Fatalf("response = %d %q, want 200 application/grpc-web", o.StatusCode, o.Header.Get("Content-Type"))
+	}
+	r := strings.NewReader(b)
+	if v := readFrame(t, r); v != "hello" {
+		t.Fatalf("message = %q, want hello", v)
+	}
+	if v := readFrame(t, r); !strings.Contains(v, "grpc-status: 0\r\n") || !strings.Contains(v, "grpc-message: done\r\n") {
+		t.Fatalf("trailer frame = %q, want the gRPC status", v)
+	}
+}
+func TestGRPCWebText(t *testing.T) {
+	s := grpcEcho(t)
+	s.GRPCWeb(true)
+	p := switchproxytest.NewProxy(t, s)
+	// Each message is encoded separately, so the body has multiple padded
+	// base64 chunks. The Content-Type is matched case-insensitively.
+	e := base64.StdEncoding.EncodeToString(frame("a")) + base64.StdEncoding.EncodeToString(frame("bc")) +
+		base64.StdEncoding.EncodeToString(frame("def"))
+	if strings.Count(e, "=") < 2 {
+		t.Fatalf("request body %q does not have padded chunks", e)
+	}
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/echo.Echo/Say", strings.NewReader(e))
+	q.Header.Set("Content-Type", "Application/gRPC-Web-Text")
+	o, b := do(t, q)
+	if o.StatusCode != http.StatusOK || o.Header.Get("Content-Type") != "application/grpc-web-text" {
+		t.Fatalf("response = %d %q, want 200 application/grpc-web-text", o.StatusCode, o.Header.Get("Content-Type"))
+	}
+	d, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(b)))
+	if err != nil {
+		t.Fatalf("decode response failed: %s", err)
+	}
+	r := bytes.NewReader(d)
+	for _, m := range [...]string{"a", "bc", "def"} {
+		if v := readFrame(t, r); v != m {
+			t.Fatalf("message = %q, want %q", v, m)
+		}
+	}
+	if v := readFrame(t, r); !strings.Contains(v, "grpc-status: 0\r\n") {
+		t.Fatalf("trailer frame = %q, want the gRPC status", v)
+	}
+}
+func TestGRPCWebOnRequest(t *testing.T) {
+	var (
+		b buffer
+		c = make(chan string, 1)
+		u = make(chan string, 1)
+		s = grpcEcho(t)
+	)
+	s.GRPCWeb(true)
+	s.Pre = func(v switchproxy.Result) { c <- v.UUID }
+	p := switchproxytest.NewProxy(t, s)
+	p.Via("edge")
+	p.AuditBody(&b)
+	p.OnRequest(func(r *http.Request) error {
+		var v string
+		if i := switchproxy.FromContext(r.Context()); i != nil {
+			v = i.UUID
+		}
+		if u <- v; r.URL.Path == "/echo.Echo/Deny" {
+			return &switchproxy.StatusError{Status: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	call := func(path string) *http.Response {
+		t.Helper()
+		q, _ := http.NewRequest(http.MethodPost, p.URL+path, bytes.NewReader(frame("hello")))
+		q.Header.Set("Content-Type", "application/grpc-web")
+		o, _ := do(t, q)
+		return o
+	}
+	o := call("/echo.Echo/Say")
+	if o.StatusCode != http.StatusOK || o.Header.Get("Via") != "1.1 edge" {
+		t.Fatalf("status = %d, Via = %q, want 200 and the Proxy pseudonym", o.StatusCode, o.Header.Get("Via"))
+	}
+	if v, h := <-u, <-c; len(v) == 0 || v != h {
+		t.Fatalf("OnRequest UUID = %q, Pre Handler UUID = %q, want the same UUID", v, h)
+	}
+	if !strings.Contains(b.String(), "POST /echo.Echo/Say HTTP/1.1") {
+		t.Fatalf("audit log = %q, want the gRPC-web request", b.String())
+	}
+	if o = call("/echo.Echo/Deny"); o.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("rejected status = %d, want 429", o.StatusCode)
+	}
+	<-u
+	s.RestrictTargets("example.com")
+	if o = call("/echo.Echo/Say"); o.StatusCode != http.StatusForbidden {
+		t.Fatalf("denied target status = %d, want 403", o.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+type hinter struct {
+	w    http.ResponseWriter
+	lock sync.Mutex
+	done bool
+}
+
+// ForwardEarlyHints sets if the Switch will pass any "103 Early Hints" responses
+// from the Switch target on to the client, before the final response is
+// received. Other informational responses, such as "100 Continue", are not
+// passed on.
+//
+// This only applies when the Switch is used as the primary (or fallback) Switch.
+func (s *Switch) ForwardEarlyHints(e bool) {
+	s.hints.Store(e)
+}
+func (s *Switch) earlyHints(x context.Context, w *hinter) context.Context {
+	return httptrace.WithClientTrace(x, &httptrace.ClientTrace{
+		Got1xxResponse: func(c int, h textproto.MIMEHeader) error {
+			if c == http.StatusEarlyHints {
+				w.hint(h)
+			}
+			return nil
+		},
+	})
+}
+func (w *hinter) stop() {
+	// The trace functions are called by the Transport, so this waits for any
+	// hint that is being written.
+	w.lock.Lock()
+	w.done = true
+	w.lock.Unlock()
+}
+func (w *hinter) hint(h textproto.MIMEHeader) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.done {
+		return
+	}
+	// The Header map is kept for the final response, so only the hint headers
+	// that were not already set are added and then removed.
+	var (
+		o = w.w.Header()
+		n []string
+	)
+	for k, v := range h {
+		if _, ok := o[k]; ok {
+			continue
+		}
+		o[k], n = v, append(n, k)
+	}
+	w.w.WriteHeader(http.StatusEarlyHints)
+	for i := range n {
+		delete(o, n[i])
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestForwardEarlyHints(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Link", "</final>; rel=canonical")
+		w.Write([]byte("page"))
+	}))
+	s.ForwardEarlyHints(true)
+	p := switchproxytest.NewProxy(t, s)
+	h := make(chan string, 2)
+	x := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(c int, v textproto.MIMEHeader) error {
+			if c == http.StatusEarlyHints {
+				h <- v.Get("Link")
+			}
+			return nil
+		},
+	})
+	q, _ := http.NewRequestWithContext(x, http.MethodGet, p.URL+"/", nil)
+	o, b := do(t, q)
+	if b != "page" || o.Header.Get("Link") != "</final>; rel=canonical" {
+		t.Fatalf("final response = %q (Link %q), want the page without the hint headers", b, o.Header.Get("Link"))
+	}
+	select {
+	case v := <-h:
+		if v != "</style.css>; rel=preload; as=style" {
+			t.Fatalf("early hint Link = %q, want the target hint", v)
+		}
+	default:
+		t.Fatal("client did not receive the early hints")
+	}
+}
+func TestForwardEarlyHintsTimeout(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep sending hints, so they are still arriving when the request
+		// times out and the error response is written.
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		for r.Context().Err() == nil {
+			w.WriteHeader(http.StatusEarlyHints)
+		}
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.ForwardEarlyHints(true)
+	p := switchproxytest.NewProxy(t, s)
+	for i := 0; i < 20; i++ {
+		if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("status = %d, want 504", o.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type access struct {
+	logger
+	fields []string
+}
+type logger struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// LogTo sets a Writer that will receive an access log line for each request
+// sent by this Switch, including each attempt made to additional targets. gRPC
+// streams are not logged.
+//
+// Lines are written in a "key=value" format with the time, UUID, method, path,
+// status, request and response byte counts and the duration of the request.
+// Requests that fail also include the error and have a status of zero. Each line
+// is written with a single Write call, so Writers shared by multiple Switches
+// must be safe for concurrent use. A nil Writer disables logging.
+func (s *Switch) LogTo(w io.Writer) {
+	var l *logger
+	if w != nil {
+		l = &logger{w: w}
+	}
+	s.lock.Lock()
+	s.log = l
+	s.lock.Unlock()
+}
+func (s *Switch) attempt(x context.Context, r *http.Request, t *transfer, b url.URL, k int) (Result, error) {
+	s.lock.RLock()
+	l := s.log
+	s.lock.RUnlock()
+	var n time.Time
+	if l != nil {
+		n = time.Now()
+	}
+	v, err := s.send(x, r, t, b, k)
+	if s.stats.requests.Add(1); k > 0 {
+		s.stats.retries.Add(1)
+	}
+	if s.failed(int(v.Status), err) {
+		s.stats.failures.Add(1)
+	}
+	if s.reset.Load() && (v.Status >= 500 || upstreamError(err)) {
+		s.closeIdle()
+	}
+	if l != nil {
+		l.write(r, t.id, v, err, n)
+	}
+	return v, err
+}
+func (l *logger) write(r *http.Request, u string, v Result, err error, n time.Time) {
+	var (
+		b bytes.Buffer
+		p = v.Path
+	)
+	if len(p) == 0 {
+		p = r.URL.Path
+	}
+	b.WriteString("time=" + n.UTC().Format(time.RFC3339Nano))
+	b.WriteString(" uuid=" + u)
+	b.WriteString(" method=" + r.Method)
+	b.WriteString(" path=" + strconv.Quote(p))
+	b.WriteString(" status=" + strconv.Itoa(int(v.Status)))
+	b.WriteString(" bytes_in=" + strconv.FormatInt(v.BytesIn, 10))
+	b.WriteString(" bytes_out=" + strconv.FormatInt(v.BytesOut, 10))
+	b.WriteString(" duration=" + time.Since(n).String())
+	if err != nil {
+		b.WriteString(" error=" + strconv.Quote(err.Error()))
+	}
+	b.WriteByte('\n')
+	l.lock.Lock()
+	l.w.Write(b.Bytes())
+	l.lock.Unlock()
+}
+
+// JSONAccessLog sets a Writer that will receive a JSON access log line for each
+// request handled by the Proxy.
+//
+// Each line is a JSON object with the "time", "uuid", "ip", "method", "path",
+// "status", "bytes" (response body bytes sent) and "duration" (in seconds)
+// fields, along with the values of any request headers named in fields, which
+// use the header name as given as their key. Each line is written with a single
+// Write call. A nil Writer disables logging.
+func (p *Proxy) JSONAccessLog(w io.Writer, fields ...string) {
+	var a *access
+	if w != nil {
+		a = &access{logger: logger{w: w}, fields: fields}
+	}
+	p.lock.Lock()
+	p.access = a
+	p.lock.Unlock()
+}
+func (a *access) write(r *http.Request, c *recorder, n time.Time) {
+	s := c.status
+	if s == 0 {
+		s = http.StatusOK
+	}
+	m := map[string]interface{}{
+		"ip":       r.RemoteAddr,
+		"uuid":     "",
+		"time":     n.UTC().Format(time.RFC3339Nano),
+		"path":     r.URL.Path,
+		"bytes":    c.n,
+		"method":   r.Method,
+		"status":   s,
+		"duration": time.Since(n).Seconds(),
+	}
+	if i := FromContext(r.Context()); i != nil {
+		m["uuid"] = i.UUID
+	}
+	for _, k := range a.fields {
+		m[k] = r.Header.Get(k)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	a.lock.Lock()
+	a.w.Write(append(b, '\n'))
+	a.lock.Unlock()
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestLogTo(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	var (
+		a, b buffer
+		x    = switchproxytest.NewSwitch(t, h)
+		y    = switchproxytest.NewSwitch(t, h)
+	)
+	x.LogTo(&a)
+	y.LogTo(&b)
+	p := switchproxytest.NewProxy(t, x)
+	p.RouteContentType("application/json", y)
+	get(t, p.URL+"/one")
+	get(t, p.URL+"/missing")
+	q, err := http.NewRequest(http.MethodPost, p.URL+"/two", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	q.Header.Set("Content-Type", "application/json")
+	do(t, q)
+	l := strings.Split(strings.TrimSpace(a.String()), "\n")
+	if len(l) != 2 || !strings.Contains(l[0], ` method=GET path="/one" status=200 `) || !strings.Contains(l[1], ` path="/missing" status=404 `) {
+		t.Fatalf("primary log = %q, want only the two GET requests", l)
+	}
+	v := b.String()
+	if strings.Count(v, "\n") != 1 || !strings.Contains(v, ` method=POST path="/two" status=200 bytes_in=7 bytes_out=2 `) {
+		t.Fatalf("route log = %q, want only the POST request", v)
+	}
+	for _, k := range []string{"time=", "uuid=", "duration="} {
+		if !strings.Contains(v, k) {
+			t.Fatalf("route log = %q, want the %s field", v, k)
+		}
+	}
+}
+func TestJSONAccessLog(t *testing.T) {
+	var b buffer
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+	p.JSONAccessLog(&b, "X-Request-Source")
+	q, err := http.NewRequest(http.MethodGet, p.URL+"/one?a=b", nil)
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	q.Header.Set("X-Request-Source", "mobile")
+	do(t, q)
+	// The line is written after the response, so the client may see it first.
+	for i := 0; i < 100 && !strings.HasSuffix(b.String(), "\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(l) != 1 {
+		t.Fatalf("access log = %q, want one line", l)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(l[0]), &m); err != nil {
+		t.Fatalf("access log line %q is not JSON: %s", l[0], err)
+	}
+	for k, v := range map[string]interface{}{"method": "GET", "path": "/one", "status": 201.0, "bytes": 5.0, "X-Request-Source": "mobile"} {
+		if m[k] != v {
+			t.Fatalf("access log %s = %v, want %v", k, m[k], v)
+		}
+	}
+	if u, _ := m["uuid"].(string); len(u) == 0 {
+		t.Fatalf("access log uuid = %v, want the request UUID", m["uuid"])
+	}
+	if v, _ := m["ip"].(string); !strings.HasPrefix(v, "127.0.0.1:") {
+		t.Fatalf("access log ip = %v, want the client address", m["ip"])
+	}
+	if v, ok := m["duration"].(float64); !ok || v < 0 {
+		t.Fatalf("access log duration = %v, want a number of seconds", m["duration"])
+	}
+	if v, _ := m["time"].(string); len(v) == 0 {
+		t.Fatal("access log is missing the time field")
+	} else if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+		t.Fatalf("access log time %q is not RFC 3339: %s", v, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Matcher is a function alias that can be used to limit a Proxy feature to only
+// the requests that the function returns true for. A nil Matcher matches all
+// requests.
+type Matcher func(*http.Request) bool
+
+// MatchHeader returns a Matcher that matches requests that have the specified
+// header set, with any value.
+func MatchHeader(name string) Matcher {
+	k := http.CanonicalHeaderKey(name)
+	return func(r *http.Request) bool {
+		_, ok := r.Header[k]
+		return ok
+	}
+}
+
+// MatchPrefix returns a Matcher that matches requests with a URL path that starts
+// with the specified prefix.
+func MatchPrefix(prefix string) Matcher {
+	return func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+}
+
+// MatchMethod returns a Matcher that matches requests that use any of the
+// specified methods.
+func MatchMethod(m ...string) Matcher {
+	return func(r *http.Request) bool {
+		for i := range m {
+			if strings.EqualFold(r.Method, m[i]) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// And returns a Matcher that matches requests that are matched by both this
+// Matcher and the supplied Matcher.
+func (m Matcher) And(o Matcher) Matcher {
+	return func(r *http.Request) bool {
+		return m.match(r) && o.match(r)
+	}
+}
+
+// Or returns a Matcher that matches requests that are matched by either this
+// Matcher or the supplied Matcher.
+func (m Matcher) Or(o Matcher) Matcher {
+	return func(r *http.Request) bool {
+		return m.match(r) || o.match(r)
+	}
+}
+
+// Not returns a Matcher that matches requests that are not matched by this
+// Matcher.
+func (m Matcher) Not() Matcher {
+	return func(r *http.Request) bool {
+		return !m.match(r)
+	}
+}
+func (m Matcher) match(r *http.Request) bool {
+	return m == nil || m(r)
+}
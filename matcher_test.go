@@ -0,0 +1,78 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestMatcher(t *testing.T) {
+	q, _ := http.NewRequest(http.MethodPost, "http://example.com/api/users", nil)
+	q.Header.Set("x-debug", "")
+	for _, c := range [...]struct {
+		name string
+		m    switchproxy.Matcher
+		want bool
+	}{
+		{"nil", nil, true},
+		{"prefix", switchproxy.MatchPrefix("/api/"), true},
+		{"other prefix", switchproxy.MatchPrefix("/static/"), false},
+		{"method", switchproxy.MatchMethod(http.MethodGet, "post"), true},
+		{"other method", switchproxy.MatchMethod(http.MethodGet), false},
+		{"header", switchproxy.MatchHeader("X-Debug"), true},
+		{"missing header", switchproxy.MatchHeader("X-Other"), false},
+		{"and", switchproxy.MatchPrefix("/api/").And(switchproxy.MatchMethod(http.MethodGet)), false},
+		{"or", switchproxy.MatchPrefix("/static/").Or(switchproxy.MatchHeader("X-Debug")), true},
+		{"not", switchproxy.MatchPrefix("/api/").Not(), false},
+		{"nil and", switchproxy.Matcher(nil).And(switchproxy.MatchHeader("X-Debug")), true},
+	} {
+		if v := c.m == nil || c.m(q); v != c.want {
+			t.Fatalf("%s Matcher = %t, want %t", c.name, v, c.want)
+		}
+	}
+}
+func TestCacheWhen(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n.Add(1)
+		w.Write([]byte("ok"))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Cache(8, time.Minute)
+	p.CacheWhen(switchproxy.MatchPrefix("/static/"))
+	for _, c := range [...]struct {
+		path string
+		want int64
+	}{
+		{"/static/app.js", 1},
+		{"/api/users", 2},
+	} {
+		n.Store(0)
+		for i := 0; i < 2; i++ {
+			get(t, p.URL+c.path)
+		}
+		if v := n.Load(); v != c.want {
+			t.Fatalf("%s was sent to the Switch %d times, want %d", c.path, v, c.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// buckets are the upper bounds (in seconds) of the request duration histogram.
+var buckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metrics struct {
+	sum    atomic.Uint64
+	total  atomic.Uint64
+	flight atomic.Int64
+	hist   [len(buckets)]atomic.Uint64
+	codes  [5]atomic.Uint64
+}
+type recorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+// Metrics enables the Proxy metrics, which are served in the OpenMetrics text
+// format at the specified path. Requests to this path are not forwarded to any
+// Switches. This can only be enabled once, further calls return an error.
+//
+// The path must be an absolute path other than "/" that is not already used by
+// the Proxy, otherwise an error is returned.
+//
+// The following metrics are exposed:
+//
+//	switchproxy_requests_total{class="1xx"..."5xx"}  counter of completed requests by status class
+//	switchproxy_requests_in_flight                   gauge of requests currently being handled
+//	switchproxy_request_duration_seconds             histogram of request handling time
+//
+// The metric names and labels are stable and will not change.
+func (p *Proxy) Metrics(path string) error {
+	if len(path) < 2 || path[0] != '/' || strings.ContainsAny(path, " \t\r\n{}") {
+		return errors.New(`invalid metrics path "` + path + `"`)
+	}
+	m := p.server.Handler.(*http.ServeMux)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.metrics != nil {
+		return errors.New("metrics are already enabled")
+	}
+	if _, v := m.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: path}}); v == path {
+		return errors.New(`metrics path "` + path + `" is already in use`)
+	}
+	p.metrics = new(metrics)
+	m.Handle(path, p.metrics)
+	return nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter, which allows an
+// http.ResponseController to be used.
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// WriteHeader satisfies the http.ResponseWriter interface.
+func (r *recorder) WriteHeader(c int) {
+	if r.status == 0 && c >= 200 {
+		r.status = c
+	}
+	r.ResponseWriter.WriteHeader(c)
+}
+
+// Write satisfies the http.ResponseWriter interface.
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.n += int64(n)
+	return n, err
+}
+func (m *metrics) done(r *recorder, s time.Time) {
+	d := time.Since(s)
+	m.flight.Add(-1)
+	m.total.Add(1)
+	m.sum.Add(uint64(d))
+	for i := range buckets {
+		if d.Seconds() <= buckets[i] {
+			m.hist[i].Add(1)
+			break
+		}
+	}
+	c := r.status
+	if c == 0 {
+		c = http.StatusOK
+	}
+	if c /= 100; c >= 1 && c <= 5 {
+		m.codes[c-1].Add(1)
+	}
+}
+func (m *metrics) start() time.Time {
+	m.flight.Add(1)
+	return time.Now()
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	b.WriteString("# TYPE switchproxy_requests counter\n")
+	b.WriteString("# HELP switchproxy_requests Completed requests by status class.\n")
+	for i := range m.codes {
+		b.WriteString(`switchproxy_requests_total{class="` + strconv.Itoa(i+1) + `xx"} `)
+		b.WriteString(strconv.FormatUint(m.codes[i].Load(), 10) + "\n")
+	}
+	b.WriteString("# TYPE switchproxy_requests_in_flight gauge\n")
+	b.WriteString("# HELP switchproxy_requests_in_flight Requests currently being handled.\n")
+	b.WriteString("switchproxy_requests_in_flight " + strconv.FormatInt(m.flight.Load(), 10) + "\n")
+	b.WriteString("# TYPE switchproxy_request_duration_seconds histogram\n")
+	b.WriteString("# UNIT switchproxy_request_duration_seconds seconds\n")
+	b.WriteString("# HELP switchproxy_request_duration_seconds Time taken to handle requests.\n")
+	var n uint64
+	for i := range buckets {
+		n += m.hist[i].Load()
+		b.WriteString(`switchproxy_request_duration_seconds_bucket{le="` + strconv.FormatFloat(buckets[i], 'f', -1, 64) + `"} `)
+		b.WriteString(strconv.FormatUint(n, 10) + "\n")
+	}
+	// Read the total last, so it is never lower than the sum of the buckets.
+	t := m.total.Load()
+	b.WriteString(`switchproxy_request_duration_seconds_bucket{le="+Inf"} ` + strconv.FormatUint(t, 10) + "\n")
+	b.WriteString("switchproxy_request_duration_seconds_sum " + strconv.FormatFloat(time.Duration(m.sum.Load()).Seconds(), 'f', -1, 64) + "\n")
+	b.WriteString("switchproxy_request_duration_seconds_count " + strconv.FormatUint(t, 10) + "\n")
+	b.WriteString("# EOF\n")
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
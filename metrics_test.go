@@ -0,0 +1,89 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func series(b, name string) string {
+	for _, v := range strings.Split(b, "\n") {
+		if strings.HasPrefix(v, name+" ") {
+			return v[len(name)+1:]
+		}
+	}
+	return ""
+}
+func TestMetrics(t *testing.T) {
+	var n int
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n++; r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	if err := p.Metrics("/metrics"); err != nil {
+		t.Fatalf("Metrics failed: %s", err)
+	}
+	get(t, p.URL+"/a")
+	get(t, p.URL+"/b")
+	get(t, p.URL+"/missing")
+	o, b := get(t, p.URL+"/metrics")
+	if !strings.HasPrefix(o.Header.Get("Content-Type"), "application/openmetrics-text") || !strings.HasSuffix(b, "# EOF\n") {
+		t.Fatalf("metrics response = %q %q, want the OpenMetrics format", o.Header.Get("Content-Type"), b)
+	}
+	if v := series(b, `switchproxy_requests_total{class="2xx"}`); v != "2" {
+		t.Fatalf("2xx requests = %q, want 2", v)
+	}
+	if v := series(b, `switchproxy_requests_total{class="4xx"}`); v != "1" {
+		t.Fatalf("4xx requests = %q, want 1", v)
+	}
+	if v := series(b, "switchproxy_request_duration_seconds_count"); v != "3" {
+		t.Fatalf("duration count = %q, want 3", v)
+	}
+	if v := series(b, "switchproxy_requests_in_flight"); v != "0" {
+		t.Fatalf("in flight = %q, want 0", v)
+	}
+	if n != 3 {
+		t.Fatalf("Switch received %d requests, want the metrics path to not be forwarded", n)
+	}
+}
+func TestMetricsPath(t *testing.T) {
+	p := switchproxy.New("127.0.0.1:0")
+	for _, v := range []string{"", "/", "metrics", "/a b", "/{id}"} {
+		if err := p.Metrics(v); err == nil {
+			t.Fatalf("Metrics(%q) should have failed", v)
+		}
+	}
+	switchproxy.Server(p).Handler.(*http.ServeMux).Handle("/taken", http.NotFoundHandler())
+	if err := p.Metrics("/taken"); err == nil {
+		t.Fatal("Metrics should fail for a path that is already in use")
+	}
+	if err := p.Metrics("/metrics"); err != nil {
+		t.Fatalf("Metrics failed: %s", err)
+	}
+	if err := p.Metrics("/other"); err == nil {
+		t.Fatal("Metrics should fail when already enabled")
+	}
+}
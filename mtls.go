@@ -0,0 +1,105 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+)
+
+// DefaultCertHeaders is the default set of header names that can be passed to
+// 'ClientCertHeaders', which does not include the full certificate.
+var DefaultCertHeaders = CertHeaders{
+	Subject: "X-Client-Cert-Subject",
+	Serial:  "X-Client-Cert-Serial",
+	Issuer:  "X-Client-Cert-Issuer",
+}
+
+// CertHeaders is a struct that contains the names of the headers that are used
+// to pass the details of the client certificate to the Switch targets. Headers
+// with an empty name are not sent.
+//
+// The PEM header contains the full certificate in PEM format, which is URL
+// encoded, as it contains newlines.
+type CertHeaders struct {
+	PEM     string
+	Serial  string
+	Issuer  string
+	Subject string
+}
+
+// ClientCertificates sets the certificate pool that will be used to verify the
+// client certificates of TLS connections. If require is true, clients that do
+// not send a valid certificate are rejected, otherwise the certificate is only
+// verified if one is sent. Passing a nil pool disables client certificates.
+//
+// This only applies to listeners that are started by this Proxy.
+func (p *Proxy) ClientCertificates(roots *x509.CertPool, require bool) {
+	switch {
+	case roots == nil:
+		p.auth = tls.NoClientCert
+	case require:
+		p.auth = tls.RequireAndVerifyClientCert
+	default:
+		p.auth = tls.VerifyClientCertIfGiven
+	}
+	p.roots = roots
+}
+
+// ClientCertHeaders sets the headers that will be added to requests that were
+// made with a verified client certificate, to pass the certificate details to
+// the Switch targets.
+//
+// The named headers are always removed from client requests first, so clients
+// cannot spoof them. Certificates that were not verified (such as when the Proxy
+// is mounted in a server that only requests them) are ignored. Passing an empty
+// CertHeaders struct disables this (the default).
+func (p *Proxy) ClientCertHeaders(h CertHeaders) {
+	var c *CertHeaders
+	if h != (CertHeaders{}) {
+		c = &h
+	}
+	p.lock.Lock()
+	p.certHead = c
+	p.lock.Unlock()
+}
+func (h *CertHeaders) apply(r *http.Request) {
+	for _, k := range [...]string{h.PEM, h.Serial, h.Issuer, h.Subject} {
+		if len(k) > 0 {
+			r.Header.Del(k)
+		}
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	c := r.TLS.PeerCertificates[0]
+	if len(h.Subject) > 0 {
+		r.Header.Set(h.Subject, c.Subject.String())
+	}
+	if len(h.Issuer) > 0 {
+		r.Header.Set(h.Issuer, c.Issuer.String())
+	}
+	if len(h.Serial) > 0 {
+		r.Header.Set(h.Serial, c.SerialNumber.Text(16))
+	}
+	if len(h.PEM) > 0 {
+		r.Header.Set(h.PEM, url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))))
+	}
+}
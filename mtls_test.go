@@ -0,0 +1,127 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+)
+
+func clientCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err)
+	}
+	c := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: name},
+		SerialNumber: big.NewInt(42),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	d, err := x509.CreateCertificate(rand.Reader, c, c, &k.PublicKey, k)
+	if err != nil {
+		t.Fatalf("create certificate failed: %s", err)
+	}
+	v, err := x509.ParseCertificate(d)
+	if err != nil {
+		t.Fatalf("parse certificate failed: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{d}, PrivateKey: k, Leaf: v}, v
+}
+func TestClientCertHeaders(t *testing.T) {
+	h := make(chan string, 2)
+	v := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h <- r.Header.Get("X-Client-Subject") + " " + r.Header.Get("X-Client-Serial")
+		if r.Header.Get("Content-Type") == "application/grpc" {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Grpc-Status", "0")
+		}
+	}))
+	v.Config.Protocols = new(http.Protocols)
+	v.Config.Protocols.SetHTTP1(true)
+	v.Config.Protocols.SetUnencryptedHTTP2(true)
+	v.Start()
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	cert, key := certificate(t)
+	c, x := clientCertificate(t, "client-a")
+	r := x509.NewCertPool()
+	r.AddCert(x)
+	p := switchproxy.New(l.Addr().String(), switchproxy.TLS(cert, key))
+	p.Primary(s)
+	p.ClientCertificates(r, false)
+	p.ClientCertHeaders(switchproxy.CertHeaders{Subject: "X-Client-Subject", Serial: "X-Client-Serial"})
+	d := make(chan struct{})
+	go func() {
+		p.Serve(l)
+		close(d)
+	}()
+	defer func() {
+		p.Close()
+		<-d
+	}()
+	k := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{c}},
+		ForceAttemptHTTP2: true,
+	}
+	defer k.CloseIdleConnections()
+	e := &http.Client{Transport: k}
+	u := "https://" + l.Addr().String() + "/"
+	// The client header is replaced, so it can not be spoofed. gRPC requests
+	// are streamed, but still receive the headers.
+	for _, m := range [...]string{"text/plain", "application/grpc"} {
+		q, _ := http.NewRequest(http.MethodPost, u, bytes.NewReader([]byte("body")))
+		q.Header.Set("Content-Type", m)
+		q.Header.Set("Te", "trailers")
+		q.Header.Set("X-Client-Subject", "CN=spoofed")
+		o, err := e.Do(q)
+		if err != nil {
+			t.Fatalf("%s request failed: %s", m, err)
+		}
+		if o.Body.Close(); o.ProtoMajor != 2 {
+			t.Fatalf("%s request used HTTP/%d, want HTTP/2", m, o.ProtoMajor)
+		}
+		if v := <-h; v != "CN=client-a 2a" {
+			t.Fatalf("%s target received %q, want the client certificate details", m, v)
+		}
+	}
+}
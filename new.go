@@ -19,6 +19,7 @@ package switchproxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"net/http"
 	"sync"
 	"time"
@@ -27,10 +28,35 @@ import (
 type keys struct {
 	Cert, Key string
 }
+type noHTTP2 struct{}
+type h2c struct{}
 
 // Timeout is a time.Duration alias of a configuration option.
 type Timeout time.Duration
 
+// IdleTimeout is a time.Duration alias of a configuration option that only sets
+// how long idle keep-alive client connections are kept open. Unlike Timeout,
+// this does not change the read or write timeouts of each request.
+//
+// If used with Timeout, this must be specified after it to take effect.
+type IdleTimeout time.Duration
+
+// TCPKeepAlive is a time.Duration alias of a configuration option that sets
+// the TCP keep-alive period of accepted client connections. A negative value
+// disables TCP keep-alives, while zero uses the system default (the default).
+type TCPKeepAlive time.Duration
+
+// MaxBodySize is an int64 alias of a configuration option that limits the size
+// of client request bodies, in bytes. Requests with larger bodies will receive
+// a 413 response. A value of zero or less disables the limit (the default).
+type MaxBodySize int64
+
+// MaxURLLength is an int alias of a configuration option that limits the length
+// of the raw request URI (the path and query) of client requests, in bytes.
+// Requests with longer URIs will receive a 414 response. A value of zero or less
+// disables the limit (the default).
+type MaxURLLength int
+
 // Parameter is an interface that helps define config options for the Proxy struct.
 type Parameter interface {
 	config(*Proxy)
@@ -39,6 +65,32 @@ type Parameter interface {
 func (k keys) config(p *Proxy) {
 	p.key, p.cert = k.Key, k.Cert
 }
+func (l *listen) config(p *Proxy) {
+	p.listen = append(p.listen, &listen{addr: l.addr, cert: l.cert, key: l.key})
+}
+func (i IdleTimeout) config(p *Proxy) {
+	p.server.IdleTimeout = time.Duration(i)
+}
+func (noHTTP2) config(p *Proxy) {
+	p.http1 = true
+	p.server.Protocols.SetHTTP2(false)
+	p.server.Protocols.SetUnencryptedHTTP2(false)
+	p.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
+func (h2c) config(p *Proxy) {
+	if !p.http1 {
+		p.server.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+func (k TCPKeepAlive) config(p *Proxy) {
+	p.alive = time.Duration(k)
+}
+func (m MaxBodySize) config(p *Proxy) {
+	p.limit = int64(m)
+}
+func (m MaxURLLength) config(p *Proxy) {
+	p.urlMax = int(m)
+}
 func (t Timeout) config(p *Proxy) {
 	p.server.ReadTimeout = time.Duration(t)
 	p.server.IdleTimeout, p.server.WriteTimeout = p.server.ReadTimeout, p.server.ReadTimeout
@@ -50,6 +102,40 @@ func TLS(cert, key string) Parameter {
 	return &keys{Cert: cert, Key: key}
 }
 
+// Listen creates a config parameter that adds an extra address for the Proxy to
+// listen on when 'Start' is called. This can be used multiple times.
+//
+// The extra address uses plaintext HTTP, even if TLS is set. Use 'ListenTLS' to
+// use TLS on an extra address.
+func Listen(addr string) Parameter {
+	return &listen{addr: addr}
+}
+
+// ListenTLS creates a config parameter that adds an extra address for the Proxy
+// to listen on when 'Start' is called, using the specified Cert and Key file
+// paths. This can be used multiple times.
+func ListenTLS(addr, cert, key string) Parameter {
+	return &listen{addr: addr, cert: cert, key: key}
+}
+
+// DisableHTTP2 creates a config parameter that disables HTTP/2 support, which
+// forces all clients to use HTTP/1.1 on both TLS and plaintext connections.
+//
+// gRPC requests cannot be proxied when this is used, as they require HTTP/2.
+func DisableHTTP2() Parameter {
+	return noHTTP2{}
+}
+
+// UnencryptedHTTP2 creates a config parameter that allows clients to use HTTP/2
+// without TLS (h2c) on plaintext connections. By default, HTTP/2 is only used on
+// TLS connections.
+//
+// This is required to accept gRPC requests without TLS. This has no effect when
+// 'DisableHTTP2' is used.
+func UnencryptedHTTP2() Parameter {
+	return h2c{}
+}
+
 // New creates a new Proxy instance from the specified listen address and
 // optional parameters.
 func New(listen string, c ...Parameter) *Proxy {
@@ -61,17 +147,23 @@ func New(listen string, c ...Parameter) *Proxy {
 //
 // This function allows the caller to specify a context to specify when to shut down
 // the Proxy.
+//
+// The DefaultTimeout is only used for the server timeouts when no parameters are
+// specified.
 func NewContext(x context.Context, listen string, c ...Parameter) *Proxy {
 	p := &Proxy{
-		pool: &sync.Pool{
+		pool: &pool{Pool: sync.Pool{
 			New: func() interface{} {
 				return &transfer{out: new(bytes.Buffer), read: new(bytes.Buffer)}
 			},
-		},
-		server:    &http.Server{Addr: listen, Handler: &http.ServeMux{}},
-		secondary: make([]*Switch, 0),
+		}},
+		server: &http.Server{Addr: listen, Handler: &http.ServeMux{}},
+		config: config{secondary: make([]*Switch, 0)},
 	}
 	p.server.BaseContext = p.context
+	p.server.Protocols = new(http.Protocols)
+	p.server.Protocols.SetHTTP1(true)
+	p.server.Protocols.SetHTTP2(true)
 	p.ctx, p.cancel = context.WithCancel(x)
 	p.server.Handler.(*http.ServeMux).Handle("/", p)
 	for i := range c {
@@ -0,0 +1,144 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+// certificate writes a self-signed certificate for "127.0.0.1" and its key to
+// the test's temporary directory and returns the file paths.
+func certificate(t *testing.T, names ...string) (string, string) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err)
+	}
+	c := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	d, err := x509.CreateCertificate(rand.Reader, c, c, &k.PublicKey, k)
+	if err != nil {
+		t.Fatalf("create certificate failed: %s", err)
+	}
+	b, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatalf("marshal key failed: %s", err)
+	}
+	var (
+		v    = t.TempDir()
+		cert = filepath.Join(v, "cert.pem")
+		key  = filepath.Join(v, "key.pem")
+	)
+	if err = os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d}), 0o600); err != nil {
+		t.Fatalf("write certificate failed: %s", err)
+	}
+	if err = os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600); err != nil {
+		t.Fatalf("write key failed: %s", err)
+	}
+	return cert, key
+}
+func negotiated(t *testing.T, c ...switchproxy.Parameter) string {
+	t.Helper()
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()), c...)
+	x, err := tls.Dial("tcp", strings.TrimPrefix(p.URL, "http://"), &tls.Config{
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %s", err)
+	}
+	defer x.Close()
+	return x.ConnectionState().NegotiatedProtocol
+}
+func TestDisableHTTP2(t *testing.T) {
+	cert, key := certificate(t)
+	if v := negotiated(t, switchproxy.TLS(cert, key)); v != "h2" {
+		t.Fatalf("negotiated %q, want h2 by default", v)
+	}
+	if v := negotiated(t, switchproxy.TLS(cert, key), switchproxy.DisableHTTP2()); v == "h2" {
+		t.Fatal("negotiated h2 with DisableHTTP2")
+	}
+	// The plaintext path must not accept h2c either, even when it is allowed.
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()), switchproxy.UnencryptedHTTP2(), switchproxy.DisableHTTP2())
+	if o, err := h2cClient().Get(p.URL); err == nil {
+		o.Body.Close()
+		t.Fatal("h2c request succeeded with DisableHTTP2")
+	}
+	if o, _ := get(t, p.URL); o.ProtoMajor != 1 {
+		t.Fatalf("protocol = %s, want HTTP/1.1", o.Proto)
+	}
+}
+func TestTCPKeepAlive(t *testing.T) {
+	for _, d := range []time.Duration{time.Minute, -1} {
+		p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()), switchproxy.TCPKeepAlive(d))
+		// A request is sent first, so the listener is known to be set.
+		get(t, p.URL)
+		if v, ok := switchproxy.KeepAliveOf(p.Proxy); !ok || v != d {
+			t.Fatalf("TCPKeepAlive(%s): listener keep-alive = %s, %t, want the wrapped listener", d, v, ok)
+		}
+	}
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	get(t, p.URL)
+	if _, ok := switchproxy.KeepAliveOf(p.Proxy); ok {
+		t.Fatal("listener was wrapped without the TCPKeepAlive parameter")
+	}
+}
+func TestMaxURLLength(t *testing.T) {
+	var n atomic.Int32
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		n.Add(1)
+	})), switchproxy.MaxURLLength(64))
+	// "/search?q=" is 10 bytes, so this is exactly at the limit.
+	if o, _ := get(t, p.URL+"/search?q="+strings.Repeat("a", 54)); o.StatusCode != http.StatusOK {
+		t.Fatalf("URI at the limit: status = %d, want 200", o.StatusCode)
+	}
+	if o, _ := get(t, p.URL+"/search?q="+strings.Repeat("a", 55)); o.StatusCode != http.StatusRequestURITooLong {
+		t.Fatalf("URI over the limit: status = %d, want 414", o.StatusCode)
+	}
+	if v := n.Load(); v != 1 {
+		t.Fatalf("target received %d requests, want 1", v)
+	}
+	// Without the parameter, long URIs are passed on.
+	p = switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	if o, _ := get(t, p.URL+"/search?q="+strings.Repeat("a", 4096)); o.StatusCode != http.StatusNotFound {
+		t.Fatalf("URI without a limit: status = %d, want 404", o.StatusCode)
+	}
+}
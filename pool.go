@@ -0,0 +1,131 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type idle struct {
+	e time.Time
+	t *transfer
+}
+type pool struct {
+	sync.Pool
+	stop context.CancelFunc
+	done chan struct{}
+	free []idle
+	lock sync.Mutex
+	reap atomic.Bool
+}
+
+// PoolReap starts a background task that will drop any pooled transfer buffers
+// that have been idle for longer than the interval, to bound the memory used by
+// the Proxy after bursts of requests.
+//
+// While this is running, the transfers are kept in a list instead of being left
+// for the garbage collector to clear. The task will stop when the Proxy context
+// is cancelled or this function is called again, which also returns the listed
+// transfers to the garbage collector. An interval of zero or less only stops
+// any running task.
+func (p *Proxy) PoolReap(d time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pool.stop != nil {
+		// Wait for the task to exit, as it empties the list when it stops.
+		p.pool.stop()
+		<-p.pool.done
+		p.pool.stop, p.pool.done = nil, nil
+	}
+	if d <= 0 {
+		return
+	}
+	var x context.Context
+	x, p.pool.stop = context.WithCancel(p.ctx)
+	p.pool.done = make(chan struct{})
+	p.pool.reap.Store(true)
+	go p.pool.janitor(x, d, p.pool.done)
+}
+func (q *pool) drain() {
+	q.lock.Lock()
+	q.reap.Store(false)
+	for i := range q.free {
+		q.Pool.Put(q.free[i].t)
+		q.free[i].t = nil
+	}
+	q.free = q.free[:0]
+	q.lock.Unlock()
+}
+func (q *pool) get() *transfer {
+	if q.reap.Load() {
+		q.lock.Lock()
+		if n := len(q.free); n > 0 {
+			t := q.free[n-1].t
+			q.free[n-1].t = nil
+			q.free = q.free[:n-1]
+			q.lock.Unlock()
+			return t
+		}
+		q.lock.Unlock()
+	}
+	return q.Pool.Get().(*transfer)
+}
+func (q *pool) put(t *transfer) {
+	if q.reap.Load() {
+		q.lock.Lock()
+		// Check again, as 'drain' may have run before the lock was taken.
+		if q.reap.Load() {
+			q.free = append(q.free, idle{e: time.Now(), t: t})
+			q.lock.Unlock()
+			return
+		}
+		q.lock.Unlock()
+	}
+	q.Pool.Put(t)
+}
+func (q *pool) janitor(x context.Context, d time.Duration, c chan struct{}) {
+	t := time.NewTicker(d)
+	for {
+		select {
+		case <-x.Done():
+			// Nothing drops the listed transfers once this returns, so they are
+			// given back to the sync.Pool.
+			t.Stop()
+			q.drain()
+			close(c)
+			return
+		case n := <-t.C:
+			q.prune(n.Add(-d))
+		}
+	}
+}
+func (q *pool) prune(e time.Time) {
+	q.lock.Lock()
+	// The list is in the order the transfers were returned, so the oldest
+	// entries are always at the start.
+	var i int
+	for ; i < len(q.free) && q.free[i].e.Before(e); i++ {
+		q.free[i].t = nil
+	}
+	if i > 0 {
+		q.free = append(q.free[:0], q.free[i:]...)
+	}
+	q.lock.Unlock()
+}
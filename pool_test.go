@@ -0,0 +1,80 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+)
+
+func TestPoolPrune(t *testing.T) {
+	p := switchproxy.New("")
+	defer p.Close()
+	// The interval is long, so only the manual prunes below drop transfers.
+	p.PoolReap(time.Hour)
+	switchproxy.PoolPut(p, 3)
+	if n := switchproxy.PoolIdle(p); n != 3 {
+		t.Fatalf("idle transfers = %d, want 3", n)
+	}
+	switchproxy.PoolPrune(p, time.Now().Add(-time.Hour))
+	if n := switchproxy.PoolIdle(p); n != 3 {
+		t.Fatalf("idle transfers = %d after pruning older ones, want 3", n)
+	}
+	e := time.Now()
+	switchproxy.PoolPut(p, 2)
+	switchproxy.PoolPrune(p, e)
+	if n := switchproxy.PoolIdle(p); n != 2 {
+		t.Fatalf("idle transfers = %d, want only the 2 newer ones", n)
+	}
+	p.PoolReap(0)
+	if switchproxy.PoolPut(p, 1); switchproxy.PoolIdle(p) != 0 {
+		t.Fatal("transfers are kept after the reaper was stopped")
+	}
+}
+func TestPoolReap(t *testing.T) {
+	p := switchproxy.New("")
+	defer p.Close()
+	p.PoolReap(10 * time.Millisecond)
+	switchproxy.PoolPut(p, 4)
+	for i := 0; i < 100 && switchproxy.PoolIdle(p) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := switchproxy.PoolIdle(p); n != 0 {
+		t.Fatalf("idle transfers = %d, want the pool to shrink after the interval", n)
+	}
+}
+func TestPoolReapCancel(t *testing.T) {
+	x, f := context.WithCancel(context.Background())
+	p := switchproxy.NewContext(x, "")
+	defer p.Close()
+	p.PoolReap(time.Hour)
+	switchproxy.PoolPut(p, 2)
+	// The task stops with the Proxy context, which must also stop the list
+	// from growing, as nothing would prune it.
+	f()
+	for i := 0; i < 100 && switchproxy.PoolIdle(p) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if switchproxy.PoolPut(p, 1); switchproxy.PoolIdle(p) != 0 {
+		t.Fatal("transfers are kept after the Proxy context was cancelled")
+	}
+	// Stopping the task again after it already exited must not block.
+	p.PoolReap(0)
+}
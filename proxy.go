@@ -20,10 +20,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,42 +38,341 @@ import (
 // specified in NewProxy.
 const DefaultTimeout = time.Second * time.Duration(15)
 
+const headerOverride = "X-HTTP-Method-Override"
+
+// maxGrow is the largest Content-Length that the request buffer will be sized
+// for before the body is read. Larger bodies still grow the buffer as they are
+// read, so memory is only used for bytes the client has actually sent.
+const maxGrow = 1 << 20
+
+var errTooLarge = errors.New("request body too large")
+
 // Proxy is a struct that represents a stacked proxy that allows a forwarding proxy
 // with secondary read only Switch connections that allow logging and storing
 // the connection data.
 type Proxy struct {
-	ctx       context.Context
-	key       string
-	cert      string
-	pool      *sync.Pool
-	server    *http.Server
-	cancel    context.CancelFunc
+	config
+	ctx      context.Context
+	key      string
+	cert     string
+	certs    []tls.Certificate
+	roots    *x509.CertPool
+	auth     tls.ClientAuthType
+	pause    atomic.Int32
+	paused   atomic.Bool
+	alive    time.Duration
+	lock     sync.RWMutex
+	reload   sync.RWMutex
+	pool     *pool
+	server   *http.Server
+	cancel   context.CancelFunc
+	listener net.Listener
+	listen   []*listen
+	http1    bool
+	debug    bool
+}
+
+// config is the Proxy settings that are used while handling requests. Setters
+// change these under the Proxy lock and each request takes a copy when it
+// starts, so they can be changed while requests are being handled.
+type config struct {
+	certHead  *CertHeaders
+	limit     int64
+	limits    map[string]int64
+	urlMax    int
+	budget    time.Duration
+	deadline  time.Duration
 	primary   *Switch
+	dual      *dual
+	fallback  *Switch
+	audit     *audit
+	metrics   *metrics
+	access    *access
+	ring      *ring
+	geo       *geo
+	group     *group
+	cache     *cache
+	cacheWhen Matcher
+	groupWhen Matcher
+	observers []Handler
+	via       string
+	external  *url.URL
+	onError   ErrorHandler
+	onClient  ErrorHandler
+	onRequest RequestHandler
+	onReject  RejectHandler
+	down      *static
+	statics   map[string]*static
+	types     map[string]*Switch
+	routes    []route
 	secondary []*Switch
+	sinks     []*Switch
+	weighted  []weighted
+	trusted   []*net.IPNet
+	total     int
+	tee       int64
+	auditMax  int
+	normalize func([]byte) []byte
+	sample    uint32
+	fanout    int
+	override  bool
+	stale     bool
+}
+
+// ErrorHandler is a function alias that can be passed a request and an error
+// that occurred while it was being processed.
+type ErrorHandler func(*http.Request, error)
+
+// RequestHandler is a function alias that can be passed a request before it is
+// processed by any Switch. Returning a non-nil error will reject the request.
+type RequestHandler func(*http.Request) error
+
+// StatusError is an error struct that can be returned by a RequestHandler to
+// reject a request with a specific HTTP status code.
+//
+// Errors from Switch targets are also passed to the ErrorHandler as a
+// *StatusError, with a status of 504 for timeouts and 502 for any other
+// connection errors.
+type StatusError struct {
+	Err    error
+	Status int
+}
+type static struct {
+	kind   string
+	body   []byte
+	status int
+}
+type keepAlive struct {
+	net.Listener
+	d time.Duration
+}
+type weighted struct {
+	s      *Switch
+	weight int
+}
+type listen struct {
+	l               net.Listener
+	s               *http.Server
+	addr, cert, key string
 }
 type transfer struct {
-	in   *bytes.Reader
-	out  *bytes.Buffer
-	read *bytes.Buffer
-	data []byte
+	id     string
+	in     *bytes.Reader
+	out    *bytes.Buffer
+	read   *bytes.Buffer
+	stream io.Reader
+	hint   *hinter
+	resp   *streamer
+	data   []byte
+	fail   bool
 }
 
 // Close attempts to gracefully close and stop the proxy and all remaining
 // connections.
 func (p *Proxy) Close() error {
 	p.cancel()
-	return p.server.Close()
+	err := p.server.Close()
+	for _, s := range p.servers() {
+		if e := s.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shutdown attempts to gracefully stop the proxy, without interrupting any active
+// connections. This waits for all active requests to finish or the context
+// to be cancelled, which will return the context error.
+func (p *Proxy) Shutdown(x context.Context) error {
+	err := p.server.Shutdown(x)
+	for _, s := range p.servers() {
+		if e := s.Shutdown(x); err == nil {
+			err = e
+		}
+	}
+	p.cancel()
+	return err
 }
 
 // Start starts the Server listening loop and returns an error if the server
 // could not be started.
 //
-// Only returns an error if any IO issues occur during operation.
+// If any extra addresses were added with the 'Listen' or 'ListenTLS' parameters,
+// a server is started for each address and this will block until all of them
+// are stopped. Any errors returned by the servers are joined together.
+//
+// Only returns an error if any IO issues occur during operation. This returns
+// nil when the Proxy is stopped using 'Close' or 'Shutdown'.
 func (p *Proxy) Start() error {
+	a := p.server.Addr
+	if len(a) == 0 {
+		if a = ":http"; (len(p.cert) > 0 && len(p.key) > 0) || len(p.certs) > 0 {
+			a = ":https"
+		}
+	}
+	l, err := net.Listen("tcp", a)
+	if err != nil {
+		p.Close()
+		return err
+	}
+	v := p.listens()
+	if len(v) == 0 {
+		return p.Serve(l)
+	}
+	n := make([]net.Listener, len(v))
+	for i := range v {
+		if n[i], err = net.Listen("tcp", v[i].addr); err != nil {
+			for _, c := range n[:i] {
+				c.Close()
+			}
+			l.Close()
+			p.Close()
+			return err
+		}
+	}
+	var (
+		g sync.WaitGroup
+		e = make([]error, len(v)+1)
+	)
+	p.lock.Lock()
+	for i := range v {
+		v[i].s = p.clone()
+	}
+	p.lock.Unlock()
+	for i := range v {
+		g.Add(1)
+		go func(i int) {
+			e[i+1] = p.serve(v[i].s, n[i], v[i].cert, v[i].key, &v[i].l)
+			g.Done()
+		}(i)
+	}
+	e[0] = p.Serve(l)
+	g.Wait()
+	return errors.Join(e...)
+}
+
+// Addr returns the address that the Proxy is listening on. This will return
+// nil if the Proxy is not listening.
+//
+// This can be used to find the port chosen when listening on port zero.
+func (p *Proxy) Addr() net.Addr {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// Addrs returns the addresses of all the listeners that the Proxy is listening
+// on, starting with the address returned by 'Addr', followed by any addresses
+// added with the 'Listen' or 'ListenTLS' parameters, in order.
+//
+// Addresses that are not listening are skipped.
+func (p *Proxy) Addrs() []net.Addr {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	a := make([]net.Addr, 0, len(p.listen)+1)
+	if p.listener != nil {
+		a = append(a, p.listener.Addr())
+	}
+	for _, v := range p.listen {
+		if v.l != nil {
+			a = append(a, v.l.Addr())
+		}
+	}
+	return a
+}
+
+// AddCertificate loads the specified certificate and key files and adds them to
+// the certificates used by the Proxy, which will enable TLS. This can be called
+// multiple times to serve multiple domains on the same address, as the
+// certificate is selected using the SNI name sent by the client.
+//
+// The certificate set by the TLS parameter (or the first added certificate, if
+// not set) is used when no certificate matches. Certificates added after the
+// Proxy is started are only used once it is restarted.
+func (p *Proxy) AddCertificate(cert, key string) error {
+	c, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.certs = append(p.certs, c)
+	p.lock.Unlock()
+	return nil
+}
+
+// Serve starts the Server listening loop on the specified Listener and returns
+// an error if the server could not be started.
+//
+// Only returns an error if any IO issues occur during operation. This returns
+// nil when the Proxy is stopped using 'Close' or 'Shutdown'.
+func (p *Proxy) Serve(l net.Listener) error {
+	return p.serve(p.server, l, p.cert, p.key, &p.listener)
+}
+func (p *Proxy) clone() *http.Server {
+	return &http.Server{
+		Handler:           p.server.Handler,
+		ConnState:         p.server.ConnState,
+		Protocols:         p.server.Protocols,
+		BaseContext:       p.server.BaseContext,
+		ReadTimeout:       p.server.ReadTimeout,
+		IdleTimeout:       p.server.IdleTimeout,
+		WriteTimeout:      p.server.WriteTimeout,
+		TLSNextProto:      p.server.TLSNextProto,
+		MaxHeaderBytes:    p.server.MaxHeaderBytes,
+		ReadHeaderTimeout: p.server.ReadHeaderTimeout,
+	}
+}
+func (p *Proxy) servers() []*http.Server {
+	p.lock.RLock()
+	s := make([]*http.Server, 0, len(p.listen))
+	for _, v := range p.listen {
+		if v.s != nil {
+			s = append(s, v.s)
+		}
+	}
+	p.lock.RUnlock()
+	return s
+}
+func (p *Proxy) listens() []*listen {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.listen
+}
+func (p *Proxy) serve(s *http.Server, l net.Listener, cert, key string, v *net.Listener) error {
+	var c []tls.Certificate
+	if s == p.server {
+		p.lock.RLock()
+		c = p.certs
+		p.lock.RUnlock()
+		if len(c) > 0 && len(cert) > 0 && len(key) > 0 {
+			// The TLS pair must be loaded here, as 'ServeTLS' would replace the
+			// added certificates with it. It stays the default certificate.
+			x, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				l.Close()
+				p.Close()
+				return err
+			}
+			c, cert, key = append([]tls.Certificate{x}, c...), "", ""
+		}
+	}
+	if p.alive != 0 {
+		l = &keepAlive{Listener: l, d: p.alive}
+	}
+	p.lock.Lock()
+	*v = l
+	p.lock.Unlock()
 	var err error
-	if len(p.cert) > 0 && len(p.key) > 0 {
-		p.server.TLSConfig = &tls.Config{
-			NextProtos: []string{"h2", "http/1.1"},
+	if len(c) > 0 || (len(cert) > 0 && len(key) > 0) {
+		n := []string{"h2", "http/1.1"}
+		if p.http1 {
+			n = n[1:]
+		}
+		s.TLSConfig = &tls.Config{
+			NextProtos: n,
 			MinVersion: tls.VersionTLS12,
 			CipherSuites: []uint16{
 				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
@@ -78,65 +384,896 @@ func (p *Proxy) Start() error {
 			},
 			CurvePreferences:         []tls.CurveID{tls.CurveP256, tls.X25519},
 		}
-		err = p.server.ListenAndServeTLS(p.cert, p.key)
+		// Go will select the certificate that matches the SNI of the client,
+		// using the first one if none match.
+		s.TLSConfig.Certificates = c
+		s.TLSConfig.ClientCAs, s.TLSConfig.ClientAuth = p.roots, p.auth
+		err = s.ServeTLS(l, cert, key)
 	} else {
-		err = p.server.ListenAndServe()
+		err = s.Serve(l)
+	}
+	p.lock.Lock()
+	*v = nil
+	p.lock.Unlock()
+	if err == http.ErrServerClosed {
+		// The Proxy was stopped by 'Close' or 'Shutdown', so it is already
+		// closed.
+		return nil
 	}
 	p.Close()
 	return err
 }
 
+// Accept satisfies the net.Listener interface.
+func (k *keepAlive) Accept() (net.Conn, error) {
+	c, err := k.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := c.(*net.TCPConn); ok {
+		if k.d < 0 {
+			t.SetKeepAlive(false)
+		} else {
+			t.SetKeepAlive(true)
+			t.SetKeepAlivePeriod(k.d)
+		}
+	}
+	return c, nil
+}
+
+// Reconfigure calls the function with the Proxy, so that all the Proxy settings
+// it changes are applied together. Each request copies the Proxy settings when
+// it starts, so every request will use either the old or the new settings and
+// requests that are already being handled are not affected.
+//
+// New requests wait until the function returns, so it should not block. The
+// Proxy setter functions are safe to use in the function (and at any other
+// time), but 'Start', 'Serve', 'Close', 'Shutdown' and 'Reconfigure' must not be
+// called. Switch settings are not part of the copy, so changes to a Switch that
+// is in use are seen by requests already being handled and should be made by
+// setting a new Switch instead. Setters documented as needing to be called
+// before the Proxy or Switch is used (such as server timeouts, 'OnConnState'
+// and the Switch Transport settings) are not safe to change here either.
+func (p *Proxy) Reconfigure(f func(*Proxy)) {
+	p.reload.Lock()
+	defer p.reload.Unlock()
+	f(p)
+}
+
+// settings returns a copy of the current Proxy settings, which is used for the
+// whole request. Holding the reload lock means the copy is never taken while
+// 'Reconfigure' is part way through its changes.
+func (p *Proxy) settings() *config {
+	p.reload.RLock()
+	p.lock.RLock()
+	o := p.config
+	p.lock.RUnlock()
+	p.reload.RUnlock()
+	return &o
+}
+
+// Pause stops the Proxy from handling new requests until 'Resume' is called,
+// without closing the listeners or any client connections. Requests that are
+// received while paused are answered with the status set by 'PauseStatus' (503
+// by default). Requests that are already being handled complete normally.
+func (p *Proxy) Pause() {
+	p.paused.Store(true)
+}
+
+// Resume allows the Proxy to handle requests again after a call to 'Pause'.
+func (p *Proxy) Resume() {
+	p.paused.Store(false)
+}
+
+// PauseStatus sets the HTTP status code that is returned to clients while the
+// Proxy is paused. A value of zero or less restores the default 503 status.
+func (p *Proxy) PauseStatus(c int) {
+	if c <= 0 {
+		c = http.StatusServiceUnavailable
+	}
+	p.pause.Store(int32(c))
+}
+
 // Primary sets the primary Proxy Switch context.
+//
+// This is the default primary Switch. The primary Switch used for each request
+// is the first match of:
+//
+//  1. The routes added by 'AddRoute', in the order they were added.
+//  2. The Switch set by 'RouteContentType' for the request Content-Type.
+//  3. The Switch set by 'GeoRoute' for the client region.
+//  4. The Switch set by this function.
 func (p *Proxy) Primary(s *Switch) {
+	p.lock.Lock()
 	p.primary = s
+	p.lock.Unlock()
+}
+
+// PrimarySwitch returns the primary Proxy Switch context, or nil if none is set.
+func (p *Proxy) PrimarySwitch() *Switch {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.primary
+}
+
+// Secondaries returns a copy of the list of the one-way Switch contexts added
+// by 'AddSecondary'.
+func (p *Proxy) Secondaries() []*Switch {
+	p.lock.RLock()
+	s := make([]*Switch, len(p.secondary))
+	copy(s, p.secondary)
+	p.lock.RUnlock()
+	return s
+}
+func (o *config) switches(r *http.Request) (*Switch, []*Switch) {
+	for i := range o.routes {
+		if o.routes[i].m(r) {
+			return o.routes[i].s, o.secondary
+		}
+	}
+	if len(o.types) > 0 {
+		if v, ok := o.types[mediaType(r.Header.Get("Content-Type"))]; ok {
+			return v, o.secondary
+		}
+	}
+	if o.geo != nil {
+		return o.geo.route(r, o.primary, o.trusted), o.secondary
+	}
+	return o.primary, o.secondary
+}
+
+// RouteContentType sets the Switch that will be used as the primary Switch for
+// requests with the specified Content-Type.
+//
+// Only the media type is matched (case-insensitive), so any parameters, such as
+// 'charset', are ignored. Content types are checked after the routes added by
+// 'AddRoute' and before 'GeoRoute' (see 'Primary'). Passing a nil Switch removes
+// the route.
+func (p *Proxy) RouteContentType(ct string, s *Switch) {
+	k := mediaType(ct)
+	p.lock.Lock()
+	m := make(map[string]*Switch, len(p.types)+1)
+	for n, v := range p.types {
+		m[n] = v
+	}
+	if s == nil {
+		delete(m, k)
+	} else {
+		m[k] = s
+	}
+	p.types = m
+	p.lock.Unlock()
+}
+func mediaType(s string) string {
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Fallback sets a Switch that will be used to serve requests when the primary
+// Switch fails, according to the primary Switch 'IsFailure' function.
+//
+// Results from the fallback Switch will have the Failover field set to true.
+// If the fallback Switch also fails, the primary Switch response is returned.
+// Passing nil disables the fallback.
+func (p *Proxy) Fallback(s *Switch) {
+	p.lock.Lock()
+	p.fallback = s
+	p.lock.Unlock()
+}
+
+// RequestBudget sets the total amount of time that can be spent on forwarding
+// each request, which is shared by all attempts, such as the primary and
+// fallback Switches. Once the budget is used, no further attempts are started
+// and a 504 response is returned.
+//
+// A value of zero or less disables the budget (the default).
+func (p *Proxy) RequestBudget(d time.Duration) {
+	p.lock.Lock()
+	p.budget = d
+	p.lock.Unlock()
+}
+
+// ClientWriteTimeout sets the maximum amount of time that each write of the
+// response body to the client can take. Responses are written in blocks when
+// this is set, so large responses can take longer than the server WriteTimeout,
+// as long as the client keeps reading them.
+//
+// If a client does not read a block in time, the connection is closed. A value
+// of zero or less disables the timeout (the default).
+func (p *Proxy) ClientWriteTimeout(d time.Duration) {
+	p.lock.Lock()
+	p.deadline = d
+	p.lock.Unlock()
+}
+func (o *config) write(w http.ResponseWriter, b []byte) error {
+	if o.deadline <= 0 {
+		_, err := w.Write(b)
+		return err
+	}
+	c := http.NewResponseController(w)
+	if err := c.SetWriteDeadline(time.Time{}); errors.Is(err, http.ErrNotSupported) {
+		_, err = w.Write(b)
+		return err
+	}
+	for len(b) > 0 {
+		n := min(len(b), 32*1024)
+		if err := c.SetWriteDeadline(time.Now().Add(o.deadline)); err != nil {
+			return err
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	if err := c.SetWriteDeadline(time.Now().Add(o.deadline)); err != nil {
+		return err
+	}
+	err := c.Flush()
+	// Clear the deadline, so it does not apply to the next request on this
+	// connection.
+	c.SetWriteDeadline(time.Time{})
+	return err
+}
+func (o *config) head(w http.ResponseWriter, s *Switch, h http.Header) {
+	s.copyHeaders(w.Header(), h)
+	if o.external != nil {
+		relocate(s, w.Header(), o.external)
+	}
+	hop(w.Header())
+	w.Header().Del("Transfer-Encoding")
+}
+func (p *Proxy) forward(o *config, s *Switch, r *http.Request, t *transfer) (*Switch, Result, error) {
+	x := p.ctx
+	if o.budget > 0 {
+		var f context.CancelFunc
+		x, f = context.WithTimeout(x, o.budget)
+		defer f()
+	}
+	if d, ok := r.Context().Deadline(); ok {
+		// The client will not wait past its own deadline, so the Switch timeouts
+		// are cut short by it.
+		var f context.CancelFunc
+		x, f = context.WithDeadline(x, d)
+		defer f()
+	}
+	var (
+		v   Result
+		err error
+	)
+	if r.Context().Value(redirectKey{}) != nil {
+		x = context.WithValue(x, redirectKey{}, struct{}{})
+	}
+	if u := targetFrom(r.Context()); u != nil {
+		v, err = s.direct(x, r, t, *u)
+	} else {
+		v, err = s.process(x, r, t)
+	}
+	if err != nil {
+		o.error(r, err)
+	}
+	if o.fallback == nil || t.stream != nil || !s.failed(int(v.Status), err) || errors.Is(err, ErrDigestMismatch) {
+		return s, v, err
+	}
+	if x.Err() != nil {
+		return s, v, &StatusError{Err: x.Err(), Status: http.StatusGatewayTimeout}
+	}
+	if err == nil {
+		// Keep the primary response, as the buffer will be reused.
+		v.Content = append([]byte(nil), v.Content...)
+	}
+	t.out.Reset()
+	t.in = bytes.NewReader(t.data)
+	t.fail = true
+	o.fallback.stats.fallbacks.Add(1)
+	f, err2 := o.fallback.process(x, r, t)
+	if t.fail = false; err2 != nil {
+		o.error(r, err2)
+	}
+	if o.fallback.failed(int(f.Status), err2) {
+		return s, v, err
+	}
+	return o.fallback, f, nil
 }
 func (p *Proxy) clear(t *transfer) {
-	t.in, t.data = nil, nil
+	t.in, t.data, t.stream, t.fail, t.id, t.hint, t.resp = nil, nil, nil, false, "", nil, nil
 	t.out.Reset()
 	t.read.Reset()
-	p.pool.Put(t)
+	p.pool.put(t)
+}
+
+// MaxBodySizeForMethod sets the limit of the size of client request bodies, in
+// bytes, for requests with the specified method, instead of the limit set by
+// the MaxBodySize option. Requests with larger bodies will receive a 413
+// response.
+//
+// A value of zero disables the limit for the method, while a value less than
+// zero removes the override, so the MaxBodySize limit is used again.
+func (p *Proxy) MaxBodySizeForMethod(method string, n int64) {
+	k := strings.ToUpper(method)
+	p.lock.Lock()
+	m := make(map[string]int64, len(p.limits)+1)
+	for x, v := range p.limits {
+		m[x] = v
+	}
+	if n < 0 {
+		delete(m, k)
+	} else {
+		m[k] = n
+	}
+	p.limits = m
+	p.lock.Unlock()
+}
+func (o *config) bodyLimit(r *http.Request) int64 {
+	n, ok := o.limits[r.Method]
+	if !ok {
+		return o.limit
+	}
+	return n
+}
+func (p *Proxy) read(r *http.Request, t *transfer, l int64) error {
+	if n := r.ContentLength; n > 0 {
+		// Size the buffer for the known length, so it is not grown while the
+		// body is read. The extra space stops 'ReadFrom' growing the buffer
+		// again before it sees the end of the body. The size is capped by the
+		// body limit and a small constant, as the client may not send the body
+		// it claims.
+		if l > 0 {
+			n = min(n, l+1)
+		}
+		t.read.Grow(int(min(n, maxGrow)) + bytes.MinRead)
+	}
+	if l <= 0 {
+		_, err := io.Copy(t.read, r.Body)
+		return err
+	}
+	if _, err := io.Copy(t.read, io.LimitReader(r.Body, l+1)); err != nil {
+		return err
+	}
+	if int64(t.read.Len()) > l {
+		return errTooLarge
+	}
+	return nil
+}
+func (t *transfer) body() io.Reader {
+	if t.stream != nil {
+		return t.stream
+	}
+	return t.in
+}
+
+// streamable returns true if the request body can be passed directly to the
+// primary Switch without buffering. This is only possible for requests without
+// a known length (chunked) when no other Switches need to read the request
+// body.
+func (o *config) streamable(r *http.Request, s *Switch, z []*Switch) bool {
+	if r.ContentLength >= 0 || s == nil || o.fallback != nil || o.dual != nil {
+		return false
+	}
+	return len(z) == 0 && o.total == 0
 }
 
 // AddSecondary adds a one-way Switch context.
 func (p *Proxy) AddSecondary(s ...*Switch) {
-	p.secondary = append(p.secondary, s...)
+	p.lock.Lock()
+	// Copy on write, so that any requests using the current list are not affected.
+	n := make([]*Switch, len(p.secondary), len(p.secondary)+len(s))
+	copy(n, p.secondary)
+	p.secondary = append(n, s...)
+	p.lock.Unlock()
+}
+
+// AddSecondaryWeighted adds a one-way Switch context that will only receive a
+// portion of the requests, according to its weight.
+//
+// For each request, one of the Switches added by this function is chosen at
+// random, with a chance of its weight divided by the sum of all the weights.
+// A weight of zero or less means that the Switch will never be chosen. Secondary
+// Switches added with 'AddSecondary' will always receive every request.
+func (p *Proxy) AddSecondaryWeighted(s *Switch, weight int) {
+	if weight < 0 {
+		weight = 0
+	}
+	p.lock.Lock()
+	n := make([]weighted, len(p.weighted), len(p.weighted)+1)
+	copy(n, p.weighted)
+	p.weighted = append(n, weighted{s: s, weight: weight})
+	p.total += weight
+	p.lock.Unlock()
+}
+func (o *config) pick() *Switch {
+	if o.total <= 0 {
+		return nil
+	}
+	n := int(fastRand() % uint32(o.total))
+	for i := range o.weighted {
+		if n -= o.weighted[i].weight; n < 0 {
+			return o.weighted[i].s
+		}
+	}
+	return nil
+}
+
+// MaxSecondariesPerRequest sets the maximum number of secondary Switches that
+// each request will be sent to. This includes the Switch chosen from the ones
+// added by 'AddSecondaryWeighted'.
+//
+// When there are more secondary Switches than the limit, a random set of them
+// is chosen for each request, so all of them still receive requests over time.
+// A value of zero or less removes the limit (the default).
+func (p *Proxy) MaxSecondariesPerRequest(n int) {
+	p.lock.Lock()
+	p.fanout = n
+	p.lock.Unlock()
+}
+func (o *config) targets(z []*Switch) []*Switch {
+	k := o.pick()
+	if k == nil && (o.fanout <= 0 || len(z) <= o.fanout) {
+		return z
+	}
+	n := make([]*Switch, len(z), len(z)+1)
+	if copy(n, z); k != nil {
+		n = append(n, k)
+	}
+	if o.fanout <= 0 || len(n) <= o.fanout {
+		return n
+	}
+	// Only the start of the list is shuffled, as the rest is dropped.
+	for i := 0; i < o.fanout; i++ {
+		j := i + int(fastRand()%uint32(len(n)-i))
+		n[i], n[j] = n[j], n[i]
+	}
+	return n[:o.fanout]
+}
+
+// AddObserver adds a Handler that will be passed the Result of each request
+// without forwarding the request to any other server.
+//
+// Observers are called with the Result of the client request and, if the primary
+// Switch returned a response, are called again with the Result of the primary
+// response. Results passed to Observers can be told apart using the
+// 'IsResponse' function.
+func (p *Proxy) AddObserver(h ...Handler) {
+	p.lock.Lock()
+	n := make([]Handler, len(p.observers), len(p.observers)+len(h))
+	copy(n, p.observers)
+	p.observers = append(n, h...)
+	p.lock.Unlock()
+}
+
+// MethodOverride sets if the Proxy will honor the "X-HTTP-Method-Override"
+// header on POST requests.
+//
+// When enabled, the method of any POST request that contains this header will
+// be replaced by the header value, if it is a valid method. The header is
+// removed from all requests before they are forwarded.
+func (p *Proxy) MethodOverride(e bool) {
+	p.lock.Lock()
+	p.override = e
+	p.lock.Unlock()
+}
+
+// Via sets the pseudonym that the Proxy will add to the "Via" header of any
+// forwarded requests and returned responses, in addition to any existing
+// values. An empty string (the default) disables adding the header.
+func (p *Proxy) Via(pseudonym string) {
+	p.lock.Lock()
+	p.via = pseudonym
+	p.lock.Unlock()
+}
+
+// OnClientError sets a function that will be called when reading the request
+// body from a client fails, such as when the client aborts an upload.
+//
+// These requests are not sent to any Switches and receive a 400 response, or a
+// 408 response if the read timed out. These errors are not passed to the
+// 'OnError' function.
+func (p *Proxy) OnClientError(f ErrorHandler) {
+	p.lock.Lock()
+	p.onClient = f
+	p.lock.Unlock()
+}
+
+// OnConnState sets a function that will be called when a client connection
+// changes state, such as when it is accepted, becomes idle or is closed. This
+// is used for all addresses the Proxy listens on.
+//
+// This must be set before the Proxy is started. A nil function disables this.
+func (p *Proxy) OnConnState(f func(net.Conn, http.ConnState)) {
+	p.server.ConnState = f
+}
+
+// OnError sets a function that will be called when an error occurs while
+// processing a request with the primary or a secondary Switch.
+//
+// Panics caused by secondary Switches (or their Handlers) are recovered and
+// passed to this function as errors.
+func (p *Proxy) OnError(f ErrorHandler) {
+	p.lock.Lock()
+	p.onError = f
+	p.lock.Unlock()
+}
+
+// OnRequest sets a function that will be called with each request after the
+// request body is read and before it is passed to any Switch.
+//
+// The function may modify the request and any changes will be visible to the
+// primary and secondary Switches. If the function returns an error, the request
+// will be rejected with a 403 status, unless the error is a *StatusError, which
+// will use the specified status code instead.
+func (p *Proxy) OnRequest(f RequestHandler) {
+	p.lock.Lock()
+	p.onRequest = f
+	p.lock.Unlock()
+}
+
+// MaintenanceResponse sets a static response that will be returned to clients
+// instead of the default 503 response when no primary Switch is set, or when the
+// primary Switch is unhealthy (see 'ServeStale' for the full order).
+//
+// Secondary Switches will still receive any requests. Passing a status of zero
+// or less will restore the default response.
+func (p *Proxy) MaintenanceResponse(status int, contentType string, body []byte) {
+	var v *static
+	if status > 0 {
+		v = &static{kind: contentType, body: body, status: status}
+	}
+	p.lock.Lock()
+	p.down = v
+	p.lock.Unlock()
+}
+
+// StaticResponse sets a static response that will be returned to clients for
+// requests with the exact specified path, instead of forwarding them.
+//
+// These requests are not sent to the primary or secondary Switches. Passing a
+// status of zero or less will remove the response for the path.
+func (p *Proxy) StaticResponse(path string, status int, contentType string, body []byte) {
+	p.lock.Lock()
+	m := make(map[string]*static, len(p.statics)+1)
+	for k, v := range p.statics {
+		m[k] = v
+	}
+	if status <= 0 {
+		delete(m, path)
+	} else {
+		m[path] = &static{kind: contentType, body: body, status: status}
+	}
+	p.statics = m
+	p.lock.Unlock()
+}
+func (s *static) serve(w http.ResponseWriter) {
+	if len(s.kind) > 0 {
+		w.Header().Set("Content-Type", s.kind)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.body)))
+	w.WriteHeader(s.status)
+	w.Write(s.body)
+}
+func withUUID(r *http.Request, u string) *http.Request {
+	if i := FromContext(r.Context()); i != nil {
+		i.UUID = u
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), ContextKey{}, &Info{UUID: u}))
+}
+func (o *config) admit(w http.ResponseWriter, r *http.Request, t *transfer) bool {
+	// The request is written to the audit log before 'OnRequest' is called, so
+	// rejected requests are also logged.
+	if o.audit != nil {
+		o.audit.write(r, t, o.auditMax)
+	}
+	if o.onRequest == nil {
+		return true
+	}
+	err := o.onRequest(r)
+	if err == nil {
+		return true
+	}
+	c := http.StatusForbidden
+	if e := (*StatusError)(nil); errors.As(err, &e) && e.Status > 0 {
+		c = e.Status
+	}
+	o.reject(w, r, c)
+	return false
+}
+func (o *config) error(r *http.Request, err error) {
+	if o.onError != nil {
+		o.onError(r, err)
+	}
 }
 func (p *Proxy) context(_ net.Listener) context.Context {
 	return p.ctx
 }
 
+func (o *config) observe(r *http.Request, t *transfer, s *Switch, v Result, ok bool) {
+	q := Result{
+		IP:      r.RemoteAddr,
+		URL:     r.URL.String(),
+		UUID:    t.id,
+		Path:    r.URL.Path,
+		Method:  r.Method,
+		Content: t.data,
+		Headers: r.Header,
+	}
+	if ok {
+		v.Headers = s.headers(v.Headers)
+		q.Headers = s.headers(q.Headers)
+	}
+	for i := range o.observers {
+		o.observers[i](q)
+		if ok {
+			o.observers[i](v)
+		}
+	}
+}
+
+func uriLength(r *http.Request) int {
+	if len(r.RequestURI) > 0 {
+		return len(r.RequestURI)
+	}
+	// Requests that did not come from a server (such as in tests) do not have
+	// the raw URI set.
+	return len(r.URL.RequestURI())
+}
+func hasBody(c int) bool {
+	return c >= 200 && c != http.StatusNoContent && c != http.StatusNotModified
+}
+func errorStatus(err error) int {
+	if errors.Is(err, ErrHeadersTooLarge) || errors.Is(err, ErrResponseTooLarge) {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, ErrTargetDenied) {
+		return http.StatusForbidden
+	}
+	if e := (*StatusError)(nil); errors.As(err, &e) && e.Status > 0 {
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
+func methodOverride(r *http.Request) {
+	m := strings.ToUpper(strings.TrimSpace(r.Header.Get(headerOverride)))
+	if r.Header.Del(headerOverride); r.Method != http.MethodPost || len(m) == 0 {
+		return
+	}
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		r.Method = m
+	}
+}
+
+func (p *Proxy) secondaryProcess(o *config, s *Switch, r *http.Request, t *transfer) {
+	if s.meta.Load() {
+		i, d := t.in, t.data
+		t.in, t.data = bytes.NewReader(nil), nil
+		defer func() { t.in, t.data = i, d }()
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			o.error(r, fmt.Errorf("secondary panic: %v", err))
+		}
+	}()
+	if _, err := s.process(p.ctx, r, t); err != nil {
+		o.error(r, err)
+	}
+}
+
+// Error returns the string value of this error.
+func (e StatusError) Error() string {
+	if e.Err == nil {
+		return http.StatusText(e.Status)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error of this StatusError.
+func (e StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Handler returns the http.Handler used by the Proxy server, which can be
+// mounted in another http.ServeMux (or any router) instead of using 'Start' or
+// 'Serve'. This handles the metrics endpoint (if enabled by 'Metrics') and the
+// debug ring (if enabled by 'DebugRing') and forwards all other requests, like
+// 'ServeHTTP'.
+//
+// When mounted under a subpath, use http.StripPrefix to remove the subpath
+// before the requests are forwarded, if the Switch targets do not expect it.
+func (p *Proxy) Handler() http.Handler {
+	return p.server.Handler
+}
+
 // ServeHTTP satisfies the http.Handler interface.
+//
+// A Proxy can be used as a plain http.Handler, which forwards every request it
+// receives. Unlike 'Handler', this does not handle the metrics endpoint or the
+// debug ring.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	t := p.pool.Get().(*transfer)
-	if _, err := io.Copy(t.read, r.Body); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	o := p.settings()
+	if o.metrics != nil || o.access != nil {
+		c := &recorder{ResponseWriter: w}
+		w = c
+		if m := o.metrics; m != nil {
+			defer m.done(c, m.start())
+		}
+		if a := o.access; a != nil {
+			// The request is replaced once the UUID is added to its context, so
+			// the last value is used.
+			n := time.Now()
+			defer func() { a.write(r, c, n) }()
+		}
+	}
+	if p.paused.Load() {
+		c := int(p.pause.Load())
+		if c == 0 {
+			c = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(c), c)
+		r.Body.Close()
+		return
+	}
+	if o.urlMax > 0 && uriLength(r) > o.urlMax {
+		o.reject(w, r, http.StatusRequestURITooLong)
+		r.Body.Close()
+		return
+	}
+	// These are applied before any requests are streamed (such as WebSockets
+	// and gRPC), so the Switch targets always receive them.
+	if u := o.external; u != nil {
+		r = forwarded(r, u)
+	}
+	if o.certHead != nil {
+		o.certHead.apply(r)
+	}
+	if isWebSocket(r) {
+		p.serveWebSocket(o, w, r)
+		return
+	}
+	if o.override {
+		methodOverride(r)
+	}
+	if v := o.statics[r.URL.Path]; v != nil {
+		v.serve(w)
+		r.Body.Close()
+		return
+	}
+	var via string
+	if len(o.via) > 0 {
+		via = strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor) + " " + o.via
+		r.Header.Add("Via", via)
+	}
+	if isGRPC(r) {
+		p.serveGRPC(o, w, r, via)
+		return
+	}
+	if isGRPCWeb(r) {
+		if s, _ := o.switches(r); s != nil && s.web.Load() {
+			p.serveGRPCWeb(o, w, r, s, via)
+			return
+		}
+	}
+	l := o.bodyLimit(r)
+	if l > 0 && r.ContentLength > l {
+		o.reject(w, r, http.StatusRequestEntityTooLarge)
+		r.Body.Close()
+		return
+	}
+	s, z := o.switches(r)
+	t := p.pool.get()
+	if o.streamable(r, s, z) {
+		if t.stream = r.Body; l > 0 {
+			t.stream = http.MaxBytesReader(w, r.Body, l)
+		}
+	} else if err := p.read(r, t, l); err != nil {
+		if err == errTooLarge {
+			o.reject(w, r, http.StatusRequestEntityTooLarge)
+		} else {
+			// The client failed to send the body, which is not an upstream
+			// issue, so the Switches are skipped.
+			c := http.StatusBadRequest
+			if n := net.Error(nil); errors.As(err, &n) && n.Timeout() {
+				c = http.StatusRequestTimeout
+			}
+			if o.onClient != nil {
+				o.onClient(r, err)
+			}
+			http.Error(w, http.StatusText(c), c)
+		}
 		p.clear(t)
 		r.Body.Close()
 		return
 	}
-	t.data = t.read.Bytes()
-	if t.in = bytes.NewReader(t.data); p.primary != nil {
-		if s, h, err := p.primary.process(p.ctx, r, t); err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	t.data, t.id = t.read.Bytes(), newUUID()
+	if r = withUUID(r, t.id); !o.admit(w, r, t) {
+		p.clear(t)
+		r.Body.Close()
+		return
+	}
+	var (
+		v  Result
+		x  *Switch
+		ok bool
+		a  bool
+	)
+	g, c, d := o.degrade(s, r, t)
+	t.hint = &hinter{w: w}
+	if o.tee > 0 && o.fallback == nil && o.dual == nil && o.cache == nil && o.group == nil {
+		t.resp = &streamer{w: w, o: o, b: t.out, via: via, n: o.tee}
+	}
+	if t.in = bytes.NewReader(t.data); s != nil && (c || !d) {
+		var (
+			h   bool
+			err error
+		)
+		if c {
+			x, v, h = s, g, true
 		} else {
-			for k, v := range h {
-				w.Header()[k] = v
+			x, v, h, err = p.fetch(o, s, r, t)
+		}
+		// Hints can be received after an error (such as a timeout), so they are
+		// stopped before the response is written.
+		switch t.hint.stop(); {
+		case t.streamed():
+			// The response was already started, so a failure can only be passed
+			// on to the client by aborting it.
+			ok, a = err == nil, err != nil
+		case err != nil:
+			c := errorStatus(err)
+			http.Error(w, http.StatusText(c), c)
+		case h && notModified(r, v.Headers):
+			writeNotModified(w, v.Headers)
+			ok = true
+		default:
+			// The response is fully buffered, so the length is known even when
+			// the upstream closed the connection to end the body. The length is
+			// always set from the buffer, so the client only ever receives a single
+			// framing, whatever the upstream sent. The net/http server never uses a
+			// chunked body for an HTTP/1.0 client, and closes the connection unless
+			// the client asked for keep-alive.
+			if o.head(w, x, v.Headers); r.Method != http.MethodHead && hasBody(int(v.Status)) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(v.Content)))
+			}
+			if len(via) > 0 {
+				w.Header().Add("Via", via)
 			}
-			w.WriteHeader(s)
-			if _, err := io.Copy(w, t.out); err != nil {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			w.WriteHeader(int(v.Status))
+			if r.Method != http.MethodHead {
+				if err := o.write(w, v.Content); err != nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
 			}
+			ok = true
 		}
+	} else if o.down != nil {
+		o.down.serve(w)
 	} else {
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 	}
-	if len(p.secondary) > 0 {
-		for i := range p.secondary {
-			t.out.Reset()
-			t.in.Seek(0, 0)
-			p.secondary[i].process(p.ctx, r, t)
-		}
+	// The response is written, so no other Switches can send hints or stream
+	// their responses.
+	t.hint, t.resp = nil, nil
+	if len(o.observers) > 0 {
+		o.observe(r, t, x, v, ok)
+	}
+	if o.ring != nil {
+		o.ring.add(r, t, x, v, ok)
+	}
+	if ok {
+		p.sink(o, r, v)
+	}
+	if ok && o.dual != nil && o.sampled() {
+		o.dual.compare(p.ctx, r, t, s, v, o.normalize)
+	}
+	// Each Switch is given a new reader of the body, so the read position left
+	// by one Switch can never affect the next one.
+	for _, k := range o.targets(z) {
+		t.out.Reset()
+		t.in = bytes.NewReader(t.data)
+		p.secondaryProcess(o, k, r, t)
 	}
 	p.clear(t)
-	r.Body.Close()
+	if r.Body.Close(); a {
+		panic(http.ErrAbortHandler)
+	}
 }
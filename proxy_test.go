@@ -0,0 +1,1329 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func do(t *testing.T, q *http.Request) (*http.Response, string) {
+	t.Helper()
+	o, err := http.DefaultClient.Do(q)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, err := io.ReadAll(o.Body)
+	if o.Body.Close(); err != nil {
+		t.Fatalf("read response failed: %s", err)
+	}
+	return o, string(b)
+}
+func get(t *testing.T, u string) (*http.Response, string) {
+	t.Helper()
+	q, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	return do(t, q)
+}
+func post(t *testing.T, u, body string) (*http.Response, string) {
+	t.Helper()
+	q, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	return do(t, q)
+}
+func TestChunkedStream(t *testing.T) {
+	var (
+		r = make(chan struct{})
+		c = make(chan string, 1)
+		x = make(chan bool, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, q *http.Request) {
+		if q.ContentLength != -1 {
+			c <- "content length was set"
+			return
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(q.Body, b); err != nil || string(b) != "first" {
+			c <- "first chunk was not received"
+			return
+		}
+		close(r)
+		v, err := io.ReadAll(q.Body)
+		if err != nil || string(v) != "second" {
+			c <- "second chunk was not received"
+			return
+		}
+		if q.Trailer.Get("X-Sum") != "42" {
+			c <- "trailer was not forwarded"
+			return
+		}
+		c <- ""
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	i, o := io.Pipe()
+	q, err := http.NewRequest(http.MethodPost, p.URL+"/", i)
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	q.Trailer = http.Header{"X-Sum": nil}
+	go func() {
+		o.Write([]byte("first"))
+		// The second chunk is only sent once the backend has read the first,
+		// so this hangs if the Proxy buffers the whole body first.
+		select {
+		case <-r:
+			x <- false
+		case <-time.After(5 * time.Second):
+			x <- true
+		}
+		q.Trailer.Set("X-Sum", "42")
+		o.Write([]byte("second"))
+		o.Close()
+	}()
+	do(t, q)
+	if <-x {
+		t.Fatal("the body was buffered before being forwarded")
+	}
+	if v := <-c; v != "" {
+		t.Fatal(v)
+	}
+}
+func TestObserver(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	c := make(chan switchproxy.Result, 4)
+	p := switchproxytest.NewProxy(t, s)
+	p.AddObserver(func(r switchproxy.Result) { c <- r })
+	post(t, p.URL+"/observe", "body")
+	var q, o switchproxy.Result
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-c:
+			if r.IsResponse() {
+				o = r
+			} else {
+				q = r
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("observer was not called")
+		}
+	}
+	if q.Method != http.MethodPost || q.Path != "/observe" || string(q.Content) != "body" {
+		t.Fatalf("request Result = %s %s %q, want POST /observe \"body\"", q.Method, q.Path, q.Content)
+	}
+	if h, _, err := net.SplitHostPort(q.IP); err != nil || h != "127.0.0.1" {
+		t.Fatalf("request Result IP = %q, want 127.0.0.1", q.IP)
+	}
+	if o.Status != http.StatusOK || string(o.Content) != "ok" {
+		t.Fatalf("response Result = %d %q, want 200 \"ok\"", o.Status, o.Content)
+	}
+}
+func TestMethodOverride(t *testing.T) {
+	c := make(chan string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.Method + " " + r.Header.Get("X-HTTP-Method-Override")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.MethodOverride(true)
+	for _, v := range []struct {
+		method, override, want string
+	}{
+		{http.MethodPost, "delete", "DELETE "},
+		{http.MethodPost, "TRACE", "POST "},
+		{http.MethodPut, "DELETE", "PUT "},
+		{http.MethodPost, "", "POST "},
+	} {
+		q, _ := http.NewRequest(v.method, p.URL+"/", nil)
+		if len(v.override) > 0 {
+			q.Header.Set("X-HTTP-Method-Override", v.override)
+		}
+		do(t, q)
+		if r := <-c; r != v.want {
+			t.Fatalf("%s with override %q: upstream saw %q, want %q", v.method, v.override, r, v.want)
+		}
+	}
+}
+func TestVia(t *testing.T) {
+	c := make(chan []string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c <- r.Header.Values("Via")
+		w.Header().Add("Via", "1.1 backend")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Via("edge")
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Add("Via", "1.0 client-proxy")
+	o, _ := do(t, q)
+	if v := strings.Join(<-c, ", "); v != "1.0 client-proxy, 1.1 edge" {
+		t.Fatalf("upstream Via = %q, want the chain with the Proxy added", v)
+	}
+	if v := strings.Join(o.Header.Values("Via"), ", "); v != "1.1 backend, 1.1 edge" {
+		t.Fatalf("client Via = %q, want the chain with the Proxy added", v)
+	}
+	p.Via("")
+	get(t, p.URL+"/")
+	if v := <-c; len(v) > 0 {
+		t.Fatalf("upstream Via = %q, want no header when unset", v)
+	}
+}
+func TestSecondaryFailure(t *testing.T) {
+	d := httptest.NewServer(http.NotFoundHandler())
+	d.Close()
+	a, err := switchproxy.NewSwitch(d.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	b := switchproxytest.NewSwitch(t, http.NotFoundHandler())
+	b.Pre = func(switchproxy.Result) { panic("handler panic") }
+	var (
+		c = make(chan string, 1)
+		e = make(chan error, 2)
+	)
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.URL.Path
+	}))
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	p.OnError(func(_ *http.Request, err error) { e <- err })
+	p.AddSecondary(a, b, x)
+	get(t, p.URL+"/log")
+	select {
+	case v := <-c:
+		if v != "/log" {
+			t.Fatalf("secondary path = %q, want /log", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the last secondary was skipped after the others failed")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-e:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d secondary errors, want 2", i)
+		}
+	}
+}
+func TestAddr(t *testing.T) {
+	p := switchproxy.New("127.0.0.1:0")
+	if a := p.Addr(); a != nil {
+		t.Fatalf("Addr = %s before Start, want nil", a)
+	}
+	e := make(chan error, 1)
+	go func() { e <- p.Start() }()
+	defer func() {
+		p.Close()
+		<-e
+	}()
+	var a net.Addr
+	for i := 0; a == nil && i < 100; i++ {
+		if a = p.Addr(); a == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if a == nil {
+		t.Fatal("Addr is nil after Start")
+	}
+	c, err := net.Dial("tcp", a.String())
+	if err != nil {
+		t.Fatalf("dial %s failed: %s", a, err)
+	}
+	c.Close()
+}
+func TestOnRequest(t *testing.T) {
+	var (
+		c = make(chan string, 2)
+		d = make(chan string, 2)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.Header.Get("X-Tenant")
+	}))
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		d <- r.Header.Get("X-Tenant")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.AddSecondary(x)
+	p.OnRequest(func(r *http.Request) error {
+		switch k := r.Header.Get("X-Key"); k {
+		case "":
+			return errors.New("missing key")
+		case "teapot":
+			return &switchproxy.StatusError{Status: http.StatusTeapot}
+		default:
+			r.Header.Set("X-Tenant", "tenant-"+k)
+		}
+		return nil
+	})
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d without the header, want 403", o.StatusCode)
+	}
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Set("X-Key", "teapot")
+	if o, _ := do(t, q); o.StatusCode != http.StatusTeapot {
+		t.Fatalf("status = %d with a StatusError, want 418", o.StatusCode)
+	}
+	q, _ = http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Set("X-Key", "a")
+	if o, _ := do(t, q); o.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d with the header, want 200", o.StatusCode)
+	}
+	if v := <-c; v != "tenant-a" {
+		t.Fatalf("primary X-Tenant = %q, want the changed request", v)
+	}
+	select {
+	case v := <-d:
+		if v != "tenant-a" {
+			t.Fatalf("secondary X-Tenant = %q, want the changed request", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary did not receive the request")
+	}
+	if len(c) > 0 || len(d) > 0 {
+		t.Fatal("rejected requests were forwarded")
+	}
+}
+func TestMaintenanceResponse(t *testing.T) {
+	c := make(chan string, 1)
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.URL.Path
+	}))
+	p := switchproxytest.NewProxy(t, nil)
+	p.AddSecondary(x)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d without a primary, want 503", o.StatusCode)
+	}
+	<-c
+	p.MaintenanceResponse(http.StatusOK, "text/html", []byte("<p>maintenance</p>"))
+	o, v := get(t, p.URL+"/down")
+	if o.StatusCode != http.StatusOK || o.Header.Get("Content-Type") != "text/html" || v != "<p>maintenance</p>" {
+		t.Fatalf("response = %d %q %q, want the maintenance response", o.StatusCode, o.Header.Get("Content-Type"), v)
+	}
+	select {
+	case v := <-c:
+		if v != "/down" {
+			t.Fatalf("secondary path = %q, want /down", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary did not receive the request")
+	}
+}
+func TestAddSecondaryWeighted(t *testing.T) {
+	var n [3]atomic.Int64
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	for i, w := range []int{1, 3, 0} {
+		c := &n[i]
+		p.AddSecondaryWeighted(switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			c.Add(1)
+		})), w)
+	}
+	for i := 0; i < 400; i++ {
+		get(t, p.URL+"/")
+	}
+	for i := 0; i < 100 && n[0].Load()+n[1].Load()+n[2].Load() < 400; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a, b, c := n[0].Load(), n[1].Load(), n[2].Load()
+	if a+b+c != 400 {
+		t.Fatalf("weighted Switches received %d requests, want one per request", a+b+c)
+	}
+	// Expected 100 and 300, the bounds are wide so the test is not flaky.
+	if c != 0 || a < 50 || a > 150 {
+		t.Fatalf("weighted Switches received %d, %d and %d requests, want about 100, 300 and 0", a, b, c)
+	}
+}
+func TestFallback(t *testing.T) {
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("primary"))
+	}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	c := make(chan switchproxy.Result, 1)
+	b.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, a)
+	p.Fallback(b)
+	// The fallback must receive the full body again after the primary read it.
+	if o, v := post(t, p.URL+"/", "payload"); o.StatusCode != http.StatusOK || v != "payload" {
+		t.Fatalf("response = %d %q, want the fallback response", o.StatusCode, v)
+	}
+	if r := <-c; !r.Failover {
+		t.Fatal("fallback Result Failover = false, want true")
+	}
+}
+func TestFallbackFailure(t *testing.T) {
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("primary"))
+	}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	p := switchproxytest.NewProxy(t, a)
+	p.Fallback(b)
+	if o, v := get(t, p.URL+"/"); o.StatusCode != http.StatusServiceUnavailable || v != "primary" {
+		t.Fatalf("response = %d %q, want the primary response when both fail", o.StatusCode, v)
+	}
+}
+func TestRequestBudget(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer a.Close()
+	var n atomic.Int64
+	b := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		n.Add(1)
+	}))
+	defer b.Close()
+	s, err := switchproxy.NewSwitch(a.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if err = s.AddTarget(b.URL); err != nil {
+		t.Fatalf("add target failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusOK || n.Load() != 1 {
+		t.Fatalf("status = %d, retries = %d, want the retry to succeed without a budget", o.StatusCode, n.Load())
+	}
+	p.RequestBudget(50 * time.Millisecond)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504 after the budget is used", o.StatusCode)
+	}
+	if v := n.Load(); v != 1 {
+		t.Fatalf("retries = %d, want no retry after the budget is used", v)
+	}
+}
+func TestSecondaries(t *testing.T) {
+	p := switchproxytest.NewProxy(t, nil)
+	if p.PrimarySwitch() != nil || len(p.Secondaries()) != 0 {
+		t.Fatal("new Proxy has Switches, want none")
+	}
+	var (
+		s = switchproxytest.NewSwitch(t, http.NotFoundHandler())
+		a = switchproxytest.NewSwitch(t, http.NotFoundHandler())
+		b = switchproxytest.NewSwitch(t, http.NotFoundHandler())
+		c = switchproxytest.NewSwitch(t, http.NotFoundHandler())
+	)
+	p.Primary(s)
+	p.AddSecondary(a, b)
+	p.AddSecondary(c)
+	if p.PrimarySwitch() != s {
+		t.Fatal("PrimarySwitch did not return the primary Switch")
+	}
+	v := p.Secondaries()
+	if len(v) != 3 || v[0] != a || v[1] != b || v[2] != c {
+		t.Fatalf("Secondaries = %v, want the added Switches in order", v)
+	}
+	// Changing the returned list must not change the Proxy.
+	v[0] = nil
+	if p.Secondaries()[0] != a {
+		t.Fatal("Secondaries returned the internal list")
+	}
+}
+func TestMetadataOnly(t *testing.T) {
+	var (
+		a = make(chan string, 1)
+		b = make(chan string, 1)
+		c = make(chan switchproxy.Result, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		v, _ := io.ReadAll(r.Body)
+		a <- string(v)
+	}))
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		v, _ := io.ReadAll(r.Body)
+		b <- r.URL.Path + " " + r.Header.Get("X-Trace") + " " + string(v)
+	}))
+	x.MetadataOnly(true)
+	x.Pre = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	p.AddSecondary(x)
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/meta", strings.NewReader("payload"))
+	q.Header.Set("X-Trace", "1")
+	do(t, q)
+	if v := <-a; v != "payload" {
+		t.Fatalf("primary body = %q, want the full body", v)
+	}
+	select {
+	case v := <-b:
+		if v != "/meta 1 " {
+			t.Fatalf("secondary received %q, want the path and headers without a body", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary did not receive the request")
+	}
+	if r := <-c; len(r.Content) > 0 || r.Path != "/meta" {
+		t.Fatalf("secondary Result Path = %q, Content = %q, want the path and no Content", r.Path, r.Content)
+	}
+}
+func TestStartError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	if err = switchproxy.New(l.Addr().String()).Start(); err == nil {
+		t.Fatal("Start returned nil for an address in use, want the bind error")
+	}
+	p := switchproxy.New("127.0.0.1:0")
+	e := make(chan error, 1)
+	go func() { e <- p.Start() }()
+	for i := 0; i < 100 && p.Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	select {
+	case err = <-e:
+		if err != nil {
+			t.Fatalf("Start returned %v after Shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+}
+func TestListen(t *testing.T) {
+	cert, key := certificate(t)
+	p := switchproxy.New("127.0.0.1:0", switchproxy.Listen("127.0.0.1:0"), switchproxy.ListenTLS("127.0.0.1:0", cert, key))
+	p.Primary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	e := make(chan error, 1)
+	go func() { e <- p.Start() }()
+	var a []net.Addr
+	for i := 0; i < 100 && len(a) < 3; i++ {
+		if a = p.Addrs(); len(a) < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if len(a) != 3 {
+		t.Fatalf("Addrs = %v, want 3 listening addresses", a)
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for i, u := range []string{"http://" + a[0].String(), "http://" + a[1].String(), "https://" + a[2].String()} {
+		o, err := c.Get(u)
+		if err != nil {
+			t.Fatalf("request to address %d failed: %s", i, err)
+		}
+		if o.Body.Close(); o.StatusCode != http.StatusOK {
+			t.Fatalf("address %d status = %d, want 200", i, o.StatusCode)
+		}
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	if err := <-e; err != nil {
+		t.Fatalf("Start returned %v after Shutdown, want nil", err)
+	}
+	if v := p.Addrs(); len(v) != 0 {
+		t.Fatalf("Addrs = %v after Shutdown, want none", v)
+	}
+}
+func TestOnClientError(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		n.Add(1)
+	}))
+	p := switchproxy.New("")
+	p.Primary(s)
+	// Only the read timeout is set, so the error response can still be written.
+	switchproxy.Server(p).ReadTimeout = 200 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	go p.Serve(l)
+	defer p.Close()
+	var (
+		c = make(chan error, 2)
+		e = make(chan error, 2)
+	)
+	p.OnClientError(func(_ *http.Request, err error) { c <- err })
+	p.OnError(func(_ *http.Request, err error) { e <- err })
+	send := func(close bool) int {
+		x, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %s", err)
+		}
+		defer x.Close()
+		x.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc"))
+		if close {
+			// The client stops sending partway through the body.
+			x.(*net.TCPConn).CloseWrite()
+		}
+		o, err := http.ReadResponse(bufio.NewReader(x), nil)
+		if err != nil {
+			t.Fatalf("read response failed: %s", err)
+		}
+		o.Body.Close()
+		return o.StatusCode
+	}
+	if v := send(true); v != http.StatusBadRequest {
+		t.Fatalf("status = %d for an aborted body, want 400", v)
+	}
+	if v := send(false); v != http.StatusRequestTimeout {
+		t.Fatalf("status = %d for a body read timeout, want 408", v)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnClientError called %d times, want 2", i)
+		}
+	}
+	if len(e) > 0 || n.Load() > 0 {
+		t.Fatalf("OnError called %d times, upstream received %d requests, want none", len(e), n.Load())
+	}
+}
+func TestCloseDelimited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = http.ReadRequest(bufio.NewReader(c)); err == nil {
+				// No Content-Length, the body ends when the connection closes.
+				io.WriteString(c, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\nlegacy body")
+			}
+			c.Close()
+		}
+	}()
+	s, err := switchproxy.NewSwitch("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewSwitch failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	c := &http.Client{Transport: &http.Transport{}}
+	defer c.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		o, err := c.Get(p.URL)
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		b, _ := io.ReadAll(o.Body)
+		o.Body.Close()
+		if string(b) != "legacy body" || o.ContentLength != int64(len(b)) {
+			t.Fatalf("request %d body = %q, Content-Length = %d, want the buffered length", i, b, o.ContentLength)
+		}
+		if o.Close || len(o.Header.Get("Connection")) > 0 {
+			t.Fatalf("request %d closed the client connection, want keep-alive", i)
+		}
+	}
+}
+func TestStaticResponse(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	var m atomic.Int64
+	p := switchproxytest.NewProxy(t, s)
+	p.AddSecondary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		m.Add(1)
+	})))
+	p.StaticResponse("/robots.txt", http.StatusOK, "text/plain", []byte("User-agent: *\nDisallow: /\n"))
+	o, b := get(t, p.URL+"/robots.txt")
+	if o.StatusCode != http.StatusOK || o.Header.Get("Content-Type") != "text/plain" || b != "User-agent: *\nDisallow: /\n" {
+		t.Fatalf("response = %d %q %q, want the static response", o.StatusCode, o.Header.Get("Content-Type"), b)
+	}
+	if n.Load() != 0 || m.Load() != 0 {
+		t.Fatalf("static response reached the Switches %d and %d times, want none", n.Load(), m.Load())
+	}
+	if _, b = get(t, p.URL+"/robots.txt/other"); b != "upstream /robots.txt/other" {
+		t.Fatalf("response = %q, want only the exact path to be static", b)
+	}
+	p.StaticResponse("/robots.txt", 0, "", nil)
+	if _, b = get(t, p.URL+"/robots.txt"); b != "upstream /robots.txt" {
+		t.Fatalf("response = %q after removing the static response, want it forwarded", b)
+	}
+}
+func TestAddCertificate(t *testing.T) {
+	s := switchproxy.New("127.0.0.1:0")
+	for _, n := range []string{"one.example.com", "two.example.com"} {
+		cert, key := certificate(t, n)
+		if err := s.AddCertificate(cert, key); err != nil {
+			t.Fatalf("AddCertificate failed: %s", err)
+		}
+	}
+	if err := s.AddCertificate("missing.pem", "missing.pem"); err == nil {
+		t.Fatal("AddCertificate should fail for missing files")
+	}
+	s.Primary(switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+	for _, v := range [...]struct{ sni, want string }{
+		{"one.example.com", "one.example.com"},
+		{"two.example.com", "two.example.com"},
+		{"other.example.com", "one.example.com"},
+	} {
+		x, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: v.sni, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("TLS dial failed: %s", err)
+		}
+		n := x.ConnectionState().PeerCertificates[0].DNSNames
+		if x.Close(); len(n) != 1 || n[0] != v.want {
+			t.Fatalf("SNI %q returned the certificate for %v, want %q", v.sni, n, v.want)
+		}
+	}
+}
+func TestReconfigure(t *testing.T) {
+	a := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("a"))
+	}))
+	b := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("b"))
+	}))
+	p := switchproxytest.NewProxy(t, a)
+	p.Via("a")
+	var (
+		g sync.WaitGroup
+		n atomic.Int64
+		e = make(chan string, 1)
+		d = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			for {
+				select {
+				case <-d:
+					return
+				default:
+				}
+				o, err := http.Get(p.URL)
+				if err != nil {
+					continue
+				}
+				v, _ := io.ReadAll(o.Body)
+				o.Body.Close()
+				// The Primary and Via are changed together, so they must always
+				// match.
+				if n.Add(1); !strings.HasSuffix(o.Header.Get("Via"), " "+string(v)) {
+					select {
+					case e <- string(v) + " with Via " + o.Header.Get("Via"):
+					default:
+					}
+				}
+			}
+		}()
+	}
+	var l buffer
+	for i := 0; n.Load() < 200; i++ {
+		time.Sleep(time.Millisecond)
+		p.Reconfigure(func(p *switchproxy.Proxy) {
+			if i%2 == 0 {
+				p.Primary(b)
+				p.Via("b")
+			} else {
+				p.Primary(a)
+				p.Via("a")
+			}
+		})
+		// Setters used outside of 'Reconfigure' must also be safe.
+		p.RequestBudget(time.Duration(i+1) * time.Second)
+		p.MaxSecondariesPerRequest(i % 3)
+		p.MethodOverride(i%2 == 0)
+		p.ClientWriteTimeout(time.Second)
+		p.Fallback(nil)
+		p.JSONAccessLog(&l)
+		p.AddObserver(func(switchproxy.Result) {})
+		p.StaticResponse("/static", http.StatusOK, "text/plain", []byte("static"))
+		p.OnError(func(*http.Request, error) {})
+	}
+	close(d)
+	g.Wait()
+	select {
+	case v := <-e:
+		t.Fatalf("response %s, want the Via of the same configuration", v)
+	default:
+	}
+}
+func TestReconfigureStream(t *testing.T) {
+	var (
+		c = make(chan struct{})
+		r = make(chan struct{})
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, q *http.Request) {
+		if q.URL.Path != "/slow" {
+			return
+		}
+		close(r)
+		<-c
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	x := make(chan struct{})
+	go func() {
+		if o, err := http.Get(p.URL + "/slow"); err == nil {
+			io.Copy(io.Discard, o.Body)
+			o.Body.Close()
+		}
+		close(x)
+	}()
+	defer func() {
+		close(c)
+		<-x
+	}()
+	<-r
+	// A slow request must not stop the Proxy from being changed.
+	e := make(chan struct{})
+	go func() {
+		p.Reconfigure(func(p *switchproxy.Proxy) { p.Via("new") })
+		close(e)
+	}()
+	select {
+	case <-e:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reconfigure waited for a request that was being handled")
+	}
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusOK || o.Header.Get("Via") != "1.1 new" {
+		t.Fatalf("response = %d, Via = %q, want the new configuration", o.StatusCode, o.Header.Get("Via"))
+	}
+}
+func TestHopHeaders(t *testing.T) {
+	r := make(chan http.Header, 2)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, q *http.Request) {
+		r <- q.Header.Clone()
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		io.WriteString(w, "legacy")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	c, err := net.Dial("tcp", strings.TrimPrefix(p.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b := bufio.NewReader(c)
+	for i, v := range []string{"keep-alive, X-Secret", "X-Secret"} {
+		io.WriteString(c, "GET / HTTP/1.0\r\nHost: test\r\nConnection: "+v+"\r\nX-Secret: 1\r\nProxy-Authorization: Basic e30=\r\n\r\n")
+		o, err := http.ReadResponse(b, nil)
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		d, _ := io.ReadAll(o.Body)
+		o.Body.Close()
+		if string(d) != "legacy" || o.ContentLength != 6 || len(o.TransferEncoding) > 0 {
+			t.Fatalf("request %d body = %q, Content-Length = %d, Transfer-Encoding = %v, want a fixed length", i, d, o.ContentLength, o.TransferEncoding)
+		}
+		if len(o.Header.Get("X-Internal")) > 0 || len(o.Header.Get("Proxy-Authenticate")) > 0 {
+			t.Fatalf("request %d response headers = %v, want no hop-by-hop headers", i, o.Header)
+		}
+		h := <-r
+		if len(h.Get("X-Secret")) > 0 || len(h.Get("Proxy-Authorization")) > 0 || len(h.Get("Connection")) > 0 {
+			t.Fatalf("request %d target headers = %v, want no hop-by-hop headers", i, h)
+		}
+		if i == 0 && o.Close {
+			t.Fatal("HTTP/1.0 keep-alive request closed the connection")
+		}
+	}
+	// The second request did not ask for keep-alive, so the server closes the
+	// connection after the response.
+	if _, err := b.ReadByte(); err != io.EOF {
+		t.Fatalf("read after HTTP/1.0 response returned %v, want io.EOF", err)
+	}
+}
+func TestOnConnState(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	e := make(chan http.ConnState, 8)
+	p := switchproxy.New(l.Addr().String())
+	p.Primary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	p.OnConnState(func(_ net.Conn, s http.ConnState) { e <- s })
+	d := make(chan struct{})
+	go func() {
+		p.Serve(l)
+		close(d)
+	}()
+	defer func() {
+		p.Close()
+		<-d
+	}()
+	c := &http.Client{Transport: &http.Transport{}}
+	o, err := c.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	io.Copy(io.Discard, o.Body)
+	if o.Body.Close(); o.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", o.StatusCode)
+	}
+	// Closing the idle client connection ends the sequence.
+	c.CloseIdleConnections()
+	for i, v := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateClosed} {
+		select {
+		case s := <-e:
+			if s != v {
+				t.Fatalf("state %d = %s, want %s", i, s, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state %d was not reported, want %s", i, v)
+		}
+	}
+}
+func TestSecondaryBody(t *testing.T) {
+	c := make(chan string, 4)
+	h := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		c <- string(b)
+	})
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, h))
+	// The first secondary only reads part of the body, which must not change
+	// what the next secondary receives.
+	p.AddSecondary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var b [16]byte
+		io.ReadFull(r.Body, b[:])
+		c <- "partial"
+	})), switchproxytest.NewSwitch(t, h), switchproxytest.NewSwitch(t, h))
+	v := strings.Repeat("0123456789abcdef", 4096)
+	if o, _ := post(t, p.URL+"/", v); o.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", o.StatusCode)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case b := <-c:
+			if b != v && b != "partial" {
+				t.Fatalf("Switch received %d bytes, want the full %d byte body", len(b), len(v))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d Switches received the request, want 4", i)
+		}
+	}
+}
+func TestHandler(t *testing.T) {
+	c := make(chan string, 1)
+	p := switchproxy.New("")
+	p.Primary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c <- r.URL.Path
+		io.WriteString(w, "proxied")
+	})))
+	m := http.NewServeMux()
+	m.Handle("/proxy/", http.StripPrefix("/proxy", p.Handler()))
+	m.HandleFunc("/local", func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "local")
+	})
+	v := httptest.NewServer(m)
+	defer v.Close()
+	if o, b := get(t, v.URL+"/proxy/api/list"); o.StatusCode != http.StatusOK || b != "proxied" {
+		t.Fatalf("mounted response = %d %q, want the Switch response", o.StatusCode, b)
+	}
+	if u := <-c; u != "/api/list" {
+		t.Fatalf("Switch path = %q, want the subpath removed", u)
+	}
+	if _, b := get(t, v.URL+"/local"); b != "local" {
+		t.Fatalf("local response = %q, want the user route", b)
+	}
+	if len(c) > 0 {
+		t.Fatal("user route was forwarded by the Proxy")
+	}
+}
+func TestRouteContentType(t *testing.T) {
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, named("default")))
+	p.RouteContentType("Application/JSON", switchproxytest.NewSwitch(t, named("json")))
+	p.RouteContentType("application/grpc", switchproxytest.NewSwitch(t, named("grpc")))
+	for _, v := range [...]struct {
+		ct, want string
+	}{
+		{"", "default"},
+		{"application/json", "json"},
+		{"APPLICATION/json; charset=utf-8", "json"},
+		{"application/grpc", "grpc"},
+		{"application/grpc+proto", "default"},
+		{"text/plain", "default"},
+	} {
+		q, _ := http.NewRequest(http.MethodPost, p.URL+"/", strings.NewReader("{}"))
+		if len(v.ct) > 0 {
+			q.Header.Set("Content-Type", v.ct)
+		}
+		if _, b := do(t, q); b != v.want {
+			t.Fatalf("Content-Type %q routed to %q, want %q", v.ct, b, v.want)
+		}
+	}
+	p.RouteContentType("application/json", nil)
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/", strings.NewReader("{}"))
+	q.Header.Set("Content-Type", "application/json")
+	if _, b := do(t, q); b != "default" {
+		t.Fatalf("removed route routed to %q, want the primary Switch", b)
+	}
+}
+func TestRoutePrecedence(t *testing.T) {
+	v := httptest.NewServer(named("route"))
+	defer v.Close()
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, named("default")))
+	if _, err := p.AddRoute(switchproxy.Route{Target: v.URL, Match: func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/route")
+	}}); err != nil {
+		t.Fatalf("AddRoute failed: %s", err)
+	}
+	p.RouteContentType("application/json", switchproxytest.NewSwitch(t, named("json")))
+	p.GeoRoute(region, map[string]*switchproxy.Switch{"eu": switchproxytest.NewSwitch(t, named("eu"))})
+	if err := p.TrustedProxies("127.0.0.1"); err != nil {
+		t.Fatalf("TrustedProxies failed: %s", err)
+	}
+	for _, c := range [...]struct {
+		path, ct, xff, want string
+	}{
+		{"/route", "application/json", "10.0.0.1", "route"},
+		{"/other", "application/json", "10.0.0.1", "json"},
+		{"/other", "text/plain", "10.0.0.1", "eu"},
+		{"/other", "text/plain", "192.0.2.1", "default"},
+	} {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+c.path, nil)
+		q.Header.Set("Content-Type", c.ct)
+		q.Header.Set("X-Forwarded-For", c.xff)
+		if _, b := do(t, q); b != c.want {
+			t.Fatalf("request %s (%s, %s) routed to %q, want %q", c.path, c.ct, c.xff, b, c.want)
+		}
+	}
+}
+func TestMaxSecondariesPerRequest(t *testing.T) {
+	c := make(chan int, 64)
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.NotFoundHandler()))
+	for i := 0; i < 5; i++ {
+		p.AddSecondary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			c <- i
+		})))
+	}
+	p.MaxSecondariesPerRequest(2)
+	s := make(map[int]struct{})
+	for i := 0; i < 20; i++ {
+		get(t, p.URL+"/")
+		for k := 0; k < 2; k++ {
+			select {
+			case v := <-c:
+				s[v] = struct{}{}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("request %d was sent to %d secondaries, want 2", i, k)
+			}
+		}
+		select {
+		case <-c:
+			t.Fatalf("request %d was sent to more than 2 secondaries", i)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if len(s) < 3 {
+		t.Fatalf("requests were sent to %d secondaries, want them spread over more than 2", len(s))
+	}
+}
+func TestClientWriteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	b := make([]byte, 32<<20)
+	p := switchproxy.New(l.Addr().String())
+	p.Primary(switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(b)
+	})))
+	p.ClientWriteTimeout(100 * time.Millisecond)
+	e := make(chan struct{}, 1)
+	p.OnConnState(func(_ net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			e <- struct{}{}
+		}
+	})
+	d := make(chan struct{})
+	go func() {
+		p.Serve(l)
+		close(d)
+	}()
+	defer func() {
+		p.Close()
+		<-d
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer c.Close()
+	c.(*net.TCPConn).SetReadBuffer(4096)
+	// The response is never read, so the writes to the client block until the
+	// deadline and the Proxy closes the connection.
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	select {
+	case <-e:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to a client that is not reading was not closed")
+	}
+}
+func TestConflictingFraming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = http.ReadRequest(bufio.NewReader(c)); err == nil {
+				// Both framings are sent, with a Content-Length that does not match.
+				io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+			}
+			c.Close()
+		}
+	}()
+	s, err := switchproxy.NewSwitch("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewSwitch failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	c, err := net.Dial("tcp", strings.TrimPrefix(p.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	// The raw response is read, as http.ReadResponse hides conflicting headers.
+	b, _ := io.ReadAll(c)
+	h, d, ok := strings.Cut(string(b), "\r\n\r\n")
+	if !ok || d != "hello world" {
+		t.Fatalf("response = %q, want the decoded body", b)
+	}
+	if v := strings.ToLower(h); strings.Contains(v, "transfer-encoding") || strings.Count(v, "content-length:") != 1 || !strings.Contains(v, "\r\ncontent-length: 11") {
+		t.Fatalf("response headers = %q, want only a Content-Length of 11", h)
+	}
+	if s, err = switchproxy.NewSwitch("http://" + l.Addr().String()); err != nil {
+		t.Fatalf("NewSwitch failed: %s", err)
+	}
+	s.StrictFraming(true)
+	if o, _ := get(t, switchproxytest.NewProxy(t, s).URL); o.StatusCode != http.StatusBadRequest {
+		t.Fatalf("strict status = %d, want 400", o.StatusCode)
+	}
+	// Responses with a single framing are still accepted.
+	v := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "2")
+		io.WriteString(w, "ok")
+	}))
+	v.StrictFraming(true)
+	if o, b := get(t, switchproxytest.NewProxy(t, v).URL); o.StatusCode != http.StatusOK || b != "ok" {
+		t.Fatalf("strict response = %d %q, want 200 \"ok\"", o.StatusCode, b)
+	}
+}
+func TestPause(t *testing.T) {
+	var (
+		in  = make(chan struct{}, 1)
+		out = make(chan struct{})
+		p   = switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				in <- struct{}{}
+				<-out
+			}
+			io.WriteString(w, "ok")
+		})))
+	)
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusOK {
+		t.Fatalf("status before Pause = %d, want 200", o.StatusCode)
+	}
+	// A request started before the pause is completed normally.
+	e := make(chan string, 1)
+	go func() {
+		o, err := http.Get(p.URL + "/slow")
+		if err != nil {
+			e <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(o.Body)
+		o.Body.Close()
+		e <- string(b)
+	}()
+	<-in
+	p.Pause()
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status while paused = %d, want 503", o.StatusCode)
+	}
+	p.PauseStatus(http.StatusTooManyRequests)
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status while paused = %d, want the PauseStatus 429", o.StatusCode)
+	}
+	close(out)
+	if v := <-e; v != "ok" {
+		t.Fatalf("in-flight request = %q, want it to complete", v)
+	}
+	p.Resume()
+	if o, b := get(t, p.URL); o.StatusCode != http.StatusOK || b != "ok" {
+		t.Fatalf("after Resume = %d %q, want 200 %q", o.StatusCode, b, "ok")
+	}
+}
+func TestReadBodyGrow(t *testing.T) {
+	p := switchproxy.New("127.0.0.1:0")
+	for _, c := range [...]struct {
+		n, l int64
+		max  int
+	}{
+		// A client claiming a large body that it does not send must not be able
+		// to make the buffer that large.
+		{1 << 30, 0, 2 << 20},
+		{1 << 30, 1024, 4096},
+		{-1, 0, 4096},
+	} {
+		q := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("short body"))
+		q.ContentLength = c.n
+		v, err := switchproxy.ReadBody(p, q, c.l)
+		if err != nil {
+			t.Fatalf("Content-Length %d, limit %d: read failed: %s", c.n, c.l, err)
+		}
+		if v > c.max {
+			t.Fatalf("Content-Length %d, limit %d: buffer capacity = %d, want at most %d", c.n, c.l, v, c.max)
+		}
+	}
+}
+func BenchmarkReadBody(b *testing.B) {
+	var (
+		p = switchproxy.New("127.0.0.1:0")
+		d = bytes.Repeat([]byte("x"), 768<<10)
+	)
+	for _, n := range [...]int64{int64(len(d)), -1} {
+		name := "KnownLength"
+		if n < 0 {
+			name = "UnknownLength"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(d)))
+			for i := 0; i < b.N; i++ {
+				// The reader is wrapped, as client bodies are read in pieces.
+				q := httptest.NewRequest(http.MethodPost, "/", struct{ io.Reader }{bytes.NewReader(d)})
+				q.ContentLength = n
+				if _, err := switchproxy.ReadBody(p, q, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+func TestMaxBodySizeForMethod(t *testing.T) {
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strconv.FormatInt(n, 10))
+	})), switchproxy.MaxBodySize(100))
+	p.MaxBodySizeForMethod("post", 10)
+	p.MaxBodySizeForMethod(http.MethodPut, 1000)
+	p.MaxBodySizeForMethod(http.MethodDelete, 0)
+	for _, c := range [...]struct {
+		method string
+		n      int
+		chunk  bool
+		status int
+	}{
+		{http.MethodPost, 10, false, http.StatusOK},
+		{http.MethodPost, 11, false, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, 11, true, http.StatusRequestEntityTooLarge},
+		{http.MethodPut, 500, false, http.StatusOK},
+		{http.MethodPut, 500, true, http.StatusOK},
+		{http.MethodPut, 1001, false, http.StatusRequestEntityTooLarge},
+		{http.MethodPatch, 100, false, http.StatusOK},
+		{http.MethodPatch, 101, false, http.StatusRequestEntityTooLarge},
+		{http.MethodDelete, 5000, false, http.StatusOK},
+	} {
+		var b io.Reader = strings.NewReader(strings.Repeat("x", c.n))
+		if c.chunk {
+			// Hiding the length makes the client send a chunked body.
+			b = struct{ io.Reader }{b}
+		}
+		q, err := http.NewRequest(c.method, p.URL, b)
+		if err != nil {
+			t.Fatalf("create request failed: %s", err)
+		}
+		if o, v := do(t, q); o.StatusCode != c.status || (c.status == http.StatusOK && v != strconv.Itoa(c.n)) {
+			t.Fatalf("%s of %d bytes (chunked %t) = %d %q, want %d", c.method, c.n, c.chunk, o.StatusCode, v, c.status)
+		}
+	}
+	// Removing the override restores the MaxBodySize limit.
+	p.MaxBodySizeForMethod(http.MethodPut, -1)
+	q, _ := http.NewRequest(http.MethodPut, p.URL, strings.NewReader(strings.Repeat("x", 500)))
+	if o, _ := do(t, q); o.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT after removing the override = %d, want 413", o.StatusCode)
+	}
+}
+func TestClientDeadline(t *testing.T) {
+	e := make(chan error, 1)
+	v := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			e <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			e <- nil
+		}
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 10*time.Second)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	p := switchproxy.New("127.0.0.1:0")
+	p.Primary(s)
+	x, f := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer f()
+	var (
+		w = httptest.NewRecorder()
+		n = time.Now()
+	)
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(x))
+	if d := time.Since(n); d > 2*time.Second {
+		t.Fatalf("request took %s, want it bounded by the 100ms client deadline", d)
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", w.Code)
+	}
+	if err := <-e; err == nil {
+		t.Fatal("the upstream request was not cancelled at the client deadline")
+	}
+}
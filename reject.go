@@ -0,0 +1,104 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import "net/http"
+
+const (
+	// RejectForbidden is used when a request is rejected by the 'OnRequest'
+	// function without a status, or with a 403 status.
+	RejectForbidden RejectReason = iota
+	// RejectUnauthorized is used when a request is rejected with a 401 status.
+	RejectUnauthorized
+	// RejectRateLimited is used when a request is rejected with a 429 status.
+	RejectRateLimited
+	// RejectMethodNotAllowed is used when a request is rejected with a 405
+	// status.
+	RejectMethodNotAllowed
+	// RejectTooLarge is used when a request body is larger than the
+	// MaxBodySize limit, or a request is rejected with a 413 status.
+	RejectTooLarge
+	// RejectURITooLong is used when a request URI is longer than the
+	// MaxURLLength limit, or a request is rejected with a 414 status.
+	RejectURITooLong
+)
+
+// RejectReason is a uint8 alias that represents why a request was rejected by
+// the Proxy before being forwarded.
+type RejectReason uint8
+
+// RejectHandler is a function alias that can be used to write the response of
+// a request that was rejected by the Proxy.
+type RejectHandler func(http.ResponseWriter, *http.Request, RejectReason)
+
+// RejectionHandler sets a function that will be used to write the responses of
+// all rejected requests, instead of the default plain text responses.
+//
+// Requests rejected with a status that does not match a RejectReason still use
+// the default response. A nil function restores the default responses.
+func (p *Proxy) RejectionHandler(f RejectHandler) {
+	p.lock.Lock()
+	p.onReject = f
+	p.lock.Unlock()
+}
+
+// Status returns the default HTTP status code used for this RejectReason.
+func (r RejectReason) Status() int {
+	switch r {
+	case RejectUnauthorized:
+		return http.StatusUnauthorized
+	case RejectRateLimited:
+		return http.StatusTooManyRequests
+	case RejectMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case RejectTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case RejectURITooLong:
+		return http.StatusRequestURITooLong
+	}
+	return http.StatusForbidden
+}
+
+// String returns the name of this RejectReason.
+func (r RejectReason) String() string {
+	switch r {
+	case RejectForbidden:
+		return "Forbidden"
+	case RejectUnauthorized:
+		return "Unauthorized"
+	case RejectRateLimited:
+		return "RateLimited"
+	case RejectMethodNotAllowed:
+		return "MethodNotAllowed"
+	case RejectTooLarge:
+		return "TooLarge"
+	case RejectURITooLong:
+		return "URITooLong"
+	}
+	return "Unknown"
+}
+func (o *config) reject(w http.ResponseWriter, r *http.Request, c int) {
+	if o.onReject != nil {
+		for v := RejectForbidden; v <= RejectURITooLong; v++ {
+			if v.Status() == c {
+				o.onReject(w, r, v)
+				return
+			}
+		}
+	}
+	http.Error(w, http.StatusText(c), c)
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestRejectionHandler(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	p := switchproxytest.NewProxy(t, s, switchproxy.MaxBodySize(4))
+	p.OnRequest(func(r *http.Request) error {
+		switch r.Header.Get("X-Key") {
+		case "":
+			return &switchproxy.StatusError{Err: errors.New("missing key"), Status: http.StatusUnauthorized}
+		case "teapot":
+			return &switchproxy.StatusError{Status: http.StatusTeapot}
+		}
+		return nil
+	})
+	p.RejectionHandler(func(w http.ResponseWriter, _ *http.Request, r switchproxy.RejectReason) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(r.Status())
+		io.WriteString(w, `{"reason":"`+r.String()+`"}`)
+	})
+	for i, c := range [...]struct {
+		key, body string
+		status    int
+		want      string
+	}{
+		{"", "", http.StatusUnauthorized, `{"reason":"Unauthorized"}`},
+		{"a", "too large", http.StatusRequestEntityTooLarge, `{"reason":"TooLarge"}`},
+		{"a", "", http.StatusOK, "ok"},
+	} {
+		q, _ := http.NewRequest(http.MethodPost, p.URL+"/", strings.NewReader(c.body))
+		if len(c.key) > 0 {
+			q.Header.Set("X-Key", c.key)
+		}
+		if o, b := do(t, q); o.StatusCode != c.status || b != c.want {
+			t.Fatalf("request %d = %d %q, want %d %q", i, o.StatusCode, b, c.status, c.want)
+		}
+	}
+	// A status without a RejectReason keeps the default response.
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Set("X-Key", "teapot")
+	if o, b := do(t, q); o.StatusCode != http.StatusTeapot || strings.Contains(b, "reason") {
+		t.Fatalf("request = %d %q, want the default 418 response", o.StatusCode, b)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// result is an alias of Result without the MarshalJSON function, which is used
+// to prevent recursion when marshaling.
+type result Result
+type verbose Result
+
+// MarshalJSON satisfies the json.Marshaler interface.
+//
+// The Content field is not included, to prevent logging large bodies by
+// mistake, and a "content_length" field with the length of the Content is
+// added instead. Use the 'Verbose' function to include the Content.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		result
+		Content []byte `json:"content,omitempty"`
+		Length  int    `json:"content_length"`
+	}{result: result(r), Length: len(r.Content)})
+}
+
+// Body returns an io.Reader of the Content of this Result, which can be used to
+// consume the Content incrementally. Reading from it does not change the Content
+// or affect the response sent to the client.
+func (r Result) Body() io.Reader {
+	return bytes.NewReader(r.Content)
+}
+
+// Verbose returns a json.Marshaler that will include the Content field when
+// this Result is marshaled, along with the "content_length" field.
+func (r Result) Verbose() json.Marshaler {
+	return verbose(r)
+}
+
+// MarshalJSON satisfies the json.Marshaler interface.
+func (v verbose) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		result
+		Length int `json:"content_length"`
+	}{result: result(v), Length: len(v.Content)})
+}
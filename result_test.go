@@ -0,0 +1,63 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+)
+
+func TestResultJSON(t *testing.T) {
+	r := switchproxy.Result{Path: "/a", Status: 200, Content: []byte("secret body")}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	var v map[string]any
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if _, ok := v["content"]; ok {
+		t.Fatalf("JSON = %s, want no content", b)
+	}
+	if v["content_length"] != float64(11) || v["path"] != "/a" {
+		t.Fatalf("JSON = %s, want the content length and other fields", b)
+	}
+	if b, err = json.Marshal(r.Verbose()); err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	var x struct {
+		Content []byte `json:"content"`
+		Length  int    `json:"content_length"`
+	}
+	if err = json.Unmarshal(b, &x); err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if string(x.Content) != "secret body" || x.Length != 11 {
+		t.Fatalf("verbose JSON = %s, want the content and length", b)
+	}
+}
+func TestResultBody(t *testing.T) {
+	r := switchproxy.Result{Content: []byte("data")}
+	b, _ := io.ReadAll(r.Body())
+	if string(b) != "data" || string(r.Content) != "data" {
+		t.Fatalf("Body = %q, Content = %q, want both unchanged", b, r.Content)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const ringPath = "/debug/requests"
+
+type ring struct {
+	e    []exchange
+	n    int
+	full bool
+	lock sync.Mutex
+}
+type exchange struct {
+	Time     time.Time      `json:"time"`
+	Request  json.Marshaler `json:"request"`
+	Response json.Marshaler `json:"response,omitempty"`
+}
+
+// DebugRing enables a buffer that keeps the last size requests and their primary
+// Switch responses, which are served as JSON (newest first) at the path
+// "/debug/requests". Requests to this path are not forwarded to any Switches.
+// Like the metrics endpoint, the path is served by 'Start', 'Serve' and
+// 'Handler', but not by 'ServeHTTP'.
+//
+// The entries contain the request and response Content, so this should only be
+// used on a Proxy that untrusted clients cannot reach. Headers are redacted
+// using the rules of the primary Switch that handled the request. The
+// "Authorization", "Cookie", "Set-Cookie" and "Proxy-Authorization" headers are
+// always redacted.
+//
+// Each call replaces the buffer. A size of zero or less disables the buffer and
+// the path returns a 404 status. An error is returned if the path is already
+// used by the Proxy (such as by 'Metrics').
+func (p *Proxy) DebugRing(size int) error {
+	var g *ring
+	if size > 0 {
+		g = &ring{e: make([]exchange, size)}
+	}
+	m := p.server.Handler.(*http.ServeMux)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.debug && g != nil {
+		if _, v := m.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: ringPath}}); v == ringPath {
+			return errors.New(`debug ring path "` + ringPath + `" is already in use`)
+		}
+		m.HandleFunc(ringPath, p.serveRing)
+		p.debug = true
+	}
+	p.ring = g
+	return nil
+}
+func (p *Proxy) serveRing(w http.ResponseWriter, r *http.Request) {
+	p.lock.RLock()
+	g := p.ring
+	p.lock.RUnlock()
+	if g == nil {
+		http.NotFound(w, r)
+		return
+	}
+	g.serve(w)
+}
+func (g *ring) add(r *http.Request, t *transfer, s *Switch, v Result, ok bool) {
+	q := Result{
+		IP:      r.RemoteAddr,
+		URL:     r.URL.String(),
+		UUID:    t.id,
+		Path:    r.URL.Path,
+		Method:  r.Method,
+		Content: append([]byte(nil), t.data...),
+		Headers: r.Header.Clone(),
+	}
+	e := exchange{Time: time.Now()}
+	if s != nil {
+		q.Headers = s.headers(q.Headers)
+	}
+	q.Headers = redacted(q.Headers)
+	if e.Request = q.Verbose(); ok {
+		// The Content buffer is reused by the next request, so a copy is kept.
+		v.Headers, v.Content = v.Headers.Clone(), append([]byte(nil), v.Content...)
+		if s != nil {
+			v.Headers = s.headers(v.Headers)
+		}
+		v.Headers = redacted(v.Headers)
+		e.Response = v.Verbose()
+	}
+	g.lock.Lock()
+	if g.e[g.n] = e; g.n+1 == len(g.e) {
+		g.full = true
+	}
+	g.n = (g.n + 1) % len(g.e)
+	g.lock.Unlock()
+}
+
+func redacted(h http.Header) http.Header {
+	for _, k := range redactDefaults {
+		for i := range h[k] {
+			h[k][i] = Redacted
+		}
+	}
+	return h
+}
+func (g *ring) serve(w http.ResponseWriter) {
+	g.lock.Lock()
+	o := make([]exchange, 0, len(g.e))
+	for i := g.n - 1; i >= 0; i-- {
+		o = append(o, g.e[i])
+	}
+	if g.full {
+		for i := len(g.e) - 1; i >= g.n; i-- {
+			o = append(o, g.e[i])
+		}
+	}
+	g.lock.Unlock()
+	b, err := json.Marshal(o)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestDebugRing(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, r.URL.Path)
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	if err := p.DebugRing(2); err != nil {
+		t.Fatalf("DebugRing failed: %s", err)
+	}
+	for _, u := range [...]string{"/a", "/b", "/c"} {
+		q, _ := http.NewRequest(http.MethodGet, p.URL+u, nil)
+		q.Header.Set("Authorization", "Bearer secret")
+		q.Header.Set("Cookie", "session=secret")
+		q.Header.Set("X-Trace", "1")
+		if _, b := do(t, q); b != u {
+			t.Fatalf("%s response = %q, want the Switch response", u, b)
+		}
+	}
+	// Reading the ring is not forwarded, so it does not add an entry.
+	get(t, p.URL+"/debug/requests")
+	o, b := get(t, p.URL+"/debug/requests")
+	if o.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("ring Content-Type = %q, want application/json", o.Header.Get("Content-Type"))
+	}
+	var e []struct {
+		Request struct {
+			Path    string      `json:"path"`
+			Headers http.Header `json:"headers"`
+		} `json:"request"`
+		Response struct {
+			Headers http.Header `json:"headers"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal([]byte(b), &e); err != nil {
+		t.Fatalf("decode ring failed: %s", err)
+	}
+	if len(e) != 2 || e[0].Request.Path != "/c" || e[1].Request.Path != "/b" {
+		t.Fatalf("ring = %s, want the last 2 requests, newest first", b)
+	}
+	for i := range e {
+		h := e[i].Request.Headers
+		if h.Get("Authorization") != switchproxy.Redacted || h.Get("Cookie") != switchproxy.Redacted || h.Get("X-Trace") != "1" {
+			t.Fatalf("entry %d request headers = %v, want the credentials redacted", i, h)
+		}
+		if v := e[i].Response.Headers.Get("Set-Cookie"); v != switchproxy.Redacted {
+			t.Fatalf("entry %d response Set-Cookie = %q, want it redacted", i, v)
+		}
+	}
+}
+func TestDebugRingPath(t *testing.T) {
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})))
+	// A size of zero does not use the path, so it is still forwarded.
+	if err := p.DebugRing(0); err != nil {
+		t.Fatalf("DebugRing(0) failed: %s", err)
+	}
+	if _, b := get(t, p.URL+"/debug/requests"); b != "/debug/requests" {
+		t.Fatalf("response = %q, want the Switch response", b)
+	}
+	if err := p.DebugRing(1); err != nil {
+		t.Fatalf("DebugRing failed: %s", err)
+	}
+	p.DebugRing(0)
+	if o, _ := get(t, p.URL+"/debug/requests"); o.StatusCode != http.StatusNotFound {
+		t.Fatalf("disabled ring status = %d, want 404", o.StatusCode)
+	}
+	if err := p.Metrics("/debug/requests"); err == nil {
+		t.Fatal("Metrics succeeded on the debug ring path")
+	}
+	x := switchproxy.New("")
+	defer x.Close()
+	if err := x.Metrics("/debug/requests"); err != nil {
+		t.Fatalf("Metrics failed: %s", err)
+	}
+	if err := x.DebugRing(1); err == nil {
+		t.Fatal("DebugRing succeeded on the metrics path")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+type limitBody struct {
+	io.ReadCloser
+	n int64
+}
+type cancelBody struct {
+	io.ReadCloser
+	f context.CancelFunc
+}
+
+// RoundTrip satisfies the http.RoundTripper interface. This allows a Switch to
+// be used as the Transport of an http.Client without a Proxy.
+//
+// The request is sent to the Switch target with any rewrites applied. The request
+// and response bodies are only read into memory when the Pre or Post Handlers
+// are set, as the Handlers require the content, otherwise they are streamed.
+//
+// The Switch timeout applies to the whole request, until the response body is
+// closed, unless 'ResponseHeaderTimeout' is used. Requests to targets denied by
+// 'RestrictTargets' fail with a *StatusError with a 403 status. Response bodies
+// larger than the 'MaxResponseBody' size fail with the ErrResponseTooLarge
+// error, which is returned when reading a streamed body once the limit is
+// passed.
+func (s *Switch) RoundTrip(r *http.Request) (*http.Response, error) {
+	var (
+		a         = s.target(s.URL, r)
+		x, f      = r.Context(), func() {}
+		pre, post = s.handlers()
+		d         []byte
+	)
+	if !s.allowed(a) {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, &StatusError{Err: ErrTargetDenied, Status: http.StatusForbidden}
+	}
+	if s.timeout > 0 && s.ttfb <= 0 {
+		// The http.Client timeout is not used by RoundTrip, so the Switch
+		// timeout is set on the context instead.
+		x, f = context.WithTimeout(x, s.timeout)
+	}
+	q := r.Clone(x)
+	q.URL, q.Host, q.RequestURI = &a, s.host(r.URL.Path), ""
+	if q.Header = s.outgoing(q); (pre != nil || post != nil) && r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if d, err = io.ReadAll(r.Body); err != nil {
+			f()
+			r.Body.Close()
+			return nil, err
+		}
+		r.Body.Close()
+		q.Body, q.ContentLength = io.NopCloser(bytes.NewReader(d)), int64(len(d))
+		q.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(d)), nil
+		}
+	}
+	u, l := newUUID(), s.reported(a, r)
+	if pre != nil {
+		pre(Result{
+			IP:      r.RemoteAddr,
+			URL:     l.String(),
+			UUID:    u,
+			Path:    l.Path,
+			Target:  a.Host,
+			Method:  r.Method,
+			Content: d,
+			Headers: s.headers(r.Header),
+			BytesIn: int64(len(d)),
+		})
+	}
+	o, err := s.tr.RoundTrip(q)
+	if err != nil {
+		f()
+		return nil, err
+	}
+	if m := s.headMax.Load(); m > 0 && int64(headerSize(o.Header)) > m {
+		f()
+		o.Body.Close()
+		return nil, ErrHeadersTooLarge
+	}
+	m := s.bodyMax.Load()
+	if m > 0 && o.ContentLength > m {
+		f()
+		o.Body.Close()
+		return nil, ErrResponseTooLarge
+	}
+	if post == nil {
+		if m > 0 {
+			o.Body = &limitBody{ReadCloser: o.Body, n: m}
+		}
+		o.Body = &cancelBody{ReadCloser: o.Body, f: f}
+		return o, nil
+	}
+	var b []byte
+	if m > 0 {
+		b, err = io.ReadAll(io.LimitReader(o.Body, m+1))
+	} else {
+		b, err = io.ReadAll(o.Body)
+	}
+	if o.Body.Close(); err != nil {
+		f()
+		return nil, err
+	}
+	if m > 0 && int64(len(b)) > m {
+		f()
+		return nil, ErrResponseTooLarge
+	}
+	f()
+	o.Body = io.NopCloser(bytes.NewReader(b))
+	c := b
+	if s.decode.Load() {
+		c = decoded(o.Header, b)
+	}
+	post(Result{
+		IP:       r.RemoteAddr,
+		URL:      l.String(),
+		Path:     l.Path,
+		UUID:     u,
+		Target:   a.Host,
+		Status:   uint16(o.StatusCode),
+		Method:   r.Method,
+		Content:  c,
+		Headers:  s.headers(o.Header),
+		BytesIn:  int64(len(d)),
+		BytesOut: int64(len(b)),
+	})
+	return o, nil
+}
+func (l *limitBody) Read(b []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// One byte more than the limit is read, so a body that is exactly the limit
+	// still ends with io.EOF.
+	if int64(len(b)) > l.n+1 {
+		b = b[:l.n+1]
+	}
+	n, err := l.ReadCloser.Read(b)
+	if l.n -= int64(n); l.n < 0 {
+		return n + int(l.n), ErrResponseTooLarge
+	}
+	return n, err
+}
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.f()
+	return err
+}
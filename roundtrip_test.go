@@ -0,0 +1,154 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path + " " + string(b)))
+	}))
+	s.Rewrite("/old", "/new")
+	var (
+		pre  = make(chan switchproxy.Result, 1)
+		resp = make(chan switchproxy.Result, 1)
+	)
+	s.Pre = func(r switchproxy.Result) { pre <- r }
+	s.Post = func(r switchproxy.Result) { resp <- r }
+	c := &http.Client{Transport: s}
+	o, err := c.Post("http://example.com/old/path", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, _ := io.ReadAll(o.Body)
+	if o.Body.Close(); string(b) != "/new/path data" {
+		t.Fatalf("response = %q, want the rewritten path and body", b)
+	}
+	if r := <-pre; string(r.Content) != "data" || r.BytesIn != 4 {
+		t.Fatalf("Pre Content = %q, BytesIn = %d, want the request body", r.Content, r.BytesIn)
+	}
+	if r := <-resp; string(r.Content) != "/new/path data" || r.Status != http.StatusOK || r.BytesOut != 14 {
+		t.Fatalf("Post Content = %q, Status = %d, BytesOut = %d, want the response", r.Content, r.Status, r.BytesOut)
+	}
+}
+func TestRoundTripPostBytesIn(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	c := make(chan switchproxy.Result, 1)
+	s.Post = func(r switchproxy.Result) { c <- r }
+	o, err := (&http.Client{Transport: s}).Post(v.URL, "text/plain", strings.NewReader("12345"))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	o.Body.Close()
+	if r := <-c; r.BytesIn != 5 || r.BytesOut != 5 {
+		t.Fatalf("Post BytesIn = %d, BytesOut = %d, want 5 and 5 without a Pre Handler", r.BytesIn, r.BytesOut)
+	}
+}
+func TestRoundTripTimeout(t *testing.T) {
+	d := make(chan struct{})
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-d:
+		case <-r.Context().Done():
+		}
+	}))
+	defer v.Close()
+	defer close(d)
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	o, err := (&http.Client{Transport: s}).Get(v.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer o.Body.Close()
+	// The headers are returned in time, but the body never finishes.
+	e := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(o.Body)
+		e <- err
+	}()
+	select {
+	case err := <-e:
+		if err == nil {
+			t.Fatal("reading the body succeeded, want a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Switch timeout was not applied")
+	}
+}
+func TestRoundTripLimits(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Flushing before writing the body removes the Content-Length.
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, "0123456789")
+	}))
+	c := &http.Client{Transport: s}
+	s.MaxResponseBody(10)
+	o, err := c.Get("http://example.com/chunked")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, err := io.ReadAll(o.Body)
+	if o.Body.Close(); err != nil || string(b) != "0123456789" {
+		t.Fatalf("body = %q, err = %v, want the whole body at the limit", b, err)
+	}
+	s.MaxResponseBody(4)
+	if _, err = c.Get("http://example.com/"); !errors.Is(err, switchproxy.ErrResponseTooLarge) {
+		t.Fatalf("err = %v, want ErrResponseTooLarge for a known length", err)
+	}
+	if o, err = c.Get("http://example.com/chunked"); err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, err = io.ReadAll(o.Body)
+	if o.Body.Close(); !errors.Is(err, switchproxy.ErrResponseTooLarge) || string(b) != "0123" {
+		t.Fatalf("body = %q, err = %v, want the limit and ErrResponseTooLarge", b, err)
+	}
+	s.Post = func(switchproxy.Result) {}
+	if _, err = c.Get("http://example.com/chunked"); !errors.Is(err, switchproxy.ErrResponseTooLarge) {
+		t.Fatalf("err = %v, want ErrResponseTooLarge with a Post Handler", err)
+	}
+	s.RestrictTargets("example.com")
+	e := (*switchproxy.StatusError)(nil)
+	if _, err = c.Get("http://example.com/"); !errors.As(err, &e) || e.Status != http.StatusForbidden || !errors.Is(err, switchproxy.ErrTargetDenied) {
+		t.Fatalf("err = %v, want a 403 StatusError with ErrTargetDenied", err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"errors"
+	"time"
+)
+
+type route struct {
+	m Matcher
+	s *Switch
+}
+
+// Route is a struct that contains the configuration of a Switch that is used as
+// the primary Switch for the requests matched by the Match function. This can
+// be passed to 'AddRoute' to create and add the Switch in one step.
+//
+// A Timeout of zero uses the timeout set by 'DefaultSwitchTimeout' and a Timeout
+// less than zero disables the timeout. Rewrites map path prefixes to their
+// replacements (see 'Switch.Rewrite'). Redact, Allow and Deny are the header
+// names passed to the 'RedactHeaders', 'ResponseHeaderAllowlist' and
+// 'ResponseHeaderDenylist' functions, if not empty.
+type Route struct {
+	Match     Matcher
+	Rewrites  map[string]string
+	UserAgent string
+	Target    string
+	Redact    []string
+	Allow     []string
+	Deny      []string
+	Timeout   time.Duration
+}
+
+// AddRoute creates a Switch from the Route and adds it as the primary Switch for
+// any requests that the Route Match function matches. The created Switch is
+// returned so it can be configured further.
+//
+// Routes are checked in the order they were added, before the routes added by
+// 'RouteContentType' and 'GeoRoute' (see 'Primary'). Requests that do not match
+// any route use the primary Switch set by 'Primary'.
+func (p *Proxy) AddRoute(r Route) (*Switch, error) {
+	if r.Match == nil {
+		return nil, errors.New("route requires a Match function")
+	}
+	t := r.Timeout
+	if t == 0 {
+		if t = time.Duration(switchTimeout.Load()); t == 0 {
+			t = DefaultTimeout
+		}
+	}
+	if t < 0 {
+		t = 0
+	}
+	s, err := NewSwitchContext(p.ctx, r.Target, t)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Rewrites) > 0 {
+		s.SetRewrites(r.Rewrites)
+	}
+	if len(r.UserAgent) > 0 {
+		s.UserAgent(r.UserAgent)
+	}
+	if len(r.Redact) > 0 {
+		s.RedactHeaders(r.Redact...)
+	}
+	if len(r.Allow) > 0 {
+		s.ResponseHeaderAllowlist(r.Allow...)
+	}
+	if len(r.Deny) > 0 {
+		s.ResponseHeaderDenylist(r.Deny...)
+	}
+	p.lock.Lock()
+	n := make([]route, len(p.routes), len(p.routes)+1)
+	copy(n, p.routes)
+	p.routes = append(n, route{m: r.Match, s: s})
+	p.lock.Unlock()
+	return s, nil
+}
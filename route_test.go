@@ -0,0 +1,80 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestAddRoute(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(300 * time.Millisecond):
+			}
+		}
+		w.Header().Set("X-Internal", "1")
+		io.WriteString(w, r.URL.Path+" "+r.UserAgent())
+	}))
+	defer v.Close()
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, named("default")))
+	if _, err := p.AddRoute(switchproxy.Route{Target: v.URL}); err == nil {
+		t.Fatal("AddRoute succeeded without a Match function")
+	}
+	if _, err := p.AddRoute(switchproxy.Route{
+		Match:     switchproxy.MatchPrefix("/a/"),
+		Target:    v.URL,
+		Timeout:   50 * time.Millisecond,
+		Rewrites:  map[string]string{"/a/": "/one/"},
+		UserAgent: "route-a",
+		Deny:      []string{"X-Internal"},
+	}); err != nil {
+		t.Fatalf("AddRoute failed: %s", err)
+	}
+	if _, err := p.AddRoute(switchproxy.Route{
+		Match:    switchproxy.MatchPrefix("/b/"),
+		Target:   v.URL,
+		Timeout:  5 * time.Second,
+		Rewrites: map[string]string{"/b/": "/two/"},
+	}); err != nil {
+		t.Fatalf("AddRoute failed: %s", err)
+	}
+	for _, c := range [...]struct {
+		path, want, internal string
+		status               int
+	}{
+		{"/a/users", "/one/users route-a", "", http.StatusOK},
+		{"/a/slow", "", "", http.StatusGatewayTimeout},
+		{"/b/users", "/two/users Go-http-client/1.1", "1", http.StatusOK},
+		{"/b/slow", "/two/slow Go-http-client/1.1", "1", http.StatusOK},
+		{"/other", "default", "", http.StatusOK},
+	} {
+		o, b := get(t, p.URL+c.path)
+		if o.StatusCode != c.status || (c.status == http.StatusOK && b != c.want) || o.Header.Get("X-Internal") != c.internal {
+			t.Fatalf("%s = %d %q (X-Internal %q), want %d %q (%q)", c.path, o.StatusCode, b, o.Header.Get("X-Internal"), c.status, c.want, c.internal)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// AddResponseSink adds a Switch that will receive the response returned by the
+// primary Switch, instead of the original request.
+//
+// After each successful primary response, the Result (including the Content)
+// is marshaled as JSON and sent as a POST request to the sink Switch's target
+// URL. The sink's redacted headers are applied to the Result headers and the
+// Pre and Post handlers of the sink are not called. Errors are passed to the
+// OnError handler.
+func (p *Proxy) AddResponseSink(s ...*Switch) {
+	p.lock.Lock()
+	n := make([]*Switch, len(p.sinks), len(p.sinks)+len(s))
+	copy(n, p.sinks)
+	p.sinks = append(n, s...)
+	p.lock.Unlock()
+}
+func (p *Proxy) sink(o *config, r *http.Request, v Result) {
+	for i := range o.sinks {
+		if err := o.sinks[i].sink(p.ctx, v); err != nil {
+			o.error(r, err)
+		}
+	}
+}
+func (s *Switch) sink(x context.Context, v Result) error {
+	v.Headers = s.headers(v.Headers)
+	b, err := json.Marshal(v.Verbose())
+	if err != nil {
+		return err
+	}
+	if s.timeout > 0 {
+		var f context.CancelFunc
+		x, f = context.WithTimeout(x, s.timeout)
+		defer f()
+	}
+	q, err := http.NewRequestWithContext(x, http.MethodPost, s.URL.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	q.Header.Set("Content-Type", "application/json")
+	o, err := s.client.Do(q)
+	if err != nil {
+		return classify(err)
+	}
+	io.Copy(io.Discard, o.Body)
+	o.Body.Close()
+	if s.failed(o.StatusCode, nil) {
+		return errors.New(`response sink returned status "` + o.Status + `"`)
+	}
+	return nil
+}
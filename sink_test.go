@@ -0,0 +1,68 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestAddResponseSink(t *testing.T) {
+	var n atomic.Int64
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n.Add(1)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	c := make(chan *http.Request, 1)
+	d := make(chan switchproxy.Result, 1)
+	k := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var v switchproxy.Result
+		json.NewDecoder(r.Body).Decode(&v)
+		c <- r
+		d <- v
+	}))
+	k.RedactHeaders()
+	p := switchproxytest.NewProxy(t, s)
+	p.AddResponseSink(k)
+	get(t, p.URL+"/item")
+	select {
+	case r := <-c:
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("sink request = %s %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink did not receive the response")
+	}
+	v := <-d
+	if v.Status != http.StatusCreated || string(v.Content) != "created" || v.Path != "/item" {
+		t.Fatalf("sink Result = %d %q %q, want the primary response", v.Status, v.Content, v.Path)
+	}
+	if h := v.Headers.Get("Set-Cookie"); h != switchproxy.Redacted {
+		t.Fatalf("sink Result Set-Cookie = %q, want it redacted", h)
+	}
+	if x := n.Load(); x != 1 {
+		t.Fatalf("primary received %d requests, want the sink to not fetch it again", x)
+	}
+}
@@ -17,14 +17,21 @@
 package switchproxy
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	// Import unsafe to use "fastrand" function
@@ -33,36 +40,187 @@ import (
 
 const table = "0123456789ABCDEF"
 
+var hopHeaders = [...]string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Redacted is the value that replaces the values of any redacted headers in
+// a Result.
+const Redacted = "[REDACTED]"
+
+// NoUserAgent is a value that can be passed to the 'UserAgent' function of a
+// Switch to remove the User-Agent header from any forwarded requests.
+const NoUserAgent = "-"
+
+// ErrHeadersTooLarge is an error returned when the response headers of a Switch
+// target exceed the size set by 'MaxResponseHeaderBytes'.
+var ErrHeadersTooLarge = errors.New("response headers too large")
+
+// ErrResponseTooLarge is an error returned when the response body of a Switch
+// target exceeds the size set by 'MaxResponseBody'.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// ErrDigestMismatch is an error returned when the request body does not match
+// the "Content-MD5" or "Digest" request headers, if enabled by 'VerifyDigest'.
+var ErrDigestMismatch = errors.New("request body does not match digest")
+
+// ErrTargetDenied is an error returned when a Switch target host or address is
+// not allowed by 'RestrictTargets' or 'BlockPrivateTargets'.
+var ErrTargetDenied = errors.New("target host is not allowed")
+
+// shared is the RFC 6598 shared address space used by carrier-grade NAT, which
+// is not covered by net.IP.IsPrivate.
+var shared = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+const (
+	// SlashKeep does not change trailing slashes in request paths (the default).
+	SlashKeep SlashMode = iota
+	// SlashStrip removes any trailing slashes from request paths.
+	SlashStrip
+	// SlashAdd adds a trailing slash to request paths that do not have one.
+	SlashAdd
+)
+
+const (
+	// JoinClean joins rewritten paths with 'path.Join', which also cleans the
+	// result, removing repeated slashes and "." or ".." elements (the default).
+	JoinClean JoinMode = iota
+	// JoinConcat joins rewritten paths by appending the rest of the request path
+	// to the replacement without any changes.
+	JoinConcat
+)
+
+var (
+	uuidGen       atomic.Value
+	switchTimeout atomic.Int64
+)
+
+var redactDefaults = [...]string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
 // Result is a struct that contains the data of the resulting Switch
 // operation to be passed to Handlers.
+//
+// The Target field contains the host of the server that the request was sent
+// to and the Failover field is true when this is not the original target. The
+// BytesIn and BytesOut fields contain the number of request body bytes sent to
+// and the number of response body bytes received from the target. The Attempts
+// field contains the number of targets of the Switch that were tried.
 type Result struct {
-	Headers http.Header `json:"headers"`
-	IP      string      `json:"ip"`
-	UUID    string      `json:"uuid"`
-	Path    string      `json:"path"`
-	Method  string      `json:"method"`
-	URL     string      `json:"url"`
-	Content []byte      `json:"content"`
-	Status  uint16      `json:"status"`
+	Headers  http.Header `json:"headers"`
+	IP       string      `json:"ip"`
+	UUID     string      `json:"uuid"`
+	Path     string      `json:"path"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Target   string      `json:"target"`
+	Content  []byte      `json:"content"`
+	BytesIn  int64       `json:"bytes_in"`
+	BytesOut int64       `json:"bytes_out"`
+	Attempts int         `json:"attempts"`
+	Status   uint16      `json:"status"`
+	Failover bool        `json:"failover"`
 }
 
 // Switch is a struct that represents a connection between proxy services.
 // This struct contains mapping and functions to capture input and output.
+//
+// The Switch functions are safe to use while the Switch is processing requests,
+// except for the functions that change the Transport (such as 'LocalAddr' and
+// 'MaxConnsPerHost'), which must be called before the Switch is used. The Pre
+// and Post Handlers should only be set directly before the Switch is used.
 type Switch struct {
 	Pre     Handler
 	Post    Handler
+	ctx     context.Context
 	client  *http.Client
-	rewrite map[string]string
+	tr      *http.Transport
+	h2      *http.Transport
+	agent   string
+	ping    [2]string
+	failure FailureFunc
+	onWS    func(int, byte, []byte)
+	tap     func(io.Reader)
+	log     *logger
+	modify  func(int, http.Header)
+	extra   []url.URL
+	rewrite atomic.Pointer[map[string]string]
+	vhost   map[string]string
+	redact  map[string]struct{}
+	allow   map[string]struct{}
+	deny    map[string]struct{}
+	hosts   map[string]struct{}
+	local   *net.TCPAddr
 	url.URL
 	timeout time.Duration
+	ttfb    time.Duration
+	headMax atomic.Int64
+	bodyMax atomic.Int64
+	slash   SlashMode
+	join    JoinMode
+	clean   bool
+	meta    atomic.Bool
+	block   bool
+	strict  bool
+	reset   atomic.Bool
+	orig    atomic.Bool
+	web     atomic.Bool
+	decode  atomic.Bool
+	hints   atomic.Bool
+	timing  atomic.Bool
+	verify  atomic.Bool
+	digest  string
+	lock    sync.RWMutex
+	stop    context.CancelFunc
+	down    atomic.Bool
+	closed  atomic.Int64
+	stats   counters
 }
 
+// SlashMode is a uint8 alias that represents how a Switch handles trailing
+// slashes in request paths.
+type SlashMode uint8
+
+// JoinMode is a uint8 alias that represents how a Switch joins the replacement
+// of a rewrite with the rest of the request path.
+type JoinMode uint8
+
 // Handler is a function alias that can be passed a Result for processing.
 type Handler func(Result)
 
+// FailureFunc is a function alias that can be passed the status code and error
+// of a Switch request and returns true if the request should be considered a
+// failure. The status code will be zero if the error is not nil.
+type FailureFunc func(int, error) bool
+type counters struct {
+	retries   atomic.Uint64
+	requests  atomic.Uint64
+	failures  atomic.Uint64
+	fallbacks atomic.Uint64
+	unhealthy atomic.Uint64
+}
+type counter struct {
+	io.Reader
+	w *io.PipeWriter
+	n atomic.Int64
+}
+
 //go:linkname fastRand runtime.fastrand
 func fastRand() uint32
+
+// UUIDGenerator sets the function that will be used to generate the UUID values
+// of the Results passed to Handlers. Passing nil restores the default random
+// generator.
+//
+// This is intended for tests that need predictable Result UUID values, such as
+// a counter, and should not be used in production.
+func UUIDGenerator(f func() string) {
+	uuidGen.Store(f)
+}
 func newUUID() string {
+	if f, ok := uuidGen.Load().(func() string); ok && f != nil {
+		return f()
+	}
 	var b [64]byte
 	for i := 0; i < 64; i += 2 {
 		v := byte(fastRand() & 0xFF)
@@ -84,18 +242,661 @@ func (r Result) IsResponse() bool {
 // If a URL starts with the 'from' parameter, it will be replaced with the 'to'
 // parameter, only if starting with on the URL path.
 func (s *Switch) Rewrite(from, to string) {
-	s.rewrite[from] = to
+	s.lock.Lock()
+	m := s.rewrites(1)
+	m[from] = to
+	s.rewrite.Store(&m)
+	s.lock.Unlock()
+}
+
+// RewriteHost adds a Host header rewrite to the Switch.
+//
+// If the request URL path starts with the 'from' parameter, the Host header of
+// the forwarded request will be set to the 'to' parameter. This is matched on
+// the path before any URL rewrites are applied. The connection is still made to
+// the Switch target, only the Host header is changed. If multiple rules match,
+// the longest 'from' parameter is used.
+func (s *Switch) RewriteHost(from, to string) {
+	s.lock.Lock()
+	if s.vhost == nil {
+		s.vhost = make(map[string]string)
+	}
+	s.vhost[from] = to
+	s.lock.Unlock()
+}
+
+// SetRewrites replaces all the URL rewrites of the Switch with the rewrites in
+// the specified map, which uses the same format as 'Rewrite'.
+//
+// The change is atomic, so requests being processed will either use all of the
+// old rewrites or all of the new ones. The map is copied, so changes made to it
+// afterwards have no effect. A nil or empty map removes all rewrites.
+func (s *Switch) SetRewrites(m map[string]string) {
+	n := make(map[string]string, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	s.lock.Lock()
+	s.rewrite.Store(&n)
+	s.lock.Unlock()
+}
+
+// Reset removes all the URL rewrites, header rules and Handlers from the Switch.
+// The Switch target, client and timeout are not changed.
+//
+// This function is safe to use while the Switch is processing requests.
+func (s *Switch) Reset() {
+	s.lock.Lock()
+	s.Pre, s.Post, s.agent = nil, nil, ""
+	s.allow, s.deny = nil, nil
+	s.redact = make(map[string]struct{})
+	s.rewrite.Store(nil)
+	s.vhost, s.digest, s.modify = nil, "", nil
+	s.lock.Unlock()
+}
+func (s *Switch) host(p string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var h, m string
+	for k, v := range s.vhost {
+		if len(k) > len(m) && strings.HasPrefix(p, k) {
+			h, m = v, k
+		}
+	}
+	return h
+}
+func (s *Switch) rewrites(n int) map[string]string {
+	// The current map may be in use by requests, so changes are made to a copy.
+	o := s.rewrite.Load()
+	if o == nil {
+		return make(map[string]string, n)
+	}
+	m := make(map[string]string, len(*o)+n)
+	for k, v := range *o {
+		m[k] = v
+	}
+	return m
+}
+func (s *Switch) handlers() (Handler, Handler) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Pre, s.Post
+}
+
+// AddTarget adds an additional target server to the Switch.
+//
+// When a request to the Switch target fails (according to the 'IsFailure'
+// function), idempotent requests are tried again on each additional target, in
+// the order they were added, until one succeeds or all of them have failed.
+// Requests with streamed bodies are never tried again.
+func (s *Switch) AddTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return errors.New("unable to resolve URL: " + err.Error())
+	}
+	if !u.IsAbs() {
+		u.Scheme = "http"
+	}
+	s.lock.Lock()
+	s.extra = append(s.extra, *u)
+	s.lock.Unlock()
+	return nil
 }
 
 // RemoveRewrite removes the URL rewrite from the Switch.
 func (s *Switch) RemoveRewrite(from string) {
-	delete(s.rewrite, from)
+	s.lock.Lock()
+	m := s.rewrites(0)
+	delete(m, from)
+	s.rewrite.Store(&m)
+	s.lock.Unlock()
+}
+
+// RedactHeaders adds the specified header names to the list of headers that will
+// be redacted from any Result passed to the Switch Handlers.
+//
+// The values of redacted headers are replaced with the Redacted value only in
+// the copy of the headers given to the Handlers, the forwarded request and
+// response are not affected. If no names are specified, the default set of
+// "Authorization", "Cookie", "Set-Cookie" and "Proxy-Authorization" is used.
+func (s *Switch) RedactHeaders(names ...string) {
+	if len(names) == 0 {
+		names = redactDefaults[:]
+	}
+	s.lock.Lock()
+	for i := range names {
+		s.redact[http.CanonicalHeaderKey(names[i])] = struct{}{}
+	}
+	s.lock.Unlock()
+}
+
+// ResponseHeaderFunc sets a function that will be called with the status code
+// and headers of each response from the Switch target, which can change the
+// headers before they are returned. This is called before any allowlist or
+// denylist is applied and the changes are visible in the Result headers.
+//
+// A nil function disables this.
+func (s *Switch) ResponseHeaderFunc(f func(status int, h http.Header)) {
+	s.lock.Lock()
+	s.modify = f
+	s.lock.Unlock()
+}
+
+// ResponseHeaderAllowlist adds the specified header names to the list of
+// response headers that are allowed to be sent to the client.
+//
+// Once any names are added, only the allowed headers will be returned to the
+// client. This does not affect the headers in any Result passed to Handlers.
+func (s *Switch) ResponseHeaderAllowlist(names ...string) {
+	s.lock.Lock()
+	if s.allow == nil {
+		s.allow = make(map[string]struct{}, len(names))
+	}
+	for i := range names {
+		s.allow[http.CanonicalHeaderKey(names[i])] = struct{}{}
+	}
+	s.lock.Unlock()
+}
+
+// ResponseHeaderDenylist adds the specified header names to the list of response
+// headers that will be removed before the response is sent to the client.
+//
+// This does not affect the headers in any Result passed to Handlers.
+func (s *Switch) ResponseHeaderDenylist(names ...string) {
+	s.lock.Lock()
+	if s.deny == nil {
+		s.deny = make(map[string]struct{}, len(names))
+	}
+	for i := range names {
+		s.deny[http.CanonicalHeaderKey(names[i])] = struct{}{}
+	}
+	s.lock.Unlock()
+}
+
+// UserAgent sets the User-Agent header value that will replace the client
+// User-Agent on any forwarded requests.
+//
+// An empty string will forward the client User-Agent as-is (the default) and
+// the NoUserAgent value will remove the header entirely.
+func (s *Switch) UserAgent(ua string) {
+	s.lock.Lock()
+	s.agent = ua
+	s.lock.Unlock()
+}
+
+// ResponseHeaderTimeout sets the time to wait for the Switch target to return
+// the response headers, after the request is sent.
+//
+// When set to a value above zero, the Switch timeout is no longer applied to
+// the whole request, so large request and response bodies can take as long as
+// needed to transfer. The Switch timeout is still used for connecting. A value
+// of zero or less restores the Switch timeout for the whole request.
+//
+// This changes the Switch Transport and client, so it must be called before
+// the Switch is used.
+func (s *Switch) ResponseHeaderTimeout(d time.Duration) {
+	if d <= 0 {
+		s.ttfb, s.tr.ResponseHeaderTimeout, s.client.Timeout = 0, s.timeout, s.timeout
+		return
+	}
+	s.ttfb, s.tr.ResponseHeaderTimeout, s.client.Timeout = d, d, 0
+}
+
+// StreamTap sets a function that will be passed a reader of the request body
+// as it is streamed to the Switch target. This is only used for streamed bodies
+// (unknown length bodies, when the Proxy has no secondary Switches), as these
+// are not captured in the Result Content.
+//
+// The function is called in a new goroutine for each request and the reader
+// will return io.EOF once the body has been sent. Bytes are only sent to the
+// target as fast as the reader is read, so it should be read promptly. The
+// function may return before reading the whole body without affecting the
+// request. A nil function disables this.
+func (s *Switch) StreamTap(f func(io.Reader)) {
+	s.lock.Lock()
+	s.tap = f
+	s.lock.Unlock()
+}
+
+// MaxConnsPerHost sets the maximum number of connections that the Switch will
+// open to each target host. Requests that are made when the limit is reached
+// wait for a connection to become available.
+//
+// The wait counts towards the Switch timeout (and any request budget set on the
+// Proxy), so requests will not wait forever, unless the timeout is disabled or
+// 'ResponseHeaderTimeout' is used without a request budget. A value of zero or
+// less removes the limit (the default).
+//
+// This must be called before the Switch is used, as the Transport limits can
+// not be changed while requests are being made.
+func (s *Switch) MaxConnsPerHost(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.tr.MaxConnsPerHost, s.h2.MaxConnsPerHost = n, n
+}
+
+// VerifyDigest sets if the Switch will check the request body against the
+// "Content-MD5" and "Digest" (MD5 and SHA-256 only) request headers, if they are
+// present, before sending the request. Requests that do not match fail with a
+// 400 status and the ErrDigestMismatch error. Streamed bodies are not checked.
+func (s *Switch) VerifyDigest(v bool) {
+	s.verify.Store(v)
+}
+
+// AddResponseDigest sets the Switch to add a "Digest" header to responses,
+// which contains the digest of the response body using the specified algorithm.
+// The supported algorithms are "sha-256" (used if empty) and "md5". This is
+// removed by 'Reset'.
+//
+// This replaces any "Digest" header sent by the Switch target. gRPC responses
+// are streamed and do not have this header added.
+func (s *Switch) AddResponseDigest(algo string) error {
+	a := strings.ToLower(algo)
+	switch a {
+	case "":
+		a = "sha-256"
+	case "sha-256", "md5":
+	default:
+		return errors.New(`digest algorithm "` + algo + `" is not supported`)
+	}
+	s.lock.Lock()
+	s.digest = a
+	s.lock.Unlock()
+	return nil
+}
+
+// RestrictTargets sets the list of hosts that the Switch can send requests to.
+// Requests to any other host (such as ones added with 'AddTarget') will fail
+// with a 403 status and the ErrTargetDenied error. Hosts are matched without
+// the port. Calling this function with no hosts removes the restriction.
+func (s *Switch) RestrictTargets(allowed ...string) {
+	s.lock.Lock()
+	if len(allowed) == 0 {
+		s.hosts = nil
+	} else {
+		s.hosts = make(map[string]struct{}, len(allowed))
+		for i := range allowed {
+			s.hosts[strings.ToLower(allowed[i])] = struct{}{}
+		}
+	}
+	s.lock.Unlock()
+}
+
+// BlockPrivateTargets sets if the Switch will refuse to connect to private,
+// shared (carrier-grade NAT), loopback, link-local or unspecified addresses,
+// including IPv4 addresses mapped into IPv6. Connections that are refused will
+// fail with a 403 status and the ErrTargetDenied error.
+//
+// The check is done on the resolved address when dialing, so hostnames that
+// resolve to a blocked address are also refused. If an upstream proxy is used,
+// the address of the proxy is checked instead.
+//
+// This replaces the dialer of the Switch Transport, so it must be called before
+// the Switch is used. Connections that are already open are not checked.
+func (s *Switch) BlockPrivateTargets(b bool) {
+	s.block = b
+	s.dialer()
+}
+
+// LocalAddr sets the local address that connections to the Switch targets will
+// be made from. The address can be an IP address or an "ip:port" pair, which
+// is checked when this is called. An empty address restores the default, which
+// lets the system choose the address.
+//
+// Like 'BlockPrivateTargets', this replaces the dialer of the Switch Transport,
+// so it must be called before the Switch is used.
+func (s *Switch) LocalAddr(addr string) error {
+	if len(addr) == 0 {
+		s.local = nil
+		s.dialer()
+		return nil
+	}
+	var a *net.TCPAddr
+	if i := net.ParseIP(addr); i != nil {
+		a = &net.TCPAddr{IP: i}
+	} else {
+		h, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.New("invalid local address: " + err.Error())
+		}
+		if net.ParseIP(h) == nil {
+			return errors.New("invalid local address: " + addr + " is not an IP address")
+		}
+		if a, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+			return errors.New("invalid local address: " + err.Error())
+		}
+	}
+	s.local = a
+	s.dialer()
+	return nil
+}
+func (s *Switch) dialer() {
+	d := &net.Dialer{Timeout: s.timeout, KeepAlive: s.timeout}
+	if s.block {
+		d.Control = deny
+	}
+	if s.local != nil {
+		d.LocalAddr = s.local
+	}
+	s.tr.DialContext, s.h2.DialContext, s.tr.DialTLSContext = d.DialContext, d.DialContext, nil
+	if s.strict {
+		// Only the HTTP/1.1 Transport is wrapped, as HTTP/2 frames the body without
+		// these headers.
+		s.tr.DialContext, s.tr.DialTLSContext = frame(d.DialContext), s.frameTLS(d.DialContext)
+	}
+}
+
+// MaxResponseHeaderBytes sets the maximum size of the response headers that
+// will be accepted from the Switch target. Responses with larger headers will
+// be rejected with a 502 status and the ErrHeadersTooLarge error.
+//
+// A value of zero or less disables the limit (the default).
+func (s *Switch) MaxResponseHeaderBytes(n int) {
+	s.headMax.Store(int64(n))
+}
+
+// MaxResponseBody sets the maximum size of the response body that will be
+// accepted from the Switch target, in bytes. Responses with larger bodies are
+// not sent to the client and are rejected with a 502 status and the
+// ErrResponseTooLarge error.
+//
+// A value of zero or less disables the limit (the default).
+func (s *Switch) MaxResponseBody(n int64) {
+	s.bodyMax.Store(n)
+}
+
+// IsFailure sets the function used to determine if a request made by this
+// Switch has failed. This is used by any features that react to failures, such
+// as failover, and allows for a consistent definition of failure across them.
+//
+// Passing nil restores the default, which considers any error or a status code
+// of 500 or higher as a failure.
+func (s *Switch) IsFailure(f FailureFunc) {
+	s.lock.Lock()
+	s.failure = f
+	s.lock.Unlock()
+}
+
+// FailureStatus sets the status codes that will be considered a failure for
+// requests made by this Switch. Errors are always considered to be failures.
+//
+// This replaces any function set by 'IsFailure'.
+func (s *Switch) FailureStatus(codes ...int) {
+	m := make(map[int]struct{}, len(codes))
+	for i := range codes {
+		m[codes[i]] = struct{}{}
+	}
+	f := func(c int, err error) bool {
+		if err != nil {
+			return true
+		}
+		_, ok := m[c]
+		return ok
+	}
+	s.lock.Lock()
+	s.failure = f
+	s.lock.Unlock()
+}
+func (s *Switch) failed(c int, err error) bool {
+	s.lock.RLock()
+	f := s.failure
+	s.lock.RUnlock()
+	if f != nil {
+		return f(c, err)
+	}
+	return err != nil || c >= 500
+}
+
+// HealthCheck starts a background task that will send a HEAD request to the
+// specified path of the Switch target every interval, to check if the target is
+// healthy. The status of the last check can be read using the 'Healthy' function.
+//
+// Checks that fail (according to the 'IsFailure' function) mark the Switch as
+// unhealthy. The task will stop when the Switch context is cancelled or this
+// function is called again. An interval of zero or less only stops any running
+// task.
+func (s *Switch) HealthCheck(d time.Duration, path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+	if s.down.Store(false); d <= 0 {
+		return
+	}
+	var x context.Context
+	x, s.stop = context.WithCancel(s.ctx)
+	go s.check(x, d, path)
+}
+
+// Ping sends a request to the Switch target and returns an error if the request
+// failed (according to the 'IsFailure' function). The context can be used to
+// cancel the request.
+//
+// The request is a HEAD request to "/", unless changed by 'PingRequest'. This is
+// separate from any health checks and does not change the 'Healthy' status.
+func (s *Switch) Ping(x context.Context) error {
+	s.lock.RLock()
+	m, p := s.ping[0], s.ping[1]
+	s.lock.RUnlock()
+	if len(m) == 0 {
+		m = http.MethodHead
+	}
+	if len(p) == 0 {
+		p = "/"
+	}
+	return s.probe(x, m, p)
+}
+
+// PingRequest sets the method and path of the requests sent by 'Ping'. Empty
+// values will use the defaults of "HEAD" and "/".
+func (s *Switch) PingRequest(method, path string) {
+	s.lock.Lock()
+	s.ping = [2]string{method, path}
+	s.lock.Unlock()
+}
+
+// SwitchStats is a struct that contains the counters of a Switch, which are
+// returned by the 'Stats' function.
+//
+// Requests is the number of requests sent to any of the Switch targets, which
+// includes Retries, the number of requests sent to additional targets after a
+// failure. Failures is the number of these requests that failed (according to
+// the 'IsFailure' function). Fallbacks is the number of requests handled by
+// this Switch as the Proxy fallback and Unhealthy is the number of failed health
+// checks.
+type SwitchStats struct {
+	Requests  uint64 `json:"requests"`
+	Retries   uint64 `json:"retries"`
+	Failures  uint64 `json:"failures"`
+	Fallbacks uint64 `json:"fallbacks"`
+	Unhealthy uint64 `json:"unhealthy"`
+}
+
+// Stats returns a snapshot of the counters of this Switch. The counters are
+// updated atomically, so this is safe to use while requests are processed.
+func (s *Switch) Stats() SwitchStats {
+	return SwitchStats{
+		Requests:  s.stats.requests.Load(),
+		Retries:   s.stats.retries.Load(),
+		Failures:  s.stats.failures.Load(),
+		Fallbacks: s.stats.fallbacks.Load(),
+		Unhealthy: s.stats.unhealthy.Load(),
+	}
+}
+
+// Healthy returns false if the last health check of this Switch failed. This
+// will always return true if 'HealthCheck' was not used.
+func (s *Switch) Healthy() bool {
+	return !s.down.Load()
+}
+func (s *Switch) check(x context.Context, d time.Duration, p string) {
+	t := time.NewTicker(d)
+	for {
+		err := s.probe(x, http.MethodHead, p)
+		if x.Err() != nil {
+			t.Stop()
+			return
+		}
+		if s.down.Store(err != nil); err != nil {
+			s.stats.unhealthy.Add(1)
+		}
+		select {
+		case <-x.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+func (s *Switch) probe(x context.Context, m, p string) error {
+	if s.timeout > 0 {
+		var f context.CancelFunc
+		x, f = context.WithTimeout(x, s.timeout)
+		defer f()
+	}
+	u := s.URL
+	u.Path = p
+	q, err := http.NewRequestWithContext(x, m, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	o, err := s.client.Do(q)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, o.Body)
+	o.Body.Close()
+	if s.failed(o.StatusCode, nil) {
+		return errors.New(`health check returned status "` + o.Status + `"`)
+	}
+	return nil
+}
+
+// UpstreamProxy sets the URL of a proxy that this Switch will use to connect
+// to its target, which overrides any proxy set by the environment. Supported
+// proxy URL schemes are "http", "https" and "socks5".
+//
+// An empty string restores the default, which is to use the proxy set by the
+// environment, if any. This should be set before the Switch is used.
+func (s *Switch) UpstreamProxy(proxyURL string) error {
+	if len(proxyURL) == 0 {
+		s.tr.Proxy, s.h2.Proxy = http.ProxyFromEnvironment, http.ProxyFromEnvironment
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return errors.New("unable to resolve proxy URL: " + err.Error())
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.New(`unsupported proxy URL scheme "` + u.Scheme + `"`)
+	}
+	if len(u.Host) == 0 {
+		return errors.New("proxy URL host is empty")
+	}
+	s.tr.Proxy, s.h2.Proxy = http.ProxyURL(u), http.ProxyURL(u)
+	return nil
+}
+
+// NormalizePath sets if this Switch will collapse repeated slashes in request
+// paths (such as "/api//users") into single slashes before forwarding.
+//
+// Normalization is done before any rewrites are applied and does not change any
+// encoded characters or the query.
+func (s *Switch) NormalizePath(e bool) {
+	s.lock.Lock()
+	s.clean = e
+	s.lock.Unlock()
+}
+
+// TrailingSlash sets how this Switch handles trailing slashes in request paths
+// before forwarding. The default is SlashKeep, which does not change them.
+//
+// This is applied before any rewrites, along with 'NormalizePath'.
+func (s *Switch) TrailingSlash(m SlashMode) {
+	s.lock.Lock()
+	s.slash = m
+	s.lock.Unlock()
+}
+
+// RewriteJoinMode sets how this Switch joins the replacement of a rewrite with
+// the rest of the request path. The default is JoinClean, which cleans the
+// resulting path. JoinConcat can be used for targets that need the exact path.
+//
+// Requests received by the Proxy server itself ('Start' or 'Serve') with "."
+// elements or repeated slashes in their path are redirected to the cleaned path
+// before they are forwarded. Use 'ServeHTTP' directly to keep these paths.
+func (s *Switch) RewriteJoinMode(m JoinMode) {
+	s.lock.Lock()
+	s.join = m
+	s.lock.Unlock()
+}
+
+// MetadataOnly sets if this Switch will only be sent the request metadata
+// (method, path and headers) when used as a secondary Switch, which prevents
+// the request body from being sent again.
+//
+// Handlers will receive Results with empty request Content. This has no effect
+// when the Switch is used as the primary Switch.
+func (s *Switch) MetadataOnly(e bool) {
+	s.meta.Store(e)
+}
+
+// CloseIdleOnError sets if the Switch will close its idle connections to the
+// Switch targets after a request fails with a connection error or a 5xx status,
+// so the next request uses a new connection. This is done at most once a second,
+// so the connection pool still works while a target is failing.
+func (s *Switch) CloseIdleOnError(e bool) {
+	s.reset.Store(e)
+}
+
+// ServerTiming sets if the Switch will add a "Server-Timing" header to responses
+// with the time taken (in milliseconds) to send the request to the Switch target
+// and read the response, as the "upstream" metric. Any "Server-Timing" headers
+// sent by the target are kept.
+func (s *Switch) ServerTiming(e bool) {
+	s.timing.Store(e)
+}
+
+// CaptureOriginalPath sets if the Results passed to the Pre and Post Handlers will
+// contain the path requested by the client, instead of the path after any
+// rewrites. This only changes what is reported, the request is still sent to
+// the rewritten path.
+func (s *Switch) CaptureOriginalPath(e bool) {
+	s.orig.Store(e)
 }
 
 // NewSwitch creates a switching context that allows the connection to be proxied
 // to the specified server.
+//
+// This function will use the timeout set by 'DefaultSwitchTimeout', which is
+// the DefaultTimeout value, unless changed.
 func NewSwitch(target string) (*Switch, error) {
-	return NewSwitchTimeout(target, DefaultTimeout)
+	t := time.Duration(switchTimeout.Load())
+	switch {
+	case t == 0:
+		t = DefaultTimeout
+	case t < 0:
+		t = 0
+	}
+	return NewSwitchContext(context.Background(), target, t)
+}
+
+// DefaultSwitchTimeout sets the timeout that will be used by any Switches
+// created with 'NewSwitch'. Switches that are created with a timeout will not
+// use this value.
+//
+// A value of zero restores the DefaultTimeout value and a negative value will
+// disable the timeout.
+func DefaultSwitchTimeout(d time.Duration) {
+	if d < 0 {
+		d = -1
+	}
+	switchTimeout.Store(int64(d))
 }
 
 // NewSwitchTimeout creates a switching context that allows the connection to be
@@ -103,6 +904,15 @@ func NewSwitch(target string) (*Switch, error) {
 //
 // This function will set the specified timeout.
 func NewSwitchTimeout(target string, t time.Duration) (*Switch, error) {
+	return NewSwitchContext(context.Background(), target, t)
+}
+
+// NewSwitchContext creates a switching context that allows the connection to be
+// proxied to the specified server.
+//
+// This function will set the specified timeout. The context is used to stop any
+// background tasks of the Switch, such as health checks, when it is cancelled.
+func NewSwitchContext(x context.Context, target string, t time.Duration) (*Switch, error) {
 	u, err := url.Parse(target)
 	if err != nil {
 		return nil, errors.New("unable to resolve URL: " + err.Error())
@@ -111,84 +921,494 @@ func NewSwitchTimeout(target string, t time.Duration) (*Switch, error) {
 		u.Scheme = "http"
 	}
 	s := &Switch{
+		ctx: x,
 		URL: *u,
-		client: &http.Client{
-			Timeout: t,
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   t,
-					KeepAlive: t,
-				}).DialContext,
-				IdleConnTimeout:       t,
-				TLSHandshakeTimeout:   t,
-				ExpectContinueTimeout: t,
-				ResponseHeaderTimeout: t,
-			},
+		tr: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   t,
+				KeepAlive: t,
+			}).DialContext,
+			IdleConnTimeout:       t,
+			TLSHandshakeTimeout:   t,
+			ExpectContinueTimeout: t,
+			ResponseHeaderTimeout: t,
 		},
 		timeout: t,
-		rewrite: make(map[string]string),
+		redact:  make(map[string]struct{}),
 	}
+	s.client = &http.Client{Timeout: t, Transport: s.tr, CheckRedirect: redirect}
+	s.h2 = s.tr.Clone()
+	// gRPC streams can be long lived, so only the dial timeouts are used.
+	s.h2.ResponseHeaderTimeout = 0
+	s.h2.Protocols = new(http.Protocols)
+	s.h2.Protocols.SetHTTP2(true)
+	s.h2.Protocols.SetUnencryptedHTTP2(true)
 	return s, nil
 }
-func (s Switch) process(x context.Context, r *http.Request, t *transfer) (int, http.Header, error) {
-	s.Path = r.URL.Path
-	s.User = r.URL.User
-	s.Opaque = r.URL.Opaque
-	s.Fragment = r.URL.Fragment
-	s.RawQuery = r.URL.RawQuery
-	s.ForceQuery = r.URL.ForceQuery
-	for k, v := range s.rewrite {
-		if strings.HasPrefix(s.Path, k) {
-			s.Path = path.Join(v, s.Path[len(k):])
+func (s *Switch) headers(h http.Header) http.Header {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.redact) == 0 || len(h) == 0 {
+		return h
+	}
+	c := h.Clone()
+	for k := range s.redact {
+		v, ok := c[k]
+		if !ok {
+			continue
+		}
+		for i := range v {
+			v[i] = Redacted
+		}
+	}
+	return c
+}
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	// The Transport can still be sending the body while the Result is made.
+	if c.n.Add(int64(n)); c.w != nil {
+		if n > 0 {
+			c.w.Write(b[:n])
+		}
+		if err == io.EOF {
+			c.w.Close()
+		} else if err != nil {
+			c.w.CloseWithError(err)
+		}
+	}
+	return n, err
+}
+func (t *transfer) sent(c *counter) int64 {
+	if c != nil {
+		return c.n.Load()
+	}
+	if t.in == nil {
+		return 0
+	}
+	return t.in.Size() - int64(t.in.Len())
+}
+func classify(err error) error {
+	if e := (*http.MaxBytesError)(nil); errors.As(err, &e) {
+		// The client sent a streamed body over the MaxBodySize limit.
+		return &StatusError{Err: err, Status: http.StatusRequestEntityTooLarge}
+	}
+	if n := net.Error(nil); errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &n) && n.Timeout()) {
+		return &StatusError{Err: err, Status: http.StatusGatewayTimeout}
+	}
+	return &StatusError{Err: err, Status: http.StatusBadGateway}
+}
+func headerSize(h http.Header) int {
+	var n int
+	for k, v := range h {
+		for i := range v {
+			// Account for the ": " and CRLF characters.
+			n += len(k) + len(v[i]) + 4
+		}
+	}
+	return n
+}
+func (s *Switch) copyHeaders(dst, src http.Header) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for k, v := range src {
+		if _, ok := s.deny[k]; ok {
+			continue
+		}
+		if len(s.allow) > 0 {
+			if _, ok := s.allow[k]; !ok {
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+func normalize(p string, collapse bool, m SlashMode) string {
+	if collapse && strings.Contains(p, "//") {
+		var b strings.Builder
+		b.Grow(len(p))
+		for i := 0; i < len(p); i++ {
+			if p[i] == '/' && i > 0 && p[i-1] == '/' {
+				continue
+			}
+			b.WriteByte(p[i])
+		}
+		p = b.String()
+	}
+	switch {
+	case m == SlashStrip && len(p) > 1 && p[len(p)-1] == '/':
+		if p = strings.TrimRight(p, "/"); len(p) == 0 {
+			p = "/"
+		}
+	case m == SlashAdd && (len(p) == 0 || p[len(p)-1] != '/'):
+		p += "/"
+	}
+	return p
+}
+func (s *Switch) target(u url.URL, r *http.Request) url.URL {
+	u.Path = r.URL.Path
+	u.User = r.URL.User
+	u.Opaque = r.URL.Opaque
+	u.Fragment = r.URL.Fragment
+	u.RawQuery = r.URL.RawQuery
+	u.ForceQuery = r.URL.ForceQuery
+	u.RawPath = r.URL.RawPath
+	s.lock.RLock()
+	c, m, j := s.clean, s.slash, s.join
+	s.lock.RUnlock()
+	if c || m != SlashKeep {
+		// Use the escaped path, so encoded characters (such as "%2F") are not
+		// changed.
+		e := normalize(r.URL.EscapedPath(), c, m)
+		if v, err := url.PathUnescape(e); err == nil {
+			u.Path, u.RawPath = v, e
 		}
 	}
+	if m := s.rewrite.Load(); m != nil {
+		for k, v := range *m {
+			if !strings.HasPrefix(u.Path, k) {
+				continue
+			}
+			if j == JoinConcat {
+				u.Path = v + u.Path[len(k):]
+			} else {
+				u.Path = path.Join(v, u.Path[len(k):])
+			}
+		}
+	}
+	return u
+}
+func (s *Switch) reported(u url.URL, r *http.Request) url.URL {
+	if s.orig.Load() {
+		u.Path, u.RawPath = r.URL.Path, r.URL.RawPath
+	}
+	return u
+}
+func (s *Switch) outgoing(r *http.Request) http.Header {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.agent) == 0 && !hopping(r.Header) {
+		return r.Header
+	}
+	h := r.Header.Clone()
+	// The client connection options (such as HTTP/1.0 keep-alive) only apply to
+	// the client connection and are handled by the server, so they are not sent
+	// to the target, which uses its own connection. A "TE" value of "trailers"
+	// is kept, as it describes the request and not the connection.
+	t := strings.Contains(strings.ToLower(strings.Join(h["Te"], ",")), "trailers")
+	if hop(h); t {
+		h.Set("Te", "trailers")
+	}
+	if len(s.agent) == 0 {
+		return h
+	}
+	if s.agent == NoUserAgent {
+		// An empty value prevents the Transport adding its own default.
+		h.Set("User-Agent", "")
+	} else {
+		h.Set("User-Agent", s.agent)
+	}
+	return h
+}
+func hop(h http.Header) {
+	// Remove the hop-by-hop headers (RFC 7230 section 6.1), along with any
+	// headers named in the "Connection" header.
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); len(k) > 0 {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+func hopping(h http.Header) bool {
+	for _, k := range hopHeaders {
+		if _, ok := h[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+func deny(_, a string, _ syscall.RawConn) error {
+	h, _, err := net.SplitHostPort(a)
+	if err != nil {
+		return err
+	}
+	i := net.ParseIP(h)
+	if i == nil {
+		return ErrTargetDenied
+	}
+	if v := i.To4(); v != nil {
+		// Also covers IPv4-mapped IPv6 addresses, such as "::ffff:10.0.0.1".
+		i = v
+	}
+	if i.IsPrivate() || i.IsLoopback() || i.IsLinkLocalUnicast() || i.IsLinkLocalMulticast() || i.IsUnspecified() || shared.Contains(i) {
+		return ErrTargetDenied
+	}
+	return nil
+}
+func (s *Switch) allowed(u url.URL) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.hosts == nil {
+		return true
+	}
+	_, ok := s.hosts[strings.ToLower(u.Hostname())]
+	return ok
+}
+func idempotent(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+func (s *Switch) direct(x context.Context, r *http.Request, t *transfer, u url.URL) (Result, error) {
+	if err := s.verified(r, t); err != nil {
+		return Result{}, err
+	}
+	return s.attempt(x, r, t, u, 0)
+}
+func (s *Switch) verified(r *http.Request, t *transfer) error {
+	if s.verify.Load() && t.stream == nil && !digestValid(r.Header, t.data) {
+		return &StatusError{Err: ErrDigestMismatch, Status: http.StatusBadRequest}
+	}
+	return nil
+}
+func (s *Switch) process(x context.Context, r *http.Request, t *transfer) (Result, error) {
+	if err := s.verified(r, t); err != nil {
+		return Result{}, err
+	}
+	s.lock.RLock()
+	e := s.extra
+	s.lock.RUnlock()
+	v, err := s.attempt(x, r, t, s.URL, 0)
+	if len(e) == 0 || t.stream != nil || !idempotent(r.Method) {
+		return v, err
+	}
+	for i := 0; i < len(e) && !t.streamed() && s.failed(int(v.Status), err) && x.Err() == nil; i++ {
+		t.out.Reset()
+		t.in = bytes.NewReader(t.data)
+		v, err = s.attempt(x, r, t, e[i], i+1)
+	}
+	return v, err
+}
+func (s *Switch) closeIdle() {
+	// Limit how often the connections are closed, so a burst of errors does not
+	// stop the connection pool from working.
+	n, l := time.Now().UnixNano(), s.closed.Load()
+	if n-l < int64(time.Second) || !s.closed.CompareAndSwap(l, n) {
+		return
+	}
+	s.tr.CloseIdleConnections()
+	s.h2.CloseIdleConnections()
+}
+func upstreamError(err error) bool {
+	if err == nil || errors.Is(err, ErrTargetDenied) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	// Errors caused by the client body, or by the limits of this Switch, do not
+	// mean the connection is broken.
+	e := (*http.MaxBytesError)(nil)
+	return !errors.As(err, &e) && !errors.Is(err, ErrResponseTooLarge) && !errors.Is(err, ErrHeadersTooLarge) && !errors.Is(err, ErrDigestMismatch)
+}
+func (s *Switch) send(x context.Context, r *http.Request, t *transfer, b url.URL, k int) (Result, error) {
+	a := s.target(b, r)
+	if !s.allowed(a) {
+		return Result{}, &StatusError{Err: ErrTargetDenied, Status: http.StatusForbidden}
+	}
 	f := func() {}
-	if s.timeout > 0 {
+	if s.timeout > 0 && s.ttfb <= 0 {
 		x, f = context.WithTimeout(x, s.timeout)
 	}
-	q, err := http.NewRequestWithContext(x, r.Method, s.String(), t.in)
+	if s.hints.Load() && t.hint != nil {
+		x = s.earlyHints(x, t.hint)
+	}
+	var (
+		c *counter
+		w *framing
+		d = t.body()
+	)
+	if s.strict {
+		x = httptrace.WithClientTrace(x, &httptrace.ClientTrace{
+			GotConn: func(i httptrace.GotConnInfo) {
+				if w, _ = i.Conn.(*framing); w != nil {
+					w.arm()
+				}
+			},
+		})
+	}
+	s.lock.RLock()
+	tap, modify, digest := s.tap, s.modify, s.digest
+	s.lock.RUnlock()
+	if t.stream != nil {
+		c = &counter{Reader: t.stream}
+		if d = c; tap != nil {
+			var v *io.PipeReader
+			v, c.w = io.Pipe()
+			// Close the pipe when done, in case the body was not read fully.
+			g := f
+			f = func() {
+				c.w.CloseWithError(io.ErrUnexpectedEOF)
+				g()
+			}
+			go func(e func(io.Reader)) {
+				e(v)
+				io.Copy(io.Discard, v)
+			}(tap)
+		}
+	}
+	q, err := http.NewRequestWithContext(x, r.Method, a.String(), d)
 	if err != nil {
 		f()
-		return 0, nil, err
-	}
-	u := newUUID()
-	if s.Pre != nil {
-		s.Pre(Result{
-			IP:      r.RemoteAddr,
-			URL:     s.String(),
-			UUID:    u,
-			Path:    s.Path,
-			Method:  r.Method,
-			Content: t.data,
-			Headers: r.Header,
+		return Result{}, err
+	}
+	if c != nil {
+		// Unknown length, the Transport will send this body chunked.
+		q.ContentLength = -1
+	}
+	u, l := t.id, s.reported(a, r)
+	if len(u) == 0 {
+		u = newUUID()
+	}
+	pre, post := s.handlers()
+	if pre != nil {
+		pre(Result{
+			IP:       r.RemoteAddr,
+			URL:      l.String(),
+			UUID:     u,
+			Path:     l.Path,
+			Target:   a.Host,
+			Method:   r.Method,
+			Content:  t.data,
+			Headers:  s.headers(r.Header),
+			BytesIn:  int64(len(t.data)),
+			Failover: t.fail || k > 0,
+			Attempts: k + 1,
 		})
 	}
-	q.Header, q.Trailer = r.Header, r.Trailer
-	q.TransferEncoding = r.TransferEncoding
+	q.Header, q.Trailer, q.Host = s.outgoing(r), r.Trailer, s.host(r.URL.Path)
+	if q.TransferEncoding = r.TransferEncoding; c == nil && len(r.Trailer) > 0 {
+		// The buffered body was fully read, so the received trailers are set
+		// already. Trailers can only be sent with a chunked body, which is not
+		// used by default when the body has a known length (HTTP/2 clients).
+		q.Trailer, q.ContentLength = r.Trailer.Clone(), -1
+	}
+	var g time.Time
+	if s.timing.Load() {
+		g = time.Now()
+	}
 	o, err := s.client.Do(q)
 	if err != nil {
 		f()
-		return 0, nil, err
+		return Result{}, classify(err)
 	}
-	if _, err := io.Copy(t.out, o.Body); err != nil {
+	if m := s.headMax.Load(); m > 0 && int64(headerSize(o.Header)) > m {
 		f()
 		o.Body.Close()
-		return 0, nil, err
-	}
-	if s.Post != nil {
-		s.Post(Result{
-			IP:      r.RemoteAddr,
-			URL:     s.String(),
-			Path:    s.Path,
-			UUID:    u,
-			Status:  uint16(o.StatusCode),
-			Method:  r.Method,
-			Content: t.out.Bytes(),
-			Headers: o.Header,
-		})
+		return Result{}, ErrHeadersTooLarge
+	}
+	if w != nil && w.conflict() {
+		// Closing the unread body also closes the upstream connection.
+		f()
+		o.Body.Close()
+		return Result{}, &StatusError{Err: ErrConflictingFraming, Status: http.StatusBadRequest}
+	}
+	if modify != nil {
+		modify(o.StatusCode, o.Header)
+	}
+	var (
+		n int64
+		m = s.bodyMax.Load()
+		e = t.resp
+	)
+	if e != nil && (r.Method == http.MethodHead || len(digest) > 0 || s.failed(o.StatusCode, nil)) {
+		// The digest needs the whole body before the response is written, and
+		// failed responses may be tried again.
+		e = nil
+	}
+	switch {
+	case r.Method == http.MethodHead:
+		// HEAD responses never have content, so any body sent by the upstream
+		// is dropped instead of being passed on to the client.
+	case e != nil:
+		if m > 0 && o.ContentLength > m {
+			f()
+			o.Body.Close()
+			return Result{}, ErrResponseTooLarge
+		}
+		var i io.Reader = o.Body
+		if m > 0 {
+			i = &limitBody{ReadCloser: o.Body, n: m}
+		}
+		if s.timing.Load() {
+			// The body is still being received, so only the time until the
+			// response head can be reported.
+			o.Header.Add("Server-Timing", upstreamTiming(g))
+		}
+		if t.hint != nil {
+			t.hint.stop()
+		}
+		e.start(s, o.StatusCode, o.Header, o.ContentLength)
+		// A client that stopped reading is not a failure of the Switch target.
+		if n, err = io.Copy(e, i); e.err != nil {
+			err = nil
+		}
+	case m > 0:
+		if n, err = io.Copy(t.out, io.LimitReader(o.Body, m+1)); err == nil && n > m {
+			// Closing the unread body also closes the upstream connection.
+			f()
+			o.Body.Close()
+			return Result{}, ErrResponseTooLarge
+		}
+	default:
+		n, err = io.Copy(t.out, o.Body)
+	}
+	if err != nil {
+		f()
+		o.Body.Close()
+		return Result{}, classify(err)
+	}
+	if len(digest) > 0 && r.Method != http.MethodHead {
+		o.Header.Set("Digest", responseDigest(digest, t.out.Bytes()))
+	}
+	if s.timing.Load() && e == nil {
+		// Added as a new value, so any entries from the target are kept.
+		o.Header.Add("Server-Timing", upstreamTiming(g))
+	}
+	h := t.out.Bytes()
+	if e != nil {
+		h = e.content()
+	}
+	v := Result{
+		IP:       r.RemoteAddr,
+		URL:      l.String(),
+		Path:     l.Path,
+		UUID:     u,
+		Target:   a.Host,
+		Status:   uint16(o.StatusCode),
+		Method:   r.Method,
+		Content:  h,
+		Headers:  o.Header,
+		BytesIn:  t.sent(c),
+		BytesOut: n,
+		Failover: t.fail || k > 0,
+		Attempts: k + 1,
+	}
+	if post != nil {
+		p := v
+		if p.Headers = s.headers(o.Header); s.decode.Load() {
+			p.Content = decoded(o.Header, p.Content)
+		}
+		post(p)
 	}
 	f()
 	o.Body.Close()
-	return o.StatusCode, o.Header, nil
+	return v, nil
+}
+func upstreamTiming(g time.Time) string {
+	return "upstream;dur=" + strconv.FormatFloat(float64(time.Since(g))/float64(time.Millisecond), 'f', 3, 64)
 }
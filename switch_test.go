@@ -0,0 +1,1228 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	var (
+		got  = make(chan string, 1)
+		pre  = make(chan switchproxy.Result, 1)
+		resp = make(chan switchproxy.Result, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("Authorization")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte("ok"))
+	}))
+	s.RedactHeaders()
+	s.Pre = func(r switchproxy.Result) { pre <- r }
+	s.Post = func(r switchproxy.Result) { resp <- r }
+	p := switchproxytest.NewProxy(t, s)
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Set("Authorization", "Bearer token")
+	q.Header.Set("X-Other", "value")
+	o, _ := do(t, q)
+	if v := <-got; v != "Bearer token" {
+		t.Fatalf("upstream Authorization = %q, want the real value", v)
+	}
+	if v := o.Header.Get("Set-Cookie"); v != "session=secret" {
+		t.Fatalf("client Set-Cookie = %q, want the real value", v)
+	}
+	h := (<-pre).Headers
+	if v := h.Get("Authorization"); v != switchproxy.Redacted {
+		t.Fatalf("Result Authorization = %q, want %q", v, switchproxy.Redacted)
+	}
+	if v := h.Get("X-Other"); v != "value" {
+		t.Fatalf("Result X-Other = %q, want it unchanged", v)
+	}
+	if v := (<-resp).Headers.Get("Set-Cookie"); v != switchproxy.Redacted {
+		t.Fatalf("Result Set-Cookie = %q, want %q", v, switchproxy.Redacted)
+	}
+}
+func TestRedactHeadersCustom(t *testing.T) {
+	pre := make(chan switchproxy.Result, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.RedactHeaders("x-api-key")
+	s.Pre = func(r switchproxy.Result) { pre <- r }
+	p := switchproxytest.NewProxy(t, s)
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+	q.Header.Set("X-Api-Key", "secret")
+	q.Header.Set("Authorization", "Bearer token")
+	do(t, q)
+	h := (<-pre).Headers
+	if v := h.Get("X-Api-Key"); v != switchproxy.Redacted {
+		t.Fatalf("Result X-Api-Key = %q, want %q", v, switchproxy.Redacted)
+	}
+	if v := h.Get("Authorization"); v != "Bearer token" {
+		t.Fatalf("Result Authorization = %q, want it unchanged when not named", v)
+	}
+}
+func TestFailover(t *testing.T) {
+	d := httptest.NewServer(http.NotFoundHandler())
+	d.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("fallback"))
+	}))
+	defer b.Close()
+	s, err := switchproxy.NewSwitch(d.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if err = s.AddTarget(b.URL); err != nil {
+		t.Fatalf("add target failed: %s", err)
+	}
+	c := make(chan switchproxy.Result, 1)
+	s.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	if _, v := get(t, p.URL+"/"); v != "fallback" {
+		t.Fatalf("response = %q, want the fallback target response", v)
+	}
+	r := <-c
+	if u, _ := url.Parse(b.URL); r.Target != u.Host {
+		t.Fatalf("Result Target = %q, want %q", r.Target, u.Host)
+	}
+	if !r.Failover || r.Attempts != 2 {
+		t.Fatalf("Result Failover = %t, Attempts = %d, want true and 2", r.Failover, r.Attempts)
+	}
+}
+func TestNoFailover(t *testing.T) {
+	c := make(chan switchproxy.Result, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	get(t, p.URL+"/")
+	if r := <-c; r.Failover || r.Attempts != 1 || len(r.Target) == 0 {
+		t.Fatalf("Result Failover = %t, Attempts = %d, Target = %q, want false, 1 and the target", r.Failover, r.Attempts, r.Target)
+	}
+}
+func TestResponseHeaderAllowlist(t *testing.T) {
+	c := make(chan switchproxy.Result, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Keep", "1")
+		w.Header().Set("X-Drop", "1")
+	}))
+	s.ResponseHeaderAllowlist("x-keep")
+	s.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	o, _ := get(t, p.URL+"/")
+	if o.Header.Get("X-Keep") != "1" || len(o.Header.Get("X-Drop")) > 0 {
+		t.Fatalf("client headers = %v, want only the allowed header", o.Header)
+	}
+	if h := (<-c).Headers; h.Get("X-Drop") != "1" {
+		t.Fatalf("Result headers = %v, want all headers", h)
+	}
+}
+func TestResponseHeaderDenylist(t *testing.T) {
+	c := make(chan switchproxy.Result, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Keep", "1")
+		w.Header().Set("X-Powered-By", "1")
+	}))
+	s.ResponseHeaderDenylist("x-powered-by")
+	s.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	o, _ := get(t, p.URL+"/")
+	if o.Header.Get("X-Keep") != "1" || len(o.Header.Get("X-Powered-By")) > 0 {
+		t.Fatalf("client headers = %v, want the denied header removed", o.Header)
+	}
+	if h := (<-c).Headers; h.Get("X-Powered-By") != "1" {
+		t.Fatalf("Result headers = %v, want all headers", h)
+	}
+}
+func TestUserAgent(t *testing.T) {
+	c := make(chan []string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.Header.Values("User-Agent")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	for _, v := range []struct {
+		agent, want string
+	}{
+		{"", "client/1.0"},
+		{"proxy/2.0", "proxy/2.0"},
+		{switchproxy.NoUserAgent, ""},
+	} {
+		s.UserAgent(v.agent)
+		q, _ := http.NewRequest(http.MethodGet, p.URL+"/", nil)
+		q.Header.Set("User-Agent", "client/1.0")
+		do(t, q)
+		if r := <-c; strings.Join(r, ",") != v.want {
+			t.Fatalf("UserAgent(%q): upstream saw %q, want %q", v.agent, r, v.want)
+		}
+	}
+}
+func ExampleUUIDGenerator() {
+	var n int
+	switchproxy.UUIDGenerator(func() string {
+		n++
+		return "request-" + strconv.Itoa(n)
+	})
+	defer switchproxy.UUIDGenerator(nil)
+	b := httptest.NewServer(http.NotFoundHandler())
+	defer b.Close()
+	s, _ := switchproxy.NewSwitch(b.URL)
+	s.Post = func(r switchproxy.Result) { fmt.Println(r.UUID) }
+	x := switchproxy.New("")
+	x.Primary(s)
+	p := httptest.NewServer(x)
+	defer p.Close()
+	for i := 0; i < 2; i++ {
+		if o, err := http.Get(p.URL); err == nil {
+			o.Body.Close()
+		}
+	}
+	// Output:
+	// request-1
+	// request-2
+}
+func TestSettingsRace(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}))
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.AddSecondary(x)
+	var (
+		b buffer
+		g sync.WaitGroup
+		n atomic.Int64
+		e = make(chan int, 1)
+		d = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			for {
+				select {
+				case <-d:
+					return
+				default:
+				}
+				o, err := http.Post(p.URL+"/a", "text/plain", strings.NewReader("body"))
+				if err != nil {
+					continue
+				}
+				io.Copy(io.Discard, o.Body)
+				o.Body.Close()
+				if n.Add(1); o.StatusCode != http.StatusOK {
+					select {
+					case e <- o.StatusCode:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	// Keep changing the settings until enough requests have been served. None
+	// of these change the response, so every request must still succeed.
+	for i := 0; n.Load() < 200; i++ {
+		time.Sleep(time.Millisecond)
+		v := i%2 == 0
+		for _, c := range []*switchproxy.Switch{s, x} {
+			if !v {
+				c.Reset()
+				continue
+			}
+			c.UserAgent("test")
+			c.RewriteHost("/a", "a.example.com")
+			c.AddResponseDigest("")
+			c.StreamTap(func(r io.Reader) { io.Copy(io.Discard, r) })
+			c.ResponseHeaderFunc(func(int, http.Header) {})
+			c.IsFailure(func(c int, err error) bool { return err != nil || c >= 500 })
+			c.LogTo(&b)
+			c.PingRequest(http.MethodGet, "/")
+		}
+		s.VerifyDigest(v)
+		s.CaptureOriginalPath(v)
+		s.GRPCWeb(v)
+		s.DecodeContent(v)
+		s.ForwardEarlyHints(v)
+		s.ServerTiming(v)
+		s.CloseIdleOnError(v)
+		s.NormalizePath(v)
+		s.TrailingSlash(switchproxy.SlashKeep)
+		s.RewriteJoinMode(switchproxy.JoinClean)
+		s.MaxResponseHeaderBytes(1 << 20)
+		s.MaxResponseBody(1 << 20)
+		x.MetadataOnly(v)
+		s.Ping(context.Background())
+	}
+	close(d)
+	g.Wait()
+	select {
+	case c := <-e:
+		t.Fatalf("status = %d while changing the settings, want 200", c)
+	default:
+	}
+}
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for i := 0; i < 16; i++ {
+			w.Header().Set("X-Large-"+strconv.Itoa(i), strings.Repeat("a", 256))
+		}
+	}))
+	e := make(chan error, 1)
+	p := switchproxytest.NewProxy(t, s)
+	p.OnError(func(_ *http.Request, err error) { e <- err })
+	s.MaxResponseHeaderBytes(1024)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", o.StatusCode)
+	}
+	if err := <-e; !errors.Is(err, switchproxy.ErrHeadersTooLarge) {
+		t.Fatalf("error = %v, want ErrHeadersTooLarge", err)
+	}
+	s.MaxResponseHeaderBytes(0)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d without a limit, want 200", o.StatusCode)
+	}
+}
+func TestIsFailure(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("next"))
+	}))
+	defer b.Close()
+	s, err := switchproxy.NewSwitch(a.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if err = s.AddTarget(b.URL); err != nil {
+		t.Fatalf("add target failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d with the default failure function, want 429", o.StatusCode)
+	}
+	s.IsFailure(func(c int, err error) bool { return err != nil || c == http.StatusTooManyRequests })
+	if o, v := get(t, p.URL+"/"); o.StatusCode != http.StatusOK || v != "next" {
+		t.Fatalf("response = %d %q, want the next target after a failure", o.StatusCode, v)
+	}
+}
+func TestByteCounts(t *testing.T) {
+	var (
+		a = make(chan switchproxy.Result, 2)
+		b = make(chan switchproxy.Result, 2)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("b"), 250))
+	}))
+	s.Pre = func(r switchproxy.Result) { a <- r }
+	s.Post = func(r switchproxy.Result) { b <- r }
+	p := switchproxytest.NewProxy(t, s)
+	post(t, p.URL+"/", strings.Repeat("a", 100))
+	if r := <-a; r.BytesIn != 100 {
+		t.Fatalf("Pre BytesIn = %d, want 100", r.BytesIn)
+	}
+	if r := <-b; r.BytesIn != 100 || r.BytesOut != 250 {
+		t.Fatalf("Post BytesIn = %d, BytesOut = %d, want 100 and 250", r.BytesIn, r.BytesOut)
+	}
+	// Chunked bodies are streamed, so the count is only known after sending.
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/", io.MultiReader(strings.NewReader(strings.Repeat("c", 37))))
+	do(t, q)
+	<-a
+	if r := <-b; r.BytesIn != 37 || r.BytesOut != 250 {
+		t.Fatalf("chunked Post BytesIn = %d, BytesOut = %d, want 37 and 250", r.BytesIn, r.BytesOut)
+	}
+}
+func TestHealthCheckContext(t *testing.T) {
+	var n atomic.Int64
+	v := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		n.Add(1)
+	}))
+	defer v.Close()
+	x, f := context.WithCancel(context.Background())
+	defer f()
+	s, err := switchproxy.NewSwitchContext(x, v.URL, time.Second)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	// Calls from multiple goroutines replace the running task safely.
+	var g sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		g.Add(1)
+		go func() {
+			s.HealthCheck(5*time.Millisecond, "/health")
+			g.Done()
+		}()
+	}
+	g.Wait()
+	for i := 0; i < 100 && n.Load() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n.Load() < 3 || !s.Healthy() {
+		t.Fatalf("got %d checks, healthy = %t, want the checks to run", n.Load(), s.Healthy())
+	}
+	f()
+	time.Sleep(20 * time.Millisecond)
+	c := n.Load()
+	time.Sleep(50 * time.Millisecond)
+	if v := n.Load(); v != c {
+		t.Fatalf("got %d checks after the context was cancelled, want none", v-c)
+	}
+}
+func TestHealthCheckUnhealthy(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	s.HealthCheck(5*time.Millisecond, "/")
+	defer s.HealthCheck(0, "")
+	for i := 0; i < 100 && s.Healthy(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Healthy() {
+		t.Fatal("Switch is healthy, want it to be marked unhealthy")
+	}
+	if s.HealthCheck(0, ""); !s.Healthy() {
+		t.Fatal("Switch is unhealthy after stopping the checks, want the status reset")
+	}
+}
+func TestReset(t *testing.T) {
+	c := make(chan string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.URL.Path
+	}))
+	s.Rewrite("/a", "/b")
+	s.ResponseHeaderFunc(func(_ int, h http.Header) { h.Set("X-Modified", "1") })
+	n := make(chan struct{}, 2)
+	s.Pre = func(switchproxy.Result) { n <- struct{}{} }
+	p := switchproxytest.NewProxy(t, s)
+	o, _ := get(t, p.URL+"/a/x")
+	if v := <-c; v != "/b/x" || o.Header.Get("X-Modified") != "1" {
+		t.Fatalf("path = %q, X-Modified = %q, want the rewritten path and header", v, o.Header.Get("X-Modified"))
+	}
+	s.Reset()
+	o, _ = get(t, p.URL+"/a/x")
+	if v := <-c; v != "/a/x" {
+		t.Fatalf("path = %q after Reset, want it unchanged", v)
+	}
+	if v := o.Header.Get("X-Modified"); len(v) > 0 {
+		t.Fatalf("X-Modified = %q after Reset, want the ResponseHeaderFunc removed", v)
+	}
+	if len(n) != 1 {
+		t.Fatalf("Pre called %d times, want only before Reset", len(n))
+	}
+}
+func TestErrorStatus(t *testing.T) {
+	d := make(chan struct{})
+	defer close(d)
+	b := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-d:
+		case <-r.Context().Done():
+		}
+	}))
+	defer b.Close()
+	s, err := switchproxy.NewSwitchTimeout(b.URL, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	e := make(chan error, 1)
+	p := switchproxytest.NewProxy(t, s)
+	p.OnError(func(_ *http.Request, err error) { e <- err })
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d for a timeout, want 504", o.StatusCode)
+	}
+	var v *switchproxy.StatusError
+	if err := <-e; !errors.As(err, &v) || v.Status != http.StatusGatewayTimeout {
+		t.Fatalf("error = %v, want a StatusError with a 504 status", err)
+	}
+	u := httptest.NewServer(http.NotFoundHandler())
+	u.Close()
+	x, err := switchproxy.NewSwitch(u.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	p.Primary(x)
+	if o, _ := get(t, p.URL+"/"); o.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d for an unreachable target, want 502", o.StatusCode)
+	}
+	if err := <-e; !errors.As(err, &v) || v.Status != http.StatusBadGateway {
+		t.Fatalf("error = %v, want a StatusError with a 502 status", err)
+	}
+}
+func TestUpstreamProxy(t *testing.T) {
+	c := make(chan string, 1)
+	x := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests sent through a proxy use the absolute URL.
+		c <- r.RequestURI
+		w.Write([]byte("proxied"))
+	}))
+	defer x.Close()
+	s, err := switchproxy.NewSwitch("http://backend.invalid")
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if err = s.UpstreamProxy(x.URL); err != nil {
+		t.Fatalf("set upstream proxy failed: %s", err)
+	}
+	p := switchproxytest.NewProxy(t, s)
+	if _, v := get(t, p.URL+"/path"); v != "proxied" {
+		t.Fatalf("response = %q, want the response from the upstream proxy", v)
+	}
+	if v := <-c; v != "http://backend.invalid/path" {
+		t.Fatalf("upstream proxy request URI = %q, want the target URL", v)
+	}
+	for _, v := range []string{"ftp://proxy:21", "http://", "socks5://127.0.0.1:1080", ""} {
+		if err := s.UpstreamProxy(v); (err == nil) != (v == "" || strings.HasPrefix(v, "socks5")) {
+			t.Fatalf("UpstreamProxy(%q) error = %v", v, err)
+		}
+	}
+}
+func TestNormalizePath(t *testing.T) {
+	c := make(chan string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.RequestURI
+	}))
+	s.Rewrite("/api/", "/v2/")
+	p := switchproxy.New("")
+	p.Primary(s)
+	// The Proxy is used as the Handler directly, as the http.ServeMux used by
+	// 'Start' already redirects requests with repeated slashes.
+	v := httptest.NewServer(p)
+	defer v.Close()
+	for _, x := range []struct {
+		clean bool
+		mode  switchproxy.SlashMode
+		path  string
+		want  string
+	}{
+		{false, switchproxy.SlashKeep, "/a//b/", "/a//b/"},
+		{true, switchproxy.SlashKeep, "/a//b/", "/a/b/"},
+		{true, switchproxy.SlashKeep, "/api//users?q=a//b", "/v2/users?q=a//b"},
+		{true, switchproxy.SlashKeep, "/a//b%2Fc", "/a/b%2Fc"},
+		{true, switchproxy.SlashStrip, "/a//b//", "/a/b"},
+		{false, switchproxy.SlashStrip, "/", "/"},
+		{false, switchproxy.SlashAdd, "/a/b?q=1", "/a/b/?q=1"},
+		{false, switchproxy.SlashAdd, "/a/", "/a/"},
+	} {
+		s.NormalizePath(x.clean)
+		s.TrailingSlash(x.mode)
+		get(t, v.URL+x.path)
+		if r := <-c; r != x.want {
+			t.Errorf("NormalizePath(%t), TrailingSlash(%d): %q was sent as %q, want %q", x.clean, x.mode, x.path, r, x.want)
+		}
+	}
+}
+func TestDefaultSwitchTimeout(t *testing.T) {
+	defer switchproxy.DefaultSwitchTimeout(0)
+	for _, v := range []struct {
+		d, want time.Duration
+	}{
+		{0, switchproxy.DefaultTimeout},
+		{time.Minute, time.Minute},
+		{-1, 0},
+	} {
+		switchproxy.DefaultSwitchTimeout(v.d)
+		s, err := switchproxy.NewSwitch("http://127.0.0.1")
+		if err != nil {
+			t.Fatalf("create Switch failed: %s", err)
+		}
+		if x := switchproxy.TimeoutOf(s); x != v.want {
+			t.Fatalf("DefaultSwitchTimeout(%s): timeout = %s, want %s", v.d, x, v.want)
+		}
+	}
+	// Switches created with a timeout ignore the default.
+	switchproxy.DefaultSwitchTimeout(time.Minute)
+	s, err := switchproxy.NewSwitchTimeout("http://127.0.0.1", time.Second)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if x := switchproxy.TimeoutOf(s); x != time.Second {
+		t.Fatalf("timeout = %s, want the explicit timeout", x)
+	}
+}
+func TestAddTarget(t *testing.T) {
+	var n atomic.Int64
+	f := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	a, b := httptest.NewServer(f), httptest.NewServer(f)
+	defer a.Close()
+	defer b.Close()
+	c := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer c.Close()
+	s, err := switchproxy.NewSwitch(a.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.AddTarget(b.URL)
+	s.AddTarget(c.URL)
+	r := make(chan switchproxy.Result, 8)
+	s.Post = func(v switchproxy.Result) { r <- v }
+	p := switchproxytest.NewProxy(t, s)
+	q, _ := http.NewRequest(http.MethodPut, p.URL+"/", strings.NewReader("body"))
+	if o, v := do(t, q); o.StatusCode != http.StatusOK || v != "body" {
+		t.Fatalf("response = %d %q, want the third target with the full body", o.StatusCode, v)
+	}
+	// The Post Handler is called for each attempt.
+	<-r
+	<-r
+	if v := <-r; v.Attempts != 3 || !v.Failover {
+		t.Fatalf("Result Attempts = %d, Failover = %t, want 3 and true", v.Attempts, v.Failover)
+	}
+	// Requests that are not idempotent are only sent once.
+	n.Store(0)
+	if o, _ := post(t, p.URL+"/", "body"); o.StatusCode != http.StatusBadGateway || n.Load() != 1 {
+		t.Fatalf("POST status = %d, requests = %d, want 502 from the first target only", o.StatusCode, n.Load())
+	}
+}
+func TestPing(t *testing.T) {
+	c := make(chan string, 2)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c <- r.Method + " " + r.URL.Path
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping failed for a live target: %s", err)
+	}
+	if v := <-c; v != "HEAD /" {
+		t.Fatalf("Ping sent %q, want HEAD /", v)
+	}
+	s.PingRequest(http.MethodGet, "/down")
+	if err := s.Ping(context.Background()); err == nil {
+		t.Fatal("Ping succeeded for a failing status, want an error")
+	}
+	if v := <-c; v != "GET /down" {
+		t.Fatalf("Ping sent %q, want GET /down", v)
+	}
+	x, f := context.WithCancel(context.Background())
+	f()
+	if err := s.Ping(x); err == nil {
+		t.Fatal("Ping succeeded with a cancelled context, want an error")
+	}
+	d := httptest.NewServer(http.NotFoundHandler())
+	d.Close()
+	v, err := switchproxy.NewSwitch(d.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	if err = v.Ping(context.Background()); err == nil {
+		t.Fatal("Ping succeeded for a dead target, want an error")
+	}
+}
+func TestHead(t *testing.T) {
+	c := make(chan switchproxy.Result, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("X-Head", "1")
+		w.Write([]byte("hello"))
+	}))
+	s.Post = func(r switchproxy.Result) { c <- r }
+	p := switchproxytest.NewProxy(t, s)
+	q, _ := http.NewRequest(http.MethodHead, p.URL+"/", nil)
+	o, v := do(t, q)
+	if o.StatusCode != http.StatusOK || o.Header.Get("X-Head") != "1" || o.ContentLength != 5 {
+		t.Fatalf("response = %d, X-Head = %q, Content-Length = %d, want the target headers", o.StatusCode, o.Header.Get("X-Head"), o.ContentLength)
+	}
+	if len(v) > 0 {
+		t.Fatalf("response body = %q, want none", v)
+	}
+	if r := <-c; len(r.Content) > 0 || r.BytesOut != 0 {
+		t.Fatalf("Result Content = %q, BytesOut = %d, want no content", r.Content, r.BytesOut)
+	}
+}
+func TestTrailers(t *testing.T) {
+	var (
+		a = make(chan string, 1)
+		b = make(chan string, 1)
+	)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		v, _ := io.ReadAll(r.Body)
+		a <- string(v) + " " + r.Trailer.Get("X-Checksum")
+	}))
+	x := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		b <- r.Trailer.Get("X-Checksum")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	// The secondary Switch needs the body, so it is buffered before forwarding.
+	p.AddSecondary(x)
+	q, _ := http.NewRequest(http.MethodPost, p.URL+"/", io.MultiReader(strings.NewReader("data")))
+	q.Trailer = http.Header{"X-Checksum": {"abc123"}}
+	do(t, q)
+	if v := <-a; v != "data abc123" {
+		t.Fatalf("primary received %q, want the body and trailer", v)
+	}
+	select {
+	case v := <-b:
+		if v != "abc123" {
+			t.Fatalf("secondary trailer = %q, want abc123", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary did not receive the request")
+	}
+}
+func TestResponseHeaderTimeout(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path == "/stuck" {
+			time.Sleep(400 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		// The body takes longer than the Switch timeout to transfer.
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.ResponseHeaderTimeout(200 * time.Millisecond)
+	p := switchproxytest.NewProxy(t, s)
+	o, b := get(t, p.URL)
+	if o.StatusCode != http.StatusOK || b != strings.Repeat("chunk", 6) {
+		t.Fatalf("response = %d %q, want the whole body after the Switch timeout", o.StatusCode, b)
+	}
+	if o, _ = get(t, p.URL+"/stuck"); o.StatusCode == http.StatusOK {
+		t.Fatal("response headers after the timeout returned 200, want an error")
+	}
+	// Removing the header timeout applies the Switch timeout to the body again.
+	s.ResponseHeaderTimeout(0)
+	if o, b = get(t, p.URL); o.StatusCode == http.StatusOK && b == strings.Repeat("chunk", 6) {
+		t.Fatal("body took longer than the Switch timeout, want the request to fail")
+	}
+}
+func TestBlockPrivateTargets(t *testing.T) {
+	for _, v := range []string{
+		"10.0.0.1:80", "172.16.0.1:80", "192.168.1.1:80", "127.0.0.1:80", "0.0.0.0:80",
+		"169.254.169.254:80", "100.64.0.1:80", "100.127.255.254:80",
+		"[::1]:80", "[::]:80", "[fe80::1]:80", "[fd00::1]:80",
+		"[::ffff:10.0.0.1]:80", "[::ffff:127.0.0.1]:80", "[::ffff:100.64.0.1]:80",
+	} {
+		if err := switchproxy.Deny(v); !errors.Is(err, switchproxy.ErrTargetDenied) {
+			t.Fatalf("address %s returned %v, want ErrTargetDenied", v, err)
+		}
+	}
+	for _, v := range []string{"93.184.216.34:443", "100.63.255.255:80", "100.128.0.1:80", "[2606:4700::1]:443", "[::ffff:93.184.216.34]:80"} {
+		if err := switchproxy.Deny(v); err != nil {
+			t.Fatalf("address %s returned %v, want it to be allowed", v, err)
+		}
+	}
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s.BlockPrivateTargets(true)
+	p := switchproxytest.NewProxy(t, s)
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusForbidden {
+		t.Fatalf("response = %d for a loopback target, want 403", o.StatusCode)
+	}
+}
+func TestRestrictTargets(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	s.RestrictTargets("127.0.0.1")
+	if o, b := get(t, p.URL); o.StatusCode != http.StatusOK || b != "ok" {
+		t.Fatalf("response = %d %q for an allowed target, want 200", o.StatusCode, b)
+	}
+	s.RestrictTargets("backend.example.com")
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusForbidden {
+		t.Fatalf("response = %d for a target that is not allowed, want 403", o.StatusCode)
+	}
+	s.RestrictTargets()
+	if o, _ := get(t, p.URL); o.StatusCode != http.StatusOK {
+		t.Fatalf("response = %d after removing the restriction, want 200", o.StatusCode)
+	}
+}
+func TestStreamTap(t *testing.T) {
+	u := make(chan []byte, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		u <- b
+	}))
+	h := make(chan string, 1)
+	s.StreamTap(func(r io.Reader) {
+		v := sha256.New()
+		io.Copy(v, r)
+		h <- hex.EncodeToString(v.Sum(nil))
+	})
+	p := switchproxytest.NewProxy(t, s)
+	d := bytes.Repeat([]byte("streamed body "), 10000)
+	// Hiding the reader type leaves the length unknown, so the body is sent
+	// chunked and streamed to the Switch.
+	q, err := http.NewRequest(http.MethodPost, p.URL, struct{ io.Reader }{bytes.NewReader(d)})
+	if err != nil {
+		t.Fatalf("create request failed: %s", err)
+	}
+	do(t, q)
+	if b := <-u; !bytes.Equal(b, d) {
+		t.Fatalf("target received %d bytes, want the whole %d byte body", len(b), len(d))
+	}
+	e := sha256.Sum256(d)
+	if v := <-h; v != hex.EncodeToString(e[:]) {
+		t.Fatalf("StreamTap SHA-256 = %s, want %x", v, e)
+	}
+}
+func TestMaxResponseBody(t *testing.T) {
+	c := make(chan struct{}, 4)
+	v := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if r.URL.Path == "/large" {
+			n = 1 << 20
+		}
+		w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+	v.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			c <- struct{}{}
+		}
+	}
+	v.Start()
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.MaxResponseBody(1024)
+	p := switchproxytest.NewProxy(t, s)
+	if o, b := get(t, p.URL+"/small"); o.StatusCode != http.StatusOK || len(b) != 10 {
+		t.Fatalf("response = %d with %d bytes, want the small body", o.StatusCode, len(b))
+	}
+	o, b := get(t, p.URL+"/large")
+	if o.StatusCode != http.StatusBadGateway || strings.Contains(b, "xxx") {
+		t.Fatalf("response = %d %q, want a 502 without any of the upstream body", o.StatusCode, b)
+	}
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection was not closed after the oversized response")
+	}
+}
+func TestSetRewritesRace(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	s.SetRewrites(map[string]string{"/a": "/one"})
+	p := switchproxytest.NewProxy(t, s)
+	var (
+		g sync.WaitGroup
+		n atomic.Int64
+		e = make(chan string, 1)
+		d = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			for {
+				select {
+				case <-d:
+					return
+				default:
+				}
+				o, err := http.Get(p.URL + "/a/x")
+				if err != nil {
+					continue
+				}
+				b, _ := io.ReadAll(o.Body)
+				o.Body.Close()
+				if n.Add(1); string(b) != "/one/x" && string(b) != "/two/x" {
+					select {
+					case e <- string(b):
+					default:
+					}
+				}
+			}
+		}()
+	}
+	// Keep changing the rewrites until enough requests have been served.
+	for i := 0; n.Load() < 200; i++ {
+		time.Sleep(time.Millisecond)
+		switch i % 3 {
+		case 0:
+			s.SetRewrites(map[string]string{"/a": "/two"})
+		case 1:
+			s.Rewrite("/a", "/one")
+			s.Rewrite("/b", "/other")
+		default:
+			s.RemoveRewrite("/b")
+		}
+	}
+	close(d)
+	g.Wait()
+	select {
+	case v := <-e:
+		t.Fatalf("response path = %q, want one of the rewrites", v)
+	default:
+	}
+}
+func TestMaxConnsPerHost(t *testing.T) {
+	var c, m atomic.Int64
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := c.Add(1)
+		for x := m.Load(); n > x && !m.CompareAndSwap(x, n); x = m.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+		c.Add(-1)
+		w.Write([]byte("ok"))
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 2*time.Second)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.MaxConnsPerHost(1)
+	p := switchproxytest.NewProxy(t, s)
+	var (
+		g sync.WaitGroup
+		e = make(chan int, 6)
+	)
+	for i := 0; i < 6; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			o, err := http.Get(p.URL)
+			if err != nil {
+				e <- 0
+				return
+			}
+			o.Body.Close()
+			e <- o.StatusCode
+		}()
+	}
+	g.Wait()
+	close(e)
+	for x := range e {
+		if x != http.StatusOK {
+			t.Fatalf("queued request returned %d, want 200", x)
+		}
+	}
+	if x := m.Load(); x != 1 {
+		t.Fatalf("target saw %d concurrent requests, want 1", x)
+	}
+}
+func TestMaxConnsPerHostTimeout(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitchTimeout(v.URL, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.MaxConnsPerHost(1)
+	p := switchproxytest.NewProxy(t, s)
+	e := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			o, err := http.Get(p.URL)
+			if err != nil {
+				e <- 0
+				return
+			}
+			o.Body.Close()
+			e <- o.StatusCode
+		}()
+	}
+	// Queued requests must fail with the Switch timeout instead of waiting
+	// for the connection forever.
+	for i := 0; i < 3; i++ {
+		select {
+		case x := <-e:
+			if x == http.StatusOK {
+				t.Fatal("request returned 200, want the Switch timeout")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued request did not time out")
+		}
+	}
+}
+func TestResponseHeaderFunc(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	s.ResponseHeaderFunc(func(c int, h http.Header) {
+		if c >= 500 {
+			h.Set("Cache-Control", "no-store")
+		}
+	})
+	p := switchproxytest.NewProxy(t, s)
+	if o, _ := get(t, p.URL+"/ok"); o.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("Cache-Control = %q on a 200, want the target value", o.Header.Get("Cache-Control"))
+	}
+	if o, _ := get(t, p.URL+"/fail"); o.StatusCode != http.StatusServiceUnavailable || o.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("response = %d, Cache-Control = %q, want no-store on a 5xx", o.StatusCode, o.Header.Get("Cache-Control"))
+	}
+}
+func TestRewriteHost(t *testing.T) {
+	v := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path)
+	}))
+	defer v.Close()
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("NewSwitch failed: %s", err)
+	}
+	s.Rewrite("/tenant-a/", "/")
+	s.RewriteHost("/tenant-a/", "a.example.com")
+	s.RewriteHost("/tenant-a/admin/", "admin.example.com")
+	p := switchproxytest.NewProxy(t, s)
+	u := strings.TrimPrefix(v.URL, "http://")
+	for i, c := range [...]struct {
+		path, want string
+	}{
+		{"/tenant-a/list", "a.example.com /list"},
+		{"/tenant-a/admin/users", "admin.example.com /admin/users"},
+		{"/other", u + " /other"},
+	} {
+		if _, b := get(t, p.URL+c.path); b != c.want {
+			t.Fatalf("request %d (%s) = %q, want %q", i, c.path, b, c.want)
+		}
+	}
+}
+func TestStats(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer b.Close()
+	s, err := switchproxy.NewSwitch(a.URL)
+	if err != nil {
+		t.Fatalf("create Switch failed: %s", err)
+	}
+	s.AddTarget(b.URL)
+	f := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "fallback")
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	p.Fallback(f)
+	if _, v := get(t, p.URL+"/"); v != "ok" {
+		t.Fatalf("GET response = %q, want the second target", v)
+	}
+	// A POST is not retried, so the fallback is used.
+	if _, v := post(t, p.URL+"/", "body"); v != "fallback" {
+		t.Fatalf("POST response = %q, want the fallback", v)
+	}
+	if v := s.Stats(); v.Requests != 3 || v.Retries != 1 || v.Failures != 2 || v.Fallbacks != 0 {
+		t.Fatalf("primary Stats = %+v, want 3 requests, 1 retry and 2 failures", v)
+	}
+	if v := f.Stats(); v.Requests != 1 || v.Fallbacks != 1 || v.Failures != 0 {
+		t.Fatalf("fallback Stats = %+v, want 1 request and 1 fallback", v)
+	}
+	s.HealthCheck(5*time.Millisecond, "/")
+	defer s.HealthCheck(0, "")
+	for i := 0; i < 100 && s.Stats().Unhealthy == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Stats().Unhealthy == 0 {
+		t.Fatal("Unhealthy = 0 after failed health checks, want at least 1")
+	}
+}
+func TestCaptureOriginalPath(t *testing.T) {
+	c := make(chan string, 1)
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		c <- r.URL.Path
+	}))
+	s.Rewrite("/api/", "/v2/")
+	r := make(chan switchproxy.Result, 2)
+	s.Pre = func(v switchproxy.Result) { r <- v }
+	s.Post = func(v switchproxy.Result) { r <- v }
+	p := switchproxytest.NewProxy(t, s)
+	for _, e := range []bool{false, true} {
+		s.CaptureOriginalPath(e)
+		get(t, p.URL+"/api/users?id=1")
+		if v := <-c; v != "/v2/users" {
+			t.Fatalf("forwarded path = %q, want the rewritten path", v)
+		}
+		w := "/v2/users"
+		if e {
+			w = "/api/users"
+		}
+		for _, n := range [...]string{"Pre", "Post"} {
+			if v := <-r; v.Path != w || !strings.HasSuffix(v.URL, w+"?id=1") {
+				t.Fatalf("CaptureOriginalPath(%t) %s Result path = %q, URL = %q, want %q", e, n, v.Path, v.URL, w)
+			}
+		}
+	}
+}
+func TestServerTiming(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Server-Timing", "db;dur=1.5")
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	p := switchproxytest.NewProxy(t, s)
+	if o, _ := get(t, p.URL); len(o.Header.Values("Server-Timing")) != 1 {
+		t.Fatalf("Server-Timing = %q, want only the target value by default", o.Header.Values("Server-Timing"))
+	}
+	s.ServerTiming(true)
+	o, _ := get(t, p.URL)
+	v := o.Header.Values("Server-Timing")
+	if len(v) != 2 || v[0] != "db;dur=1.5" || !strings.HasPrefix(v[1], "upstream;dur=") {
+		t.Fatalf("Server-Timing = %q, want the target value and an upstream entry", v)
+	}
+	d, err := strconv.ParseFloat(strings.TrimPrefix(v[1], "upstream;dur="), 64)
+	if err != nil {
+		t.Fatalf("Server-Timing duration %q is not a number: %s", v[1], err)
+	}
+	// The target waits 20ms, so the round trip takes at least that long.
+	if d < 20 || d > 10000 {
+		t.Fatalf("Server-Timing duration = %gms, want at least 20ms", d)
+	}
+}
+func TestLocalAddr(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, _, _ := net.SplitHostPort(r.RemoteAddr)
+		io.WriteString(w, a)
+	})
+	for _, c := range [...]struct {
+		addr, want string
+	}{
+		{"127.0.0.2", "127.0.0.2"},
+		{"127.0.0.3:0", "127.0.0.3"},
+		{"", "127.0.0.1"},
+	} {
+		s := switchproxytest.NewSwitch(t, h)
+		if err := s.LocalAddr(c.addr); err != nil {
+			t.Fatalf("LocalAddr(%q) failed: %s", c.addr, err)
+		}
+		if _, b := get(t, switchproxytest.NewProxy(t, s).URL); b != c.want {
+			t.Fatalf("LocalAddr(%q): target saw the source address %q, want %q", c.addr, b, c.want)
+		}
+	}
+	s := switchproxytest.NewSwitch(t, h)
+	for _, v := range []string{"localhost", "example.com:80", "127.0.0.1:port", "127.0.0.1:1:2"} {
+		if err := s.LocalAddr(v); err == nil {
+			t.Fatalf("LocalAddr(%q) succeeded, want an invalid address error", v)
+		}
+	}
+}
+func TestRewriteJoinMode(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	s.Rewrite("/api/", "/v2/")
+	p := switchproxy.New("127.0.0.1:0")
+	p.Primary(s)
+	for _, c := range [...]struct {
+		m          switchproxy.JoinMode
+		path, want string
+	}{
+		{switchproxy.JoinClean, "/api//files/./a.txt", "/v2/files/a.txt"},
+		{switchproxy.JoinClean, "/api/dir/", "/v2/dir"},
+		{switchproxy.JoinConcat, "/api//files/./a.txt", "/v2//files/./a.txt"},
+		{switchproxy.JoinConcat, "/api/dir/", "/v2/dir/"},
+	} {
+		s.RewriteJoinMode(c.m)
+		// ServeHTTP is used, as the Proxy server redirects unclean paths.
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.path, nil))
+		if b := w.Body.String(); b != c.want {
+			t.Fatalf("mode %d: %s was sent as %q, want %q", c.m, c.path, b, c.want)
+		}
+	}
+	// Paths without unclean elements keep their trailing slash when served.
+	if _, b := get(t, switchproxytest.NewProxy(t, s).URL+"/api/dir/"); b != "/v2/dir/" {
+		t.Fatalf("JoinConcat: /api/dir/ was sent as %q, want %q", b, "/v2/dir/")
+	}
+}
+func TestCloseIdleOnError(t *testing.T) {
+	type broken struct{}
+	for _, e := range []bool{false, true} {
+		var (
+			f atomic.Bool
+			n atomic.Int32
+			v = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Connections made while the target is failing stay broken, even
+				// after it recovers.
+				if r.Context().Value(broken{}).(bool) {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				io.WriteString(w, "ok")
+			}))
+		)
+		v.Config.ConnContext = func(x context.Context, _ net.Conn) context.Context {
+			n.Add(1)
+			return context.WithValue(x, broken{}, f.Load())
+		}
+		v.Start()
+		s, err := switchproxy.NewSwitch(v.URL)
+		if err != nil {
+			t.Fatalf("create Switch failed: %s", err)
+		}
+		s.CloseIdleOnError(e)
+		p := switchproxytest.NewProxy(t, s)
+		f.Store(true)
+		if o, _ := get(t, p.URL); o.StatusCode != http.StatusBadGateway {
+			t.Fatalf("CloseIdleOnError(%t): status while failing = %d, want 502", e, o.StatusCode)
+		}
+		f.Store(false)
+		o, _ := get(t, p.URL)
+		if e && (o.StatusCode != http.StatusOK || n.Load() != 2) {
+			t.Fatalf("CloseIdleOnError(true): status after recovery = %d with %d connections, want 200 on a new connection", o.StatusCode, n.Load())
+		}
+		if !e && (o.StatusCode != http.StatusBadGateway || n.Load() != 1) {
+			t.Fatalf("CloseIdleOnError(false): status after recovery = %d with %d connections, want the pooled connection reused", o.StatusCode, n.Load())
+		}
+		// Successful requests keep the connection pool working.
+		if e {
+			get(t, p.URL)
+			if get(t, p.URL); n.Load() != 2 {
+				t.Fatalf("CloseIdleOnError(true): %d connections after successful requests, want the pooled connection reused", n.Load())
+			}
+		}
+		v.Close()
+	}
+}
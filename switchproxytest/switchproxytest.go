@@ -0,0 +1,74 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// Package switchproxytest provides helpers for testing code that uses Switches
+// and Proxies, in the same style as the net/http/httptest package.
+package switchproxytest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy"
+)
+
+// Server is a Proxy listening on a local ephemeral port, which is created by
+// 'NewProxy'.
+type Server struct {
+	*switchproxy.Proxy
+
+	// URL is the base URL of the Proxy, in the form "http://ipaddr:port" with
+	// no trailing slash.
+	URL string
+}
+
+// NewSwitch starts a httptest.Server using the specified Handler and returns a
+// Switch that targets it. The Server is closed when the test finishes.
+func NewSwitch(t testing.TB, h http.Handler) *switchproxy.Switch {
+	t.Helper()
+	v := httptest.NewServer(h)
+	t.Cleanup(v.Close)
+	s, err := switchproxy.NewSwitch(v.URL)
+	if err != nil {
+		t.Fatalf("switchproxytest: create Switch: %s", err)
+	}
+	return s
+}
+
+// NewProxy creates and starts a Proxy that uses the specified Switch as the
+// primary, listening on a local ephemeral port. The Proxy is closed when the
+// test finishes.
+func NewProxy(t testing.TB, primary *switchproxy.Switch, c ...switchproxy.Parameter) *Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("switchproxytest: listen: %s", err)
+	}
+	s := &Server{Proxy: switchproxy.New(l.Addr().String(), c...), URL: "http://" + l.Addr().String()}
+	s.Primary(primary)
+	d := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(d)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-d
+	})
+	return s
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxytest_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestNewProxy(t *testing.T) {
+	var u string
+	t.Run("serve", func(t *testing.T) {
+		p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("upstream " + r.URL.Path))
+		})))
+		u = p.URL
+		o, err := http.Get(u + "/path")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		b, _ := io.ReadAll(o.Body)
+		if o.Body.Close(); string(b) != "upstream /path" {
+			t.Fatalf("response = %q, want the upstream response", b)
+		}
+	})
+	// The Proxy should be closed by the cleanup of the finished test.
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if o, err := c.Get(u); err == nil {
+		o.Body.Close()
+		t.Fatal("Proxy is still serving after the test finished")
+	}
+}
+func TestNewSwitch(t *testing.T) {
+	s := switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	o, err := (&http.Client{Transport: s}).Get("http://example.com/")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, _ := io.ReadAll(o.Body)
+	if o.Body.Close(); string(b) != "ok" {
+		t.Fatalf("response = %q, want the handler response", b)
+	}
+}
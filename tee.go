@@ -0,0 +1,107 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+type streamer struct {
+	w    http.ResponseWriter
+	o    *config
+	b    *bytes.Buffer
+	c    *http.ResponseController
+	err  error
+	via  string
+	n    int64
+	head bool
+	over bool
+}
+
+// StreamResponses sets the largest response body, in bytes, that will be kept
+// while a response from the primary Switch is streamed to the client.
+//
+// Without this, responses are fully read before being written to the client.
+// When set, the response is written to the client as it is received, while the
+// body is copied into the Result Content that is passed to the Post Handlers,
+// observers, sinks and the debug ring. Responses with bodies larger than the
+// limit are still streamed, but are passed on without any Content. If the
+// Switch target fails after the response was started, the response to the
+// client is aborted.
+//
+// This has no effect when a fallback Switch, 'DualRun', 'Cache' or 'Coalesce'
+// is used, as they need the whole response. Responses with a failure status,
+// which may be tried again, and responses that the Switch adds a digest to are
+// also still buffered. A value of zero or less disables this (the default).
+func (p *Proxy) StreamResponses(n int64) {
+	p.lock.Lock()
+	p.tee = n
+	p.lock.Unlock()
+}
+func (t *transfer) streamed() bool {
+	return t.resp != nil && t.resp.head
+}
+func (v *streamer) keep(b []byte) {
+	if v.over {
+		return
+	}
+	if int64(v.b.Len()+len(b)) > v.n {
+		// Drop the copy if it is too large, but keep the stream to the client
+		// working.
+		v.over = true
+		v.b.Reset()
+		return
+	}
+	v.b.Write(b)
+}
+func (v *streamer) content() []byte {
+	if v.over {
+		return nil
+	}
+	return v.b.Bytes()
+}
+
+// Write satisfies the io.Writer interface.
+func (v *streamer) Write(b []byte) (int, error) {
+	if v.keep(b); v.err != nil {
+		return 0, v.err
+	}
+	if v.err = v.o.write(v.w, b); v.err != nil {
+		// The copy is incomplete, so it cannot be used.
+		v.over = true
+		v.b.Reset()
+		return 0, v.err
+	}
+	v.c.Flush()
+	return len(b), nil
+}
+func (v *streamer) start(s *Switch, c int, h http.Header, n int64) {
+	v.head, v.c = true, http.NewResponseController(v.w)
+	// The length of the body is only known if the Switch target sent it.
+	if v.o.head(v.w, s, h); n >= 0 && hasBody(c) {
+		v.w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	} else {
+		v.w.Header().Del("Content-Length")
+	}
+	if len(v.via) > 0 {
+		v.w.Header().Add("Via", v.via)
+	}
+	v.w.WriteHeader(c)
+	v.c.Flush()
+}
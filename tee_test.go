@@ -0,0 +1,105 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+func TestStreamResponses(t *testing.T) {
+	d := make([]byte, 256<<10)
+	rand.Read(d)
+	var (
+		c = make(chan struct{}, 1)
+		v = make(chan []byte, 1)
+		s = switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(d[:1000])
+			w.(http.Flusher).Flush()
+			switch r.URL.Path {
+			case "/wait":
+				// The rest is only sent once the client has the start, so the
+				// response must be streamed.
+				<-c
+			case "/fail":
+				panic(http.ErrAbortHandler)
+			}
+			w.Write(d[1000:])
+		}))
+		p = switchproxytest.NewProxy(t, s)
+	)
+	// Unblock the target before the Proxy is closed, in case it was not.
+	t.Cleanup(func() { close(c) })
+	p.AddObserver(func(r switchproxy.Result) {
+		if r.IsResponse() {
+			v <- append([]byte(nil), r.Content...)
+		}
+	})
+	p.StreamResponses(1 << 20)
+	o, err := http.Get(p.URL + "/wait")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer o.Body.Close()
+	var (
+		b = make([]byte, 1000)
+		e = make(chan error, 1)
+	)
+	go func() {
+		_, err := io.ReadFull(o.Body, b)
+		e <- err
+	}()
+	select {
+	case err = <-e:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the start of the response was not streamed to the client")
+	}
+	if c <- struct{}{}; err != nil || !bytes.Equal(b, d[:1000]) {
+		t.Fatalf("read start of response failed: %v", err)
+	}
+	r, err := io.ReadAll(o.Body)
+	if err != nil || !bytes.Equal(append(b, r...), d) {
+		t.Fatalf("client received %d bytes (%v), want the identical %d byte body", len(b)+len(r), err, len(d))
+	}
+	if w := <-v; !bytes.Equal(w, d) {
+		t.Fatalf("observer received %d bytes, want the identical %d byte body", len(w), len(d))
+	}
+	// Bodies over the limit are still streamed, but are not copied.
+	p.StreamResponses(1024)
+	if o, w := get(t, p.URL); o.StatusCode != http.StatusOK || w != string(d) {
+		t.Fatalf("client response = %d (%d bytes), want the %d byte body", o.StatusCode, len(w), len(d))
+	}
+	if w := <-v; len(w) != 0 {
+		t.Fatalf("observer received %d bytes, want no content over the limit", len(w))
+	}
+	// A target that fails after the response started must not look like a
+	// complete response to the client.
+	if o, err = http.Get(p.URL + "/fail"); err == nil {
+		_, err = io.ReadAll(o.Body)
+		o.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("client read a complete response from a failed target")
+	}
+}
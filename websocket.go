@@ -0,0 +1,304 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxMessage is the largest WebSocket message that will be passed to the
+// 'OnWSMessage' functions. Inspection of a connection stops once a larger
+// message is seen, but the messages are still relayed.
+const maxMessage = 16 << 20
+
+const (
+	// WSFromClient is the direction passed to 'OnWSMessage' functions for
+	// messages sent by the client.
+	WSFromClient = iota
+	// WSFromServer is the direction passed to 'OnWSMessage' functions for
+	// messages sent by the Switch target.
+	WSFromServer
+)
+
+type frames struct {
+	f   func(int, byte, []byte)
+	b   []byte
+	m   []byte
+	d   int
+	op  byte
+	off bool
+}
+
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, e := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(e), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OnWSMessage sets a function that will be called with each message that is
+// relayed over a WebSocket connection, along with the direction (WSFromClient
+// or WSFromServer) and the frame opcode. Fragmented messages are combined and
+// passed with the opcode of the first frame. Control frames (close, ping and
+// pong) are passed as they are received.
+//
+// The messages are only observed and are relayed unchanged. The function is
+// called while relaying, so it should return quickly. WebSocket compression is
+// not offered to the target while this is set, so the payloads are readable.
+// Secondary Switches with this set are passed the messages of any WebSocket
+// connections made through the primary Switch. Passing nil disables this.
+func (s *Switch) OnWSMessage(f func(direction int, opcode byte, payload []byte)) {
+	s.lock.Lock()
+	s.onWS = f
+	s.lock.Unlock()
+}
+
+// serveWebSocket handles WebSocket upgrade requests, which are passed to the
+// primary Switch and then relayed in both directions until either side closes
+// the connection. The 'OnRequest' function is still used to allow or reject
+// the request before it is sent.
+func (p *Proxy) serveWebSocket(o *config, w http.ResponseWriter, r *http.Request) {
+	if o.onRequest != nil {
+		if err := o.onRequest(r); err != nil {
+			c := http.StatusForbidden
+			if e := (*StatusError)(nil); errors.As(err, &e) && e.Status > 0 {
+				c = e.Status
+			}
+			o.reject(w, r, c)
+			return
+		}
+	}
+	s, z := o.switches(r)
+	if s == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	var h []func(int, byte, []byte)
+	for _, v := range append([]*Switch{s}, z...) {
+		v.lock.RLock()
+		if v.onWS != nil {
+			h = append(h, v.onWS)
+		}
+		v.lock.RUnlock()
+	}
+	var f func(int, byte, []byte)
+	if len(h) > 0 {
+		f = func(d int, c byte, b []byte) {
+			for i := range h {
+				h[i](d, c, b)
+			}
+		}
+	}
+	if ok, err := s.tunnel(r.Context(), w, r, f); err != nil {
+		if o.error(r, err); !ok {
+			c := errorStatus(err)
+			http.Error(w, http.StatusText(c), c)
+		}
+	}
+}
+func (s *Switch) tunnel(x context.Context, w http.ResponseWriter, r *http.Request, f func(int, byte, []byte)) (bool, error) {
+	a := s.target(s.URL, r)
+	if !s.allowed(a) {
+		return false, &StatusError{Err: ErrTargetDenied, Status: http.StatusForbidden}
+	}
+	q, err := http.NewRequestWithContext(x, r.Method, a.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	// The "Connection" header is removed from forwarded requests, but is needed
+	// here to ask the target to switch protocols.
+	q.Header, q.Host = s.outgoing(r).Clone(), s.host(r.URL.Path)
+	q.Header.Set("Connection", "Upgrade")
+	q.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	if f != nil {
+		q.Header.Del("Sec-Websocket-Extensions")
+	}
+	u := newUUID()
+	pre, post := s.handlers()
+	if pre != nil {
+		pre(Result{
+			IP:      r.RemoteAddr,
+			URL:     a.String(),
+			UUID:    u,
+			Path:    a.Path,
+			Target:  a.Host,
+			Method:  r.Method,
+			Headers: s.headers(r.Header),
+		})
+	}
+	o, err := s.tr.RoundTrip(q)
+	if err != nil {
+		return false, classify(err)
+	}
+	if post != nil {
+		post(Result{
+			IP:      r.RemoteAddr,
+			URL:     a.String(),
+			Path:    a.Path,
+			UUID:    u,
+			Target:  a.Host,
+			Status:  uint16(o.StatusCode),
+			Method:  r.Method,
+			Headers: s.headers(o.Header),
+		})
+	}
+	if o.StatusCode != http.StatusSwitchingProtocols {
+		// The target refused the upgrade, so the response is passed on as is.
+		s.copyHeaders(w.Header(), o.Header)
+		w.WriteHeader(o.StatusCode)
+		_, err = io.Copy(w, o.Body)
+		o.Body.Close()
+		return true, err
+	}
+	b, ok := o.Body.(io.ReadWriteCloser)
+	if !ok {
+		o.Body.Close()
+		return false, errors.New("target connection cannot be used for upgrade")
+	}
+	defer b.Close()
+	c, v, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	h := make(http.Header, len(o.Header))
+	s.copyHeaders(h, o.Header)
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", o.Header.Get("Upgrade"))
+	v.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(v)
+	v.WriteString("\r\n")
+	if err = v.Flush(); err != nil {
+		return true, err
+	}
+	var (
+		d = io.Writer(c)
+		k = io.Reader(v)
+		e = make(chan error, 1)
+	)
+	if f != nil {
+		d = io.MultiWriter(c, &frames{f: f, d: WSFromServer})
+		k = io.TeeReader(v, &frames{f: f, d: WSFromClient})
+	}
+	go func() {
+		_, err := io.Copy(d, b)
+		e <- err
+	}()
+	_, err = io.Copy(b, k)
+	// Closing both sides stops the other copy, if it is still running.
+	c.Close()
+	b.Close()
+	if err2 := <-e; err == nil {
+		err = err2
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true, nil
+	}
+	return true, err
+}
+
+// Write satisfies the io.Writer interface.
+func (f *frames) Write(b []byte) (int, error) {
+	if f.off {
+		return len(b), nil
+	}
+	f.b = append(f.b, b...)
+	var i int
+	for {
+		n := f.next(f.b[i:])
+		if n == 0 || f.off {
+			break
+		}
+		i += n
+	}
+	if f.off {
+		f.b, f.m = nil, nil
+		return len(b), nil
+	}
+	f.b = f.b[:copy(f.b, f.b[i:])]
+	return len(b), nil
+}
+func (f *frames) next(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	var (
+		h = 2
+		n = uint64(b[1] & 0x7F)
+	)
+	switch n {
+	case 126:
+		if len(b) < 4 {
+			return 0
+		}
+		n, h = uint64(binary.BigEndian.Uint16(b[2:])), 4
+	case 127:
+		if len(b) < 10 {
+			return 0
+		}
+		n, h = binary.BigEndian.Uint64(b[2:]), 10
+	}
+	var k []byte
+	if b[1]&0x80 != 0 {
+		if len(b) < h+4 {
+			return 0
+		}
+		k, h = b[h:h+4], h+4
+	}
+	if n > maxMessage || n+uint64(len(f.m)) > maxMessage {
+		f.off = true
+		return 0
+	}
+	if uint64(len(b)-h) < n {
+		return 0
+	}
+	p := make([]byte, n)
+	copy(p, b[h:])
+	for i := range k {
+		for j := i; j < len(p); j += 4 {
+			p[j] ^= k[i]
+		}
+	}
+	switch c, e := b[0]&0x0F, b[0]&0x80 != 0; {
+	case c >= 8:
+		// Control frames can be sent between the frames of a fragmented message.
+		f.f(f.d, c, p)
+	case c == 0:
+		if f.m = append(f.m, p...); e {
+			f.f(f.d, f.op, f.m)
+			f.m = nil
+		}
+	case e:
+		f.f(f.d, c, p)
+	default:
+		f.op, f.m = c, p
+	}
+	return h + int(n)
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package switchproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PurpleSec/switchproxy"
+	"github.com/PurpleSec/switchproxy/switchproxytest"
+)
+
+type message struct {
+	d int
+	c byte
+	b string
+}
+
+func wsFrame(fin bool, op byte, p string) []byte {
+	b := []byte{op, 0x80 | byte(len(p)), 1, 2, 3, 4}
+	if fin {
+		b[0] |= 0x80
+	}
+	for i := range len(p) {
+		b = append(b, p[i]^b[2+i%4])
+	}
+	return b
+}
+func TestWebSocket(t *testing.T) {
+	var (
+		x = make(chan string, 1)
+		f = make(chan string, 1)
+	)
+	v := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x <- r.Header.Get("Sec-Websocket-Extensions")
+		f <- r.Header.Get("X-Forwarded-Proto") + " " + r.Header.Get("X-Forwarded-Host")
+		c, b, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		b.Flush()
+		// Echo the client frames back as is, masks included.
+		io.Copy(c, b)
+	})
+	var (
+		m = make(chan message, 16)
+		s = switchproxytest.NewSwitch(t, v)
+	)
+	s.OnWSMessage(func(d int, c byte, b []byte) { m <- message{d, c, string(b)} })
+	p := switchproxytest.NewProxy(t, s)
+	if err := p.ExternalURL("https://public.example.com"); err != nil {
+		t.Fatalf("set external URL failed: %s", err)
+	}
+	c, err := net.Dial("tcp", strings.TrimPrefix(p.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(c, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+	r := bufio.NewReader(c)
+	o, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", o.StatusCode)
+	}
+	if e := <-x; e != "" {
+		t.Fatalf("target was offered extensions %q", e)
+	}
+	if e := <-f; e != "https public.example.com" {
+		t.Fatalf("target forwarded headers = %q, want the external URL", e)
+	}
+	var w []byte
+	w = append(w, wsFrame(true, 1, "hello")...)
+	w = append(w, wsFrame(false, 1, "frag")...)
+	w = append(w, wsFrame(true, 9, "ping")...)
+	w = append(w, wsFrame(true, 0, "mented")...)
+	w = append(w, wsFrame(true, 2, "\x00\x01\x02")...)
+	// Write in small pieces so frames are split across reads.
+	for i := 0; i < len(w); i += 3 {
+		if _, err := c.Write(w[i:min(i+3, len(w))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := make([]byte, len(w))
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, w) {
+		t.Fatalf("relayed frames = %x, want %x", b, w)
+	}
+	want := []message{
+		{switchproxy.WSFromClient, 1, "hello"},
+		{switchproxy.WSFromClient, 9, "ping"},
+		{switchproxy.WSFromClient, 1, "fragmented"},
+		{switchproxy.WSFromClient, 2, "\x00\x01\x02"},
+	}
+	got := map[int][]message{}
+	for range len(want) * 2 {
+		select {
+		case e := <-m:
+			got[e.d] = append(got[e.d], e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for messages, got %v", got)
+		}
+	}
+	for i := range want {
+		e := want[i]
+		if got[switchproxy.WSFromClient][i] != e {
+			t.Fatalf("client message %d = %v, want %v", i, got[switchproxy.WSFromClient][i], e)
+		}
+		if e.d = switchproxy.WSFromServer; got[switchproxy.WSFromServer][i] != e {
+			t.Fatalf("server message %d = %v, want %v", i, got[switchproxy.WSFromServer][i], e)
+		}
+	}
+}
+func TestWebSocketRefused(t *testing.T) {
+	p := switchproxytest.NewProxy(t, switchproxytest.NewSwitch(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "no upgrades", http.StatusBadRequest)
+	})))
+	q, _ := http.NewRequest(http.MethodGet, p.URL+"/ws", nil)
+	q.Header.Set("Connection", "Upgrade")
+	q.Header.Set("Upgrade", "websocket")
+	o, b := do(t, q)
+	if o.StatusCode != http.StatusBadRequest || b != "no upgrades\n" {
+		t.Fatalf("refused upgrade = %d %q, want 400 %q", o.StatusCode, b, "no upgrades\n")
+	}
+}